@@ -0,0 +1,83 @@
+package incognitomail
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	// ErrInvalidACMECA is used when the file with the certificates trusted for the ACME directory has no certificates.
+	ErrInvalidACMECA = errors.New("no certificates found in the ACME CA file")
+)
+
+// newACMEManagerFromConfig returns a manager that obtains and renews certificates for the configured domains from the configured ACME directory.
+func newACMEManagerFromConfig(c ACMEConfig) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: c.DirectoryURL}
+
+	// Test servers such as Pebble use their own CA, which must be trusted explicitly
+	if c.DirectoryCAFile != "" {
+		pem, err := ioutil.ReadFile(c.DirectoryCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrInvalidACMECA
+		}
+
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Domain...),
+		Cache:      autocert.DirCache(c.CacheDir),
+		Email:      c.Email,
+		Client:     client,
+	}, nil
+}
+
+// checkACMEConfig records any invalid value in the ACME section of the configuration.
+func checkACMEConfig(c *Configuration, p *configProblems) {
+	if !c.ACME.Enabled {
+		return
+	}
+
+	if len(c.ACME.Domain) == 0 {
+		p.add("ACME.Domain", "must be set when ACME is enabled")
+	}
+	for _, domain := range c.ACME.Domain {
+		if !validDomainName(domain) {
+			p.add("ACME.Domain", "%q is not a valid domain", domain)
+		}
+	}
+	p.required("ACME.CacheDir", c.ACME.CacheDir)
+	p.absolutePath("ACME.CacheDir", c.ACME.CacheDir)
+	p.required("ACME.DirectoryURL", c.ACME.DirectoryURL)
+	p.absolutePath("ACME.DirectoryCAFile", c.ACME.DirectoryCAFile)
+	if c.ACME.HTTPAddress != "" {
+		p.address("ACME.HTTPAddress", c.ACME.HTTPAddress)
+	}
+
+	// Certificates come either from files or from ACME, never both
+	if c.General.TLSCertFile != "" || c.General.TLSKeyFile != "" {
+		p.add("ACME.Enabled", "can't be used together with General.TLSCertFile and General.TLSKeyFile")
+	}
+
+	// The ACME server doesn't have a client certificate, so TLS challenges in ListenAddress would always fail
+	if c.General.TLSClientCAFile != "" && c.ACME.HTTPAddress == "" {
+		p.add("ACME.HTTPAddress", "must be set when General.TLSClientCAFile is used, since TLS challenges can't be answered")
+	}
+}
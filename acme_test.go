@@ -0,0 +1,104 @@
+package incognitomail_test
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+// newACMEDirectory starts a TLS server answering like the directory of an ACME server, such as Pebble, with a certificate from its own CA. Must be closed by the caller.
+func newACMEDirectory() *httptest.Server {
+	var ts *httptest.Server
+
+	ts = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/dir" {
+			http.NotFound(w, req)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   ts.URL + "/nonce-plz",
+			"newAccount": ts.URL + "/sign-me-up",
+			"newOrder":   ts.URL + "/order-plz",
+			"revokeCert": ts.URL + "/revoke-cert",
+			"keyChange":  ts.URL + "/rollover-account-key",
+		})
+	}))
+
+	return ts
+}
+
+// Ensure the ACME directory is trusted through DirectoryCAFile, and not trusted without it.
+func TestNewACMEManager_DirectoryCAFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "incognitomail_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := newACMEDirectory()
+	defer ts.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+
+	err = ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := incognitomail.DefaultConfiguration().ACME
+	config.Enabled = true
+	config.Domain = []string{"sidhion.com"}
+	config.CacheDir = filepath.Join(dir, "acme")
+	config.DirectoryURL = ts.URL + "/dir"
+	config.DirectoryCAFile = caFile
+
+	m, err := incognitomail.NewACMEManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	directory, err := m.Client.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("expected the directory to be trusted, got %v", err)
+	}
+
+	if directory.OrderURL != ts.URL+"/order-plz" {
+		t.Errorf("expected the order URL of the directory, got %q", directory.OrderURL)
+	}
+
+	config.DirectoryCAFile = ""
+
+	m, err = incognitomail.NewACMEManager(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.Client.Discover(context.Background())
+	if err == nil {
+		t.Error("expected the directory not to be trusted without its CA")
+	}
+
+	err = ioutil.WriteFile(caFile, []byte("not a certificate"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.DirectoryCAFile = caFile
+
+	_, err = incognitomail.NewACMEManager(config)
+	if err != incognitomail.ErrInvalidACMECA {
+		t.Errorf("expected ErrInvalidACMECA, got %v", err)
+	}
+}
@@ -0,0 +1,335 @@
+package incognitomail
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// apiHandler serves the REST API, which accepts and returns JSON. Every request is authenticated with the account secret as a bearer token, except the one creating new accounts.
+type apiHandler struct {
+	server *Service
+	prefix string
+}
+
+type apiAccountRequest struct {
+	Targets []string `json:"targets"`
+	Invite  string   `json:"invite,omitempty"`
+}
+
+type apiAccountResponse struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+type apiConfirmRequest struct {
+	Token string `json:"token"`
+}
+
+type apiHandleRequest struct {
+	Targets []string `json:"targets,omitempty"`
+}
+
+type apiHandleResponse struct {
+	Handle string `json:"handle"`
+}
+
+type apiHandlesResponse struct {
+	Handles []string `json:"handles"`
+}
+
+type apiErrorResponse struct {
+	Error string `json:"error"`
+}
+
+const (
+	// Requests with bodies bigger than this are refused while being decoded.
+	apiMaxBodySize = 64 * 1024
+)
+
+// newAPIHandler returns an http.Handler serving the REST API under the given path prefix.
+func newAPIHandler(s *Service, prefix string) http.Handler {
+	return &apiHandler{
+		server: s,
+		prefix: strings.TrimSuffix(prefix, "/"),
+	}
+}
+
+// ServeHTTP routes the request to the right endpoint, relative to the prefix:
+//
+//	POST   /accounts                  creates a new account
+//	DELETE /accounts/{id}             deletes the account
+//	POST   /accounts/{id}/confirm     confirms one of the account's targets
+//	POST   /accounts/{id}/handles     creates a new handle
+//	GET    /handles                   lists all handles of the account
+//	DELETE /handles/{handle}          deletes a handle
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	config := h.server.currentConfig()
+
+	// Scripts and other programs don't send an Origin header, and bearer tokens aren't sent automatically by browsers, so only web pages are checked against the allowed origins
+	err := checkOrigin(config.General.AllowedOrigin, true, req)
+	if err != nil {
+		writeAPIJSON(w, http.StatusForbidden, apiErrorResponse{Error: err.Error()})
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, h.prefix), "/")
+	segments := strings.Split(path, "/")
+
+	switch {
+	case len(segments) == 1 && segments[0] == "accounts":
+		if checkAPIMethod(w, req, http.MethodPost) {
+			h.newAccount(w, req)
+		}
+	case len(segments) == 2 && segments[0] == "accounts":
+		if checkAPIMethod(w, req, http.MethodDelete) {
+			h.deleteAccount(w, req, segments[1])
+		}
+	case len(segments) == 3 && segments[0] == "accounts" && segments[2] == "confirm":
+		if checkAPIMethod(w, req, http.MethodPost) {
+			h.confirmTarget(w, req, segments[1])
+		}
+	case len(segments) == 3 && segments[0] == "accounts" && segments[2] == "handles":
+		if checkAPIMethod(w, req, http.MethodPost) {
+			h.newHandle(w, req, segments[1])
+		}
+	case len(segments) == 1 && segments[0] == "handles":
+		if checkAPIMethod(w, req, http.MethodGet) {
+			h.listHandles(w, req)
+		}
+	case len(segments) == 2 && segments[0] == "handles":
+		if checkAPIMethod(w, req, http.MethodDelete) {
+			h.deleteHandle(w, req, segments[1], config.PostfixConfig.Domain)
+		}
+	default:
+		writeAPIJSON(w, http.StatusNotFound, apiErrorResponse{Error: "not found"})
+	}
+}
+
+// newAccount handles POST /accounts.
+func (h *apiHandler) newAccount(w http.ResponseWriter, req *http.Request) {
+	var body apiAccountRequest
+	if !decodeAPIBody(w, req, &body) {
+		return
+	}
+
+	res, err := h.server.runCommand(req.Context(), sourceHTTP, req.RemoteAddr, newAccountCommand{
+		source:     sourceHTTP,
+		remoteAddr: req.RemoteAddr,
+		targets:    body.Targets,
+		inviteCode: body.Invite,
+	})
+
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	secret, _ := res.(string)
+	writeAPIJSON(w, http.StatusCreated, apiAccountResponse{
+		ID:     AccountID(secret),
+		Secret: secret,
+	})
+}
+
+// deleteAccount handles DELETE /accounts/{id}.
+func (h *apiHandler) deleteAccount(w http.ResponseWriter, req *http.Request, id string) {
+	secret, ok := h.authenticate(w, req, id)
+	if !ok {
+		return
+	}
+
+	_, err := h.server.runCommand(req.Context(), sourceHTTP, req.RemoteAddr, deleteAccountCommand{
+		source:     sourceHTTP,
+		remoteAddr: req.RemoteAddr,
+		secret:     secret,
+	})
+
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// confirmTarget handles POST /accounts/{id}/confirm.
+func (h *apiHandler) confirmTarget(w http.ResponseWriter, req *http.Request, id string) {
+	secret, ok := h.authenticate(w, req, id)
+	if !ok {
+		return
+	}
+
+	var body apiConfirmRequest
+	if !decodeAPIBody(w, req, &body) {
+		return
+	}
+
+	_, err := h.server.runCommand(req.Context(), sourceHTTP, req.RemoteAddr, confirmTargetCommand{
+		source:     sourceHTTP,
+		remoteAddr: req.RemoteAddr,
+		secret:     secret,
+		token:      body.Token,
+	})
+
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newHandle handles POST /accounts/{id}/handles.
+func (h *apiHandler) newHandle(w http.ResponseWriter, req *http.Request, id string) {
+	secret, ok := h.authenticate(w, req, id)
+	if !ok {
+		return
+	}
+
+	var body apiHandleRequest
+	if !decodeAPIBody(w, req, &body) {
+		return
+	}
+
+	res, err := h.server.runCommand(req.Context(), sourceHTTP, req.RemoteAddr, newHandleCommand{
+		source:        sourceHTTP,
+		remoteAddr:    req.RemoteAddr,
+		accountSecret: secret,
+		targets:       body.Targets,
+	})
+
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	handle, _ := res.(string)
+	writeAPIJSON(w, http.StatusCreated, apiHandleResponse{Handle: handle})
+}
+
+// listHandles handles GET /handles.
+func (h *apiHandler) listHandles(w http.ResponseWriter, req *http.Request) {
+	secret, ok := h.authenticate(w, req, "")
+	if !ok {
+		return
+	}
+
+	res, err := h.server.runCommand(req.Context(), sourceHTTP, req.RemoteAddr, listHandlesCommand{
+		source:     sourceHTTP,
+		remoteAddr: req.RemoteAddr,
+		secret:     secret,
+	})
+
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	// Always returning an array, even if empty
+	handles, _ := res.([]string)
+	if handles == nil {
+		handles = []string{}
+	}
+
+	writeAPIJSON(w, http.StatusOK, apiHandlesResponse{Handles: handles})
+}
+
+// deleteHandle handles DELETE /handles/{handle}. The handle may be given with or without the given domain.
+func (h *apiHandler) deleteHandle(w http.ResponseWriter, req *http.Request, handle, domain string) {
+	secret, ok := h.authenticate(w, req, "")
+	if !ok {
+		return
+	}
+
+	_, err := h.server.runCommand(req.Context(), sourceHTTP, req.RemoteAddr, deleteHandleCommand{
+		source:     sourceHTTP,
+		remoteAddr: req.RemoteAddr,
+		handle:     strings.TrimSuffix(handle, domain),
+		secret:     secret,
+	})
+
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticate returns the secret from the bearer token in the request. If an account ID is given, the secret must also belong to that account, and a mismatch counts as a failed attempt. If the request isn't authenticated, it writes the error response and returns false.
+func (h *apiHandler) authenticate(w http.ResponseWriter, req *http.Request, id string) (string, bool) {
+	const prefix = "Bearer "
+
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) || strings.TrimSpace(auth[len(prefix):]) == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeAPIJSON(w, http.StatusUnauthorized, apiErrorResponse{Error: "missing bearer token"})
+		return "", false
+	}
+
+	secret := strings.TrimSpace(auth[len(prefix):])
+
+	// Not telling apart a wrong ID from a wrong secret, the same way a wrong secret is reported as a missing account
+	if id != "" && AccountID(secret) != id {
+		writeAPIError(w, h.server.authenticationFailed(sourceHTTP, req.RemoteAddr))
+		return "", false
+	}
+
+	return secret, true
+}
+
+// checkAPIMethod returns true if the request uses the given method. Otherwise, it writes the error response and returns false.
+func checkAPIMethod(w http.ResponseWriter, req *http.Request, method string) bool {
+	if req.Method == method {
+		return true
+	}
+
+	w.Header().Set("Allow", method)
+	writeAPIJSON(w, http.StatusMethodNotAllowed, apiErrorResponse{Error: "method not allowed"})
+	return false
+}
+
+// decodeAPIBody decodes the JSON body of the request into v. If the body can't be decoded, it writes the error response and returns false.
+func decodeAPIBody(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, req.Body, apiMaxBodySize)).Decode(v)
+	if err != nil {
+		writeAPIJSON(w, http.StatusBadRequest, apiErrorResponse{Error: "invalid request body"})
+		return false
+	}
+
+	return true
+}
+
+// writeAPIError writes the response for an error returned by a command, choosing the status code according to the error.
+func writeAPIError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+
+	switch err {
+	case ErrAccountNotFound:
+		status = http.StatusUnauthorized
+	case ErrHandleNotFound, ErrTokenNotFound:
+		status = http.StatusNotFound
+	case ErrInvalidPermission, ErrInviteRequired, ErrInviteNotFound, ErrTargetNotAllowed, ErrTargetNotConfirmed:
+		status = http.StatusForbidden
+	case ErrEmptyTarget, ErrInvalidTarget, ErrTooManyTargets, ErrEmptySecret:
+		status = http.StatusBadRequest
+	case ErrAccountPending:
+		status = http.StatusConflict
+	case ErrTooManyAttempts:
+		status = http.StatusTooManyRequests
+	}
+
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+
+	writeAPIJSON(w, status, apiErrorResponse{Error: err.Error()})
+}
+
+// writeAPIJSON writes v as the JSON body of the response, with the given status code.
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,352 @@
+package incognitomail_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+// apiTest holds a service serving the REST API from a test HTTP server.
+type apiTest struct {
+	t       *testing.T
+	dir     string
+	service *incognitomail.Service
+	server  *httptest.Server
+}
+
+// newAPITest starts serving the REST API in /api/ from a service created by newTestService, with anyone allowed to create accounts and no brute-force protection, before configure changes the configuration if not nil. Everything is stopped once the test finishes.
+func newAPITest(t *testing.T, configure func(*incognitomail.Configuration)) *apiTest {
+	service, dir := newTestService(t, func(c *incognitomail.Configuration) {
+		c.General.APIPath = "/api/"
+		c.Signup.Policy = "open"
+		// Most tests fail on purpose, and would otherwise have to wait for the backoff
+		c.BruteForce.Enabled = false
+
+		if configure != nil {
+			configure(c)
+		}
+	})
+
+	server := httptest.NewServer(service.Handler())
+	t.Cleanup(server.Close)
+
+	return &apiTest{
+		t:       t,
+		dir:     dir,
+		service: service,
+		server:  server,
+	}
+}
+
+// do sends a request to the API, with the secret as the bearer token if not empty, and decodes the JSON response into v if not nil.
+func (a *apiTest) do(method, path, secret, body string, v interface{}) *http.Response {
+	authorization := ""
+	if secret != "" {
+		authorization = "Bearer " + secret
+	}
+
+	return a.doAuthorized(method, path, authorization, body, v)
+}
+
+// doAuthorized is the same as do, but with the whole Authorization header given, which is left out if empty.
+func (a *apiTest) doAuthorized(method, path, authorization, body string, v interface{}) *http.Response {
+	req, err := http.NewRequest(method, a.server.URL+"/api"+path, strings.NewReader(body))
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if v != nil {
+		err = json.NewDecoder(resp.Body).Decode(v)
+		if err != nil {
+			a.t.Fatal(err)
+		}
+	}
+
+	return resp
+}
+
+// newAccount creates an account through the API, returning its ID and secret.
+func (a *apiTest) newAccount() (string, string) {
+	var account struct {
+		ID     string `json:"id"`
+		Secret string `json:"secret"`
+	}
+
+	resp := a.do(http.MethodPost, "/accounts", "", `{"targets": ["`+accountTarget1+`"]}`, &account)
+	if resp.StatusCode != http.StatusCreated {
+		a.t.Fatalf("expected status 201 creating an account, got %d", resp.StatusCode)
+	}
+
+	return account.ID, account.Secret
+}
+
+// Ensure every endpoint is routed with its own method, and that handles can be created, listed and deleted with the defaults.
+func TestAPI_Routing(t *testing.T) {
+	t.Parallel()
+
+	a := newAPITest(t, nil)
+
+	id, secret := a.newAccount()
+
+	if id != incognitomail.AccountID(secret) {
+		t.Errorf("expected the ID of the account, got %q", id)
+	}
+
+	var handle struct {
+		Handle string `json:"handle"`
+	}
+
+	resp := a.do(http.MethodPost, "/accounts/"+id+"/handles", secret, `{}`, &handle)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201 creating a handle, got %d", resp.StatusCode)
+	}
+
+	if !strings.HasSuffix(handle.Handle, "@sidhion.com") {
+		t.Errorf("expected a full handle, got %q", handle.Handle)
+	}
+
+	var handles struct {
+		Handles []string `json:"handles"`
+	}
+
+	resp = a.do(http.MethodGet, "/handles", secret, "", &handles)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200 listing handles, got %d", resp.StatusCode)
+	}
+
+	if len(handles.Handles) != 1 || handles.Handles[0]+"@sidhion.com" != handle.Handle {
+		t.Errorf("expected the created handle, got %v", handles.Handles)
+	}
+
+	resp = a.do(http.MethodDelete, "/handles/"+handle.Handle, secret, "", nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status 204 deleting a handle, got %d", resp.StatusCode)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/accounts", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/accounts/" + id, http.StatusMethodNotAllowed},
+		{http.MethodGet, "/accounts/" + id + "/confirm", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/accounts/" + id + "/handles", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/handles", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/handles/" + handle.Handle, http.StatusMethodNotAllowed},
+		{http.MethodGet, "/unknown", http.StatusNotFound},
+		{http.MethodGet, "/accounts/" + id + "/unknown", http.StatusNotFound},
+		{http.MethodGet, "/handles/a/b", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		resp := a.do(test.method, test.path, secret, "", nil)
+		if resp.StatusCode != test.status {
+			t.Errorf("expected status %d for %s %s, got %d", test.status, test.method, test.path, resp.StatusCode)
+		}
+	}
+}
+
+// Ensure requests without a valid bearer token, or with a token for another account than the one in the path, are refused.
+func TestAPI_Authentication(t *testing.T) {
+	t.Parallel()
+
+	a := newAPITest(t, nil)
+
+	id, secret := a.newAccount()
+	_, otherSecret := a.newAccount()
+
+	tests := []struct {
+		method        string
+		path          string
+		authorization string
+	}{
+		{http.MethodGet, "/handles", ""},
+		{http.MethodGet, "/handles", "Bearer"},
+		{http.MethodGet, "/handles", "Bearer   "},
+		{http.MethodGet, "/handles", "Basic " + secret},
+		{http.MethodGet, "/handles", "bearer " + secret},
+		{http.MethodGet, "/handles", "Bearer unknown"},
+		{http.MethodPost, "/accounts/" + id + "/handles", "Bearer " + otherSecret},
+		{http.MethodDelete, "/accounts/" + id, "Bearer " + otherSecret},
+	}
+
+	for _, test := range tests {
+		resp := a.doAuthorized(test.method, test.path, test.authorization, `{}`, nil)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected status 401 for %q in %s %s, got %d", test.authorization, test.method, test.path, resp.StatusCode)
+		}
+
+		if resp.Header.Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("expected a bearer challenge for %q in %s %s, got %q", test.authorization, test.method, test.path, resp.Header.Get("WWW-Authenticate"))
+		}
+	}
+
+	resp := a.doAuthorized(http.MethodGet, "/handles", "Bearer  "+secret+" ", "", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected surrounding spaces in the token to be ignored, got %d", resp.StatusCode)
+	}
+}
+
+// Ensure API requests are only checked against the allowed origins if they have an Origin header, while websocket connections without one are still refused.
+func TestAPI_Origin(t *testing.T) {
+	t.Parallel()
+
+	a := newAPITest(t, func(c *incognitomail.Configuration) {
+		c.General.AllowedOrigin = []string{"https://sidhion.com"}
+	})
+
+	_, secret := a.newAccount()
+
+	tests := []struct {
+		origin string
+		status int
+	}{
+		{"", http.StatusOK},
+		{"https://sidhion.com", http.StatusOK},
+		{"https://example.com", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, a.server.URL+"/api/handles", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+secret)
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("expected status %d for origin %q, got %d", test.status, test.origin, resp.StatusCode)
+		}
+	}
+
+	// A websocket handshake without an Origin header, which the websocket package can't send as a client
+	req, err := http.NewRequest(http.MethodGet, a.server.URL+a.service.Config().General.ListenPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected websocket connections without an Origin header to be refused, got %d", resp.StatusCode)
+	}
+}
+
+// Ensure secrets that don't match the account in the path count as failed attempts, and that banned clients are told to wait.
+func TestAPI_Authentication_BruteForce(t *testing.T) {
+	t.Parallel()
+
+	a := newAPITest(t, func(c *incognitomail.Configuration) {
+		c.BruteForce.Enabled = true
+		c.BruteForce.MaxFailures = 2
+		c.BruteForce.BaseDelay = "1ns"
+		c.BruteForce.MaxDelay = "1ns"
+	})
+
+	id, secret := a.newAccount()
+	_, otherSecret := a.newAccount()
+
+	for i := 0; i < 2; i++ {
+		resp := a.do(http.MethodDelete, "/accounts/"+id, otherSecret, "", nil)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected status 401 for a secret of another account, got %d", resp.StatusCode)
+		}
+	}
+
+	resp := a.do(http.MethodDelete, "/accounts/"+id, otherSecret, "", nil)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status 429 after too many failures, got %d", resp.StatusCode)
+	}
+
+	resp = a.do(http.MethodGet, "/handles", secret, "", nil)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status 429 even with the right secret, got %d", resp.StatusCode)
+	}
+}
+
+// Ensure errors returned by commands are answered with the right status code.
+func TestAPI_ErrorStatus(t *testing.T) {
+	t.Parallel()
+
+	a := newAPITest(t, nil)
+
+	id, secret := a.newAccount()
+	otherID, otherSecret := a.newAccount()
+
+	var handle struct {
+		Handle string `json:"handle"`
+	}
+
+	resp := a.do(http.MethodPost, "/accounts/"+otherID+"/handles", otherSecret, `{}`, &handle)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status 201 creating a handle, got %d", resp.StatusCode)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		secret string
+		body   string
+		status int
+	}{
+		{"invalid body", http.MethodPost, "/accounts", "", `{`, http.StatusBadRequest},
+		{"empty targets", http.MethodPost, "/accounts", "", `{"targets": []}`, http.StatusBadRequest},
+		{"invalid target", http.MethodPost, "/accounts", "", `{"targets": ["Someone <someone@example.com>"]}`, http.StatusBadRequest},
+		{"too many targets", http.MethodPost, "/accounts", "", `{"targets": ["a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com", "f@example.com", "g@example.com", "h@example.com", "i@example.com", "j@example.com", "k@example.com"]}`, http.StatusBadRequest},
+		{"unknown token", http.MethodPost, "/accounts/" + id + "/confirm", secret, `{"token": "unknown"}`, http.StatusNotFound},
+		{"handle of another account", http.MethodDelete, "/handles/" + handle.Handle, secret, "", http.StatusNotFound},
+		{"denied command", http.MethodDelete, "/accounts/" + id, secret, "", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		var body struct {
+			Error string `json:"error"`
+		}
+
+		resp := a.do(test.method, test.path, test.secret, test.body, &body)
+		if resp.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, resp.StatusCode)
+		}
+
+		if body.Error == "" {
+			t.Errorf("%s: expected an error message", test.name)
+		}
+
+		if resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s: expected a JSON response, got %q", test.name, resp.Header.Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package incognitomail
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/valyala/gorpc"
+)
+
+// AuditEntry is a single line in the audit log. Entries never hold account secrets, only account IDs.
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Source     string    `json:"source"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	AccountID  string    `json:"account_id,omitempty"`
+	Command    string    `json:"command"`
+	Handle     string    `json:"handle,omitempty"`
+	Outcome    string    `json:"outcome"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// auditLog appends entries to a JSON lines file, rotating it once it gets too big. Rotated files get a numeric suffix, with ".1" being the most recent.
+type auditLog struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+const (
+	auditOutcomeSuccess = "success"
+	auditOutcomeError   = "error"
+)
+
+var (
+	// ErrAuditDisabled is used when querying the audit log, but no audit log file is configured.
+	ErrAuditDisabled = errors.New("audit log is disabled")
+)
+
+func init() {
+	// Audit entries are returned through RPC, so they must be known by the encoder on both sides
+	gorpc.RegisterType([]AuditEntry{})
+}
+
+// openAuditLog opens the audit log in the given path for appending, creating it if needed.
+func openAuditLog(path string, maxSize int64, maxBackups int) (*auditLog, error) {
+	a := &auditLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	err := a.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// openAuditLogFromConfig opens the audit log with values from the [Audit] section, or returns nil if the audit log is disabled.
+func openAuditLogFromConfig(c AuditConfig) (*auditLog, error) {
+	if c.FilePath == "" {
+		return nil, nil
+	}
+
+	return openAuditLog(c.FilePath, c.MaxSize, c.MaxBackups)
+}
+
+// open opens the current file, and keeps track of its size.
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// write appends the entry to the log, rotating it first if the entry would make the file bigger than the maximum size.
+func (a *auditLog) write(e AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		err = a.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// rotate shifts every rotated file by one, dropping the oldest if there are too many, and starts a new file.
+func (a *auditLog) rotate() error {
+	err := a.file.Close()
+	if err != nil {
+		return err
+	}
+
+	if a.maxBackups == 0 {
+		os.Remove(a.path)
+	} else {
+		os.Remove(auditBackupPath(a.path, a.maxBackups))
+
+		for i := a.maxBackups - 1; i > 0; i-- {
+			os.Rename(auditBackupPath(a.path, i), auditBackupPath(a.path, i+1))
+		}
+
+		err = os.Rename(a.path, auditBackupPath(a.path, 1))
+		if err != nil {
+			return err
+		}
+	}
+
+	return a.open()
+}
+
+// close closes the current file.
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.file.Close()
+}
+
+// auditBackupPath returns the path of the n-th rotated file.
+func auditBackupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// ReadAuditLog returns all entries for the account with the given ID from the audit log in path and its rotated files, oldest first.
+func ReadAuditLog(path string, maxBackups int, accountID string) ([]AuditEntry, error) {
+	var result []AuditEntry
+
+	paths := []string{}
+	for i := maxBackups; i > 0; i-- {
+		paths = append(paths, auditBackupPath(path, i))
+	}
+	paths = append(paths, path)
+
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e AuditEntry
+
+			// A line may be truncated if the server crashed while writing it, so just skip anything that can't be decoded
+			if json.Unmarshal(scanner.Bytes(), &e) != nil {
+				continue
+			}
+
+			if e.AccountID == accountID {
+				result = append(result, e)
+			}
+		}
+
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// auditCommand writes an entry for the command to the audit log, if the command changes anything. Any error writing the entry is only logged, since the command was already executed.
+func (s *Service) auditCommand(source, remoteAddr string, command interface{}, res interface{}, err error) {
+	if s.auditLog == nil {
+		return
+	}
+
+	e := AuditEntry{
+		Time:       time.Now().UTC(),
+		Source:     source,
+		RemoteAddr: remoteAddr,
+		Outcome:    auditOutcomeSuccess,
+	}
+
+	if secret := commandSecret(command); secret != "" {
+		e.AccountID = AccountID(secret)
+	}
+
+	switch command.(type) {
+	case listHandlesCommand, listInvitesCommand, auditLogCommand:
+		// Reading data doesn't change anything
+		return
+	case newAccountCommand:
+		if secret, ok := res.(string); ok && err == nil {
+			e.AccountID = AccountID(secret)
+		}
+	}
+
+	e.Command = commandName(command)
+	if e.Command == "" {
+		return
+	}
+	e.Handle = commandHandle(command, res, err)
+
+	if err != nil {
+		e.Outcome = auditOutcomeError
+		e.Error = err.Error()
+	}
+
+	s.writeAuditEntry(e)
+}
+
+// auditBan writes an entry to the audit log for a remote address banned for failing to authenticate too many times.
+func (s *Service) auditBan(source, remoteAddr string) {
+	if s.auditLog == nil {
+		return
+	}
+
+	s.writeAuditEntry(AuditEntry{
+		Time:       time.Now().UTC(),
+		Source:     source,
+		RemoteAddr: remoteAddr,
+		Command:    "ban",
+		Outcome:    auditOutcomeSuccess,
+	})
+}
+
+// writeAuditEntry writes the entry to the audit log, logging any errors.
+func (s *Service) writeAuditEntry(e AuditEntry) {
+	err := s.auditLog.write(e)
+	if err != nil {
+		logEntry(logLevelInfo, "Could not write to the audit log", logFields{"error": err})
+	}
+}
+
+// AuditLog returns all audit log entries for the account with the given secret, even if it was deleted. Same as the "audit" command.
+func (s *Service) AuditLog(secret string) ([]AuditEntry, error) {
+	res, err := s.runLocalCommand(auditLogCommand{source: sourceRPC, secret: secret})
+	entries, _ := res.([]AuditEntry)
+	return entries, err
+}
+
+// auditEntries returns all audit log entries for the account with the given secret. The account doesn't need to exist anymore, so entries from deleted accounts can still be retrieved.
+func (s *Service) auditEntries(secret string) ([]AuditEntry, error) {
+	config := s.currentConfig()
+	if config.Audit.FilePath == "" {
+		return nil, ErrAuditDisabled
+	}
+
+	if secret == "" {
+		return nil, ErrEmptySecret
+	}
+
+	return ReadAuditLog(config.Audit.FilePath, config.Audit.MaxBackups, AccountID(secret))
+}
@@ -0,0 +1,210 @@
+package incognitomail_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+// writeAuditFile writes the given lines to path, one per line.
+func writeAuditFile(t *testing.T, path string, lines ...string) {
+	content := ""
+	for _, l := range lines {
+		content += l + "\n"
+	}
+
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadAuditLog(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "incognitomail_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	id1 := incognitomail.AccountID(accountSecret1)
+	id2 := incognitomail.AccountID(accountSecret2)
+
+	writeAuditFile(t, path+".2",
+		`{"time":"2016-01-01T00:00:00Z","source":"rpc","command":"new account","account_id":"`+id1+`","outcome":"success"}`,
+	)
+	writeAuditFile(t, path+".1",
+		`{"time":"2016-01-02T00:00:00Z","source":"websocket","remote_addr":"127.0.0.1","command":"new handle","account_id":"`+id2+`","handle":"`+accountHandle2+`","outcome":"success"}`,
+		`{"time":"2016-01-03T00:00:00Z","source":"websocket","remote_addr":"127.0.0.1","command":"new handle","account_id":"`+id1+`","handle":"`+accountHandle1+`","outcome":"success"}`,
+	)
+	writeAuditFile(t, path,
+		`{"time":"2016-01-04T00:00:00Z","source":"rpc","command":"delete handle","account_id":"`+id1+`","handle":"`+accountHandle1+`","outcome":"error","error":"invalid secret"}`,
+		`{"time":"2016-01-05T00:00:00Z","source":"rpc","comm`,
+	)
+
+	entries, err := incognitomail.ReadAuditLog(path, 2, id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	if entries[0].Command != "new account" || entries[1].Command != "new handle" || entries[2].Command != "delete handle" {
+		t.Error("entries are not ordered from oldest to newest")
+	}
+
+	if entries[1].Handle != accountHandle1 {
+		t.Errorf("expected handle %q, got %q", accountHandle1, entries[1].Handle)
+	}
+
+	if entries[2].Outcome != "error" || entries[2].Error != "invalid secret" {
+		t.Error("error outcome was not read")
+	}
+
+	// Rotated files past maxBackups are ignored, as are missing ones
+	entries, err = incognitomail.ReadAuditLog(path, 1, id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Errorf("expected 2 entries, got %d", len(entries))
+	}
+
+	entries, err = incognitomail.ReadAuditLog(path, 5, id2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("expected 1 entry, got %d", len(entries))
+	}
+}
+
+// withAuditLog returns a configure func for newTestService writing the audit log to audit.log in the temporary directory, rotated once it gets bigger than maxSize.
+func withAuditLog(maxSize int64, maxBackups int) func(*incognitomail.Configuration) {
+	return func(c *incognitomail.Configuration) {
+		c.Audit.FilePath = filepath.Join(filepath.Dir(c.Persistence.DatabasePath), "audit.log")
+		c.Audit.MaxSize = maxSize
+		c.Audit.MaxBackups = maxBackups
+	}
+}
+
+// Ensure executed commands are written to the audit log, with the same handle for its creation and deletion.
+func TestAuditLog_Commands(t *testing.T) {
+	t.Parallel()
+
+	service, _ := newTestService(t, withAuditLog(1024*1024, 1))
+
+	secret, err := service.SendCommand("", "new account "+accountTarget1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fullHandle, err := service.SendCommand("", "new handle "+secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle := strings.TrimSuffix(fullHandle, service.Config().PostfixConfig.Domain)
+
+	_, err = service.SendCommand("", "list "+secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = service.SendCommand("", "delete handle "+handle+" "+secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = service.SendCommand("", "delete handle "+neverUsedHandle+" "+secret)
+	if err != incognitomail.ErrHandleNotFound {
+		t.Fatalf("expected ErrHandleNotFound, got %v", err)
+	}
+
+	entries, err := service.AuditLog(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		command string
+		handle  string
+		outcome string
+	}{
+		{"new account", "", "success"},
+		{"new handle", handle, "success"},
+		{"delete handle", handle, "success"},
+		{"delete handle", neverUsedHandle, "error"},
+	}
+
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %+v", len(expected), entries)
+	}
+
+	for i, e := range expected {
+		entry := entries[i]
+
+		if entry.Command != e.command || entry.Handle != e.handle || entry.Outcome != e.outcome {
+			t.Errorf("expected entry %d to be %+v, got %+v", i, e, entry)
+		}
+
+		if entry.Source != "rpc" || entry.AccountID != incognitomail.AccountID(secret) {
+			t.Errorf("expected entry %d to be from rpc for the account, got %+v", i, entry)
+		}
+	}
+}
+
+// Ensure the audit log is rotated once it reaches its maximum size, keeping only the configured number of rotated files.
+func TestAuditLog_Rotation(t *testing.T) {
+	t.Parallel()
+
+	// Every entry is bigger than the maximum size, so each one ends up in its own file
+	service, dir := newTestService(t, withAuditLog(1, 2))
+
+	var secrets []string
+	for i := 0; i < 4; i++ {
+		secret, err := service.SendCommand("", "new account "+accountTarget1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		secrets = append(secrets, secret)
+	}
+
+	path := filepath.Join(dir, "audit.log")
+
+	for i, p := range []string{path + ".2", path + ".1", path} {
+		contents, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+		if len(lines) != 1 || !strings.Contains(lines[0], incognitomail.AccountID(secrets[i+1])) {
+			t.Errorf("expected %s to hold only the entry for account %d, got %q", p, i+1, contents)
+		}
+	}
+
+	_, err := os.Stat(path + ".3")
+	if !os.IsNotExist(err) {
+		t.Errorf("expected only 2 rotated files, got %v", err)
+	}
+
+	entries, err := service.AuditLog(secrets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("expected the oldest entry to be dropped, got %+v", entries)
+	}
+}
@@ -0,0 +1,203 @@
+package incognitomail
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// authLimiter keeps track of failed authentication attempts per remote address, refusing further attempts for an exponentially growing delay and banning addresses with too many consecutive failures.
+type authLimiter struct {
+	maxFailures int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	banDuration time.Duration
+
+	// Returns the current time, replaced in tests
+	now func() time.Time
+
+	mu       sync.Mutex
+	failures map[string]*authFailures
+}
+
+// authFailures holds the failed attempts from a single remote address.
+type authFailures struct {
+	count       int
+	last        time.Time
+	retryAt     time.Time
+	bannedUntil time.Time
+}
+
+const (
+	// Expired records are only removed once there are more than this many, so we don't scan the whole map on every failure.
+	authLimiterPruneSize = 1024
+)
+
+var (
+	// ErrTooManyAttempts is used when a remote address has failed to authenticate too many times, and must wait before trying again.
+	ErrTooManyAttempts = errors.New("too many failed attempts, try again later")
+)
+
+// newAuthLimiterFromConfig returns an authLimiter initialized with values from the config, or nil if brute-force protection is disabled.
+func newAuthLimiterFromConfig(c BruteForceConfig) *authLimiter {
+	if !c.Enabled {
+		return nil
+	}
+
+	// These were already checked by ValidConfig
+	baseDelay, _ := time.ParseDuration(c.BaseDelay)
+	maxDelay, _ := time.ParseDuration(c.MaxDelay)
+	banDuration, _ := time.ParseDuration(c.BanDuration)
+
+	return &authLimiter{
+		maxFailures: c.MaxFailures,
+		baseDelay:   baseDelay,
+		maxDelay:    maxDelay,
+		banDuration: banDuration,
+		now:         time.Now,
+		failures:    make(map[string]*authFailures),
+	}
+}
+
+// checkBruteForceConfig records any duration in the BruteForce section that can't be parsed, or limits that don't make sense.
+func checkBruteForceConfig(c *Configuration, p *configProblems) {
+	if !c.BruteForce.Enabled {
+		return
+	}
+
+	p.duration("BruteForce.BaseDelay", c.BruteForce.BaseDelay, false)
+	p.duration("BruteForce.MaxDelay", c.BruteForce.MaxDelay, false)
+	p.duration("BruteForce.BanDuration", c.BruteForce.BanDuration, false)
+
+	if c.BruteForce.MaxFailures <= 0 {
+		p.add("BruteForce.MaxFailures", "must be bigger than zero")
+	}
+}
+
+// isAuthFailure returns true if the error means that a secret, token or invite code given by the client was wrong.
+func isAuthFailure(err error) bool {
+	switch err {
+	case ErrAccountNotFound, ErrEmptySecret, ErrTokenNotFound, ErrInviteNotFound:
+		return true
+	}
+
+	return false
+}
+
+// authenticationFailed records a failed authentication that happened before any command was built, such as a secret that doesn't match the account in the path of a REST API request. Returns ErrTooManyAttempts if the remote address must still wait, or ErrAccountNotFound otherwise.
+func (s *Service) authenticationFailed(source, remoteAddr string) error {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+
+	if s.authLimiter == nil || source == sourceRPC {
+		return ErrAccountNotFound
+	}
+
+	// Checking before recording, so a banned address is told to wait instead of being told its secret is wrong
+	err := s.authLimiter.check(remoteAddr)
+	if err != nil {
+		return err
+	}
+
+	if s.authLimiter.failure(remoteAddr, source) {
+		s.auditBan(source, remoteAddr)
+	}
+
+	return ErrAccountNotFound
+}
+
+// check returns ErrTooManyAttempts if the remote address is banned or hasn't waited long enough since its last failure.
+func (l *authLimiter) check(remoteAddr string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.failures[limiterKey(remoteAddr)]
+	if !ok {
+		return nil
+	}
+
+	now := l.now()
+	if now.Before(f.bannedUntil) || now.Before(f.retryAt) {
+		return ErrTooManyAttempts
+	}
+
+	return nil
+}
+
+// failure records a failed attempt from the remote address, banning it if it reached the maximum number of failures. Returns true if the address got banned.
+func (l *authLimiter) failure(remoteAddr, source string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	key := limiterKey(remoteAddr)
+
+	if len(l.failures) > authLimiterPruneSize {
+		l.prune(now)
+	}
+
+	f, ok := l.failures[key]
+	if !ok || l.expired(f, now) {
+		f = &authFailures{}
+		l.failures[key] = f
+	}
+
+	f.count++
+	f.last = now
+
+	delay := l.baseDelay << uint(f.count-1)
+	// Checking for overflow as well, since the shift can wrap around after enough failures
+	if delay > l.maxDelay || delay <= 0 {
+		delay = l.maxDelay
+	}
+
+	f.retryAt = now.Add(delay)
+
+	logEntry(logLevelDebug, "Failed authentication", logFields{"remote_addr": remoteAddr, "source": source, "failures": f.count})
+
+	if f.count >= l.maxFailures {
+		f.bannedUntil = now.Add(l.banDuration)
+		logEntry(logLevelInfo, "Banned address after too many failed authentication attempts", logFields{"remote_addr": key, "source": source, "until": f.bannedUntil.Format(time.RFC3339), "failures": f.count})
+		return true
+	}
+
+	return false
+}
+
+// success forgets all failures from the remote address.
+func (l *authLimiter) success(remoteAddr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := limiterKey(remoteAddr)
+	f, ok := l.failures[key]
+
+	// A ban still holds even if an attempt succeeds, which can only happen if the attempt was already running when the ban started
+	if ok && !l.now().Before(f.bannedUntil) {
+		delete(l.failures, key)
+	}
+}
+
+// expired returns true if the failures are old enough to be forgotten.
+func (l *authLimiter) expired(f *authFailures, now time.Time) bool {
+	return now.After(f.bannedUntil) && now.Sub(f.last) > l.banDuration
+}
+
+// prune removes all expired records.
+func (l *authLimiter) prune(now time.Time) {
+	for key, f := range l.failures {
+		if l.expired(f, now) {
+			delete(l.failures, key)
+		}
+	}
+}
+
+// limiterKey returns the key used to track failures from the remote address, which ignores the port so reconnecting doesn't reset the count.
+func limiterKey(remoteAddr string) string {
+	ip := remoteIP(remoteAddr)
+	if ip == nil {
+		return remoteAddr
+	}
+
+	return ip.String()
+}
@@ -0,0 +1,137 @@
+package incognitomail_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+const remoteAddr1 = "192.0.2.1:1234"
+
+// fakeClock returns a time that only changes when told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// newTestLimiter returns a limiter banning after 4 failures, with delays of 1s, 2s and 3s and bans of 1h, using the clock.
+func newTestLimiter(clock *fakeClock) *incognitomail.AuthLimiter {
+	return incognitomail.NewAuthLimiter(incognitomail.BruteForceConfig{
+		Enabled:     true,
+		MaxFailures: 4,
+		BaseDelay:   "1s",
+		MaxDelay:    "3s",
+		BanDuration: "1h",
+	}, clock.Now)
+}
+
+// Ensure addresses must wait after a failure, for a delay that doubles with every failure up to the maximum.
+func TestAuthLimiter_Backoff(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{now: time.Unix(1000000, 0)}
+	l := newTestLimiter(clock)
+
+	if err := l.Check(remoteAddr1); err != nil {
+		t.Fatalf("expected an address without failures to be allowed, got %v", err)
+	}
+
+	for _, delay := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		if l.Failure(remoteAddr1) {
+			t.Fatal("expected no ban before the maximum number of failures")
+		}
+
+		clock.Advance(delay - time.Millisecond)
+		if err := l.Check(remoteAddr1); err != incognitomail.ErrTooManyAttempts {
+			t.Errorf("expected ErrTooManyAttempts before %s, got %v", delay, err)
+		}
+
+		clock.Advance(time.Millisecond)
+		if err := l.Check(remoteAddr1); err != nil {
+			t.Errorf("expected the address to be allowed after %s, got %v", delay, err)
+		}
+	}
+
+	// Reconnecting from another port doesn't reset anything
+	l.Failure("192.0.2.1:5678")
+	if err := l.Check(remoteAddr1); err != incognitomail.ErrTooManyAttempts {
+		t.Errorf("expected failures from every port to count, got %v", err)
+	}
+
+	if err := l.Check("192.0.2.2:1234"); err != nil {
+		t.Errorf("expected other addresses to be allowed, got %v", err)
+	}
+}
+
+// Ensure a success forgets all failures.
+func TestAuthLimiter_Success(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{now: time.Unix(1000000, 0)}
+	l := newTestLimiter(clock)
+
+	l.Failure(remoteAddr1)
+	l.Failure(remoteAddr1)
+	l.Failure(remoteAddr1)
+	l.Success(remoteAddr1)
+
+	if err := l.Check(remoteAddr1); err != nil {
+		t.Fatalf("expected the address to be allowed after a success, got %v", err)
+	}
+
+	// Failures start over, so the next one only waits the base delay and doesn't ban
+	if l.Failure(remoteAddr1) {
+		t.Error("expected failures to start over after a success")
+	}
+
+	clock.Advance(time.Second)
+	if err := l.Check(remoteAddr1); err != nil {
+		t.Errorf("expected only the base delay after a success, got %v", err)
+	}
+}
+
+// Ensure addresses are banned after too many failures until the ban expires, even if they succeed meanwhile.
+func TestAuthLimiter_Ban(t *testing.T) {
+	t.Parallel()
+
+	clock := &fakeClock{now: time.Unix(1000000, 0)}
+	l := newTestLimiter(clock)
+
+	for i := 0; i < 3; i++ {
+		l.Failure(remoteAddr1)
+	}
+
+	if !l.Failure(remoteAddr1) {
+		t.Fatal("expected a ban after the maximum number of failures")
+	}
+
+	clock.Advance(time.Hour - time.Second)
+	l.Success(remoteAddr1)
+
+	if err := l.Check(remoteAddr1); err != incognitomail.ErrTooManyAttempts {
+		t.Errorf("expected the ban to hold, got %v", err)
+	}
+
+	clock.Advance(time.Second)
+	if err := l.Check(remoteAddr1); err != nil {
+		t.Errorf("expected the ban to expire, got %v", err)
+	}
+
+	// Failures are only forgotten after a whole ban duration without new ones
+	if !l.Failure(remoteAddr1) {
+		t.Error("expected a failure right after the ban to ban again")
+	}
+
+	clock.Advance(2*time.Hour + time.Second)
+	if l.Failure(remoteAddr1) {
+		t.Error("expected failures to be forgotten after the ban duration")
+	}
+}
@@ -0,0 +1,148 @@
+package incognitomail
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Failed checks of the certificate files are only logged as errors after this many in a row, since files are often replaced one at a time.
+	certificateFailuresBeforeError = 3
+)
+
+// certificateProvider holds the certificate served by the HTTP server, so it can be replaced without restarting the server.
+type certificateProvider struct {
+	mu   sync.RWMutex
+	cert *tls.Certificate
+
+	// Files and modification time of the current certificate, used to find out if the files changed
+	certFile string
+	keyFile  string
+	modTime  time.Time
+
+	// Consecutive failed checks, only used by check
+	failures int
+}
+
+// load reads the certificate and key from the given files, replacing the current certificate only if both could be read.
+func (c *certificateProvider) load(certFile, keyFile string) error {
+	modTime, err := certificateModTime(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.certFile, c.keyFile, c.modTime = certFile, keyFile, modTime
+	c.mu.Unlock()
+
+	return nil
+}
+
+// reloadIfChanged loads the certificate again if the files are not the ones loaded before, or if any of them was modified since. Returns true if the certificate was replaced.
+func (c *certificateProvider) reloadIfChanged(certFile, keyFile string) (bool, error) {
+	modTime, err := certificateModTime(certFile, keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.RLock()
+	unchanged := c.certFile == certFile && c.keyFile == keyFile && c.modTime.Equal(modTime)
+	c.mu.RUnlock()
+
+	if unchanged {
+		return false, nil
+	}
+
+	err = c.load(certFile, keyFile)
+	return err == nil, err
+}
+
+// check reloads the certificate if the files changed, logging the outcome. Must not be called concurrently.
+func (c *certificateProvider) check(certFile, keyFile string) {
+	reloaded, err := c.reloadIfChanged(certFile, keyFile)
+	if err != nil {
+		c.failures++
+
+		// Files are often replaced one at a time, so a single failure is expected, but the old certificate will eventually expire if it keeps failing
+		level := logLevelDebug
+		if c.failures >= certificateFailuresBeforeError {
+			level = logLevelError
+		}
+
+		logEntry(level, "Could not load the certificate", logFields{"error": err, "failures": c.failures})
+		return
+	}
+
+	c.failures = 0
+
+	if reloaded {
+		logEntry(logLevelInfo, "Loaded the new certificate", logFields{"path": certFile})
+	}
+}
+
+// getCertificate returns the current certificate. Used as tls.Config.GetCertificate.
+func (c *certificateProvider) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert, nil
+}
+
+// certificateModTime returns the latest modification time of the certificate and key files.
+func certificateModTime(certFile, keyFile string) (time.Time, error) {
+	certInfo, err := os.Stat(certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+
+	return certInfo.ModTime(), nil
+}
+
+// watchCertificates checks the certificate files for changes every interval, until the server stops. Renewed certificates are then served without restarting or reloading the server.
+func (s *Server) watchCertificates(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.finishCh:
+			return
+		case <-ticker.C:
+		}
+
+		// The files may change when reloading the configuration
+		config := s.currentConfig()
+		certFile, keyFile := config.General.TLSCertFile, config.General.TLSKeyFile
+
+		s.certificates.check(certFile, keyFile)
+	}
+}
+
+// tlsEnabled returns true if the configuration has both a certificate and a key.
+func (c *Configuration) tlsEnabled() bool {
+	return c.General.TLSCertFile != "" && c.General.TLSKeyFile != ""
+}
+
+// certificateCheckInterval returns how often the certificate files are checked for changes, as configured.
+func (c *Configuration) certificateCheckInterval() time.Duration {
+	// Already checked when validating the config
+	d, _ := time.ParseDuration(c.General.CertificateCheckInterval)
+	return d
+}
@@ -0,0 +1,140 @@
+package incognitomail_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+// serves returns true if the provider currently serves the certificate in certFile.
+func serves(t *testing.T, c *incognitomail.CertificateProvider, certFile string) bool {
+	cert, err := c.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(content)
+	return block != nil && bytes.Equal(block.Bytes, cert.Certificate[0])
+}
+
+// Ensure a key pair rewritten with a newer modification time is served from then on, and that unchanged files aren't loaded again.
+func TestCertificateProvider_ReloadIfChanged(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "incognitomail_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeKeyPair(t, dir, "server")
+
+	c := &incognitomail.CertificateProvider{}
+
+	err = c.Load(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := c.ReloadIfChanged(certFile, keyFile)
+	if err != nil || reloaded {
+		t.Errorf("expected unchanged files not to be loaded again, got %v and %v", reloaded, err)
+	}
+
+	writeKeyPair(t, dir, "server")
+
+	// Some filesystems only keep the modification time in seconds, so the rewrite could look unchanged otherwise
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{certFile, keyFile} {
+		err = os.Chtimes(path, later, later)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded, err = c.ReloadIfChanged(certFile, keyFile)
+	if err != nil || !reloaded {
+		t.Fatalf("expected the new key pair to be loaded, got %v and %v", reloaded, err)
+	}
+
+	if !serves(t, c, certFile) {
+		t.Error("expected the new certificate to be served")
+	}
+}
+
+// Ensure a key pair that can't be loaded keeps the current certificate, and is only logged as an error once it keeps failing.
+func TestCertificateProvider_Check_Failures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incognitomail_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeKeyPair(t, dir, "server")
+
+	c := &incognitomail.CertificateProvider{}
+
+	err = c.Load(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := incognitomail.DefaultConfiguration().Logging
+	config.Sink = "file"
+	config.FilePath = filepath.Join(dir, "incognitomail.log")
+	config.Format = "json"
+
+	err = incognitomail.ConfigureLogging(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer incognitomail.ConfigureLogging(incognitomail.DefaultConfiguration().Logging)
+
+	err = os.Remove(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		c.Check(certFile, keyFile)
+	}
+
+	if !serves(t, c, certFile) {
+		t.Error("expected the current certificate to be kept")
+	}
+
+	content, err := ioutil.ReadFile(config.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected only the last failure to be logged, got %q", lines)
+	}
+
+	var entry map[string]interface{}
+
+	err = json.Unmarshal([]byte(lines[0]), &entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry["level"] != "ERROR" || entry["failures"] != float64(3) {
+		t.Errorf("expected an error after 3 failures, got %v", entry)
+	}
+}
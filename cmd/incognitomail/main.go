@@ -7,9 +7,9 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/danielsidhion/incognitomail"
-	"github.com/hashicorp/logutils"
 )
 
 type arguments struct {
@@ -17,72 +17,138 @@ type arguments struct {
 }
 
 var (
-	errWrongUsage = errors.New("wrong usage") // When the command has been invoked with wrong arguments or parameters
+	errWrongUsage         = errors.New("wrong usage")         // When the command has been invoked with wrong arguments or parameters
+	errUnexpectedResponse = errors.New("unexpected response") // When the server answers an RPC call with a value of the wrong type
 
 	cliArguments arguments
 )
 
 func init() {
 	flag.Usage = func() {
-		fmt.Printf("Usage: %s [-c|--config <path>] [command [arguments]]\n", os.Args[0])
+		fmt.Printf("Usage: %s [-c|--config <path>] [--section.key=value...] [command [arguments]]\n", os.Args[0])
 		fmt.Printf("\n")
 		fmt.Printf("if command is ommitted, will act as a server listening for connections\n\n")
 		fmt.Printf("commands:\n")
-		fmt.Printf("  new account <address>            \tcreates a new account with the given address\n")
-		fmt.Printf("  new handle <secret>              \tcreates a new handle for the account with the given secret\n")
+		fmt.Printf("  new account <address>...         \tcreates a new account forwarding to the given addresses\n")
+		fmt.Printf("  new handle <secret> [address...] \tcreates a new handle for the account with the given secret. If addresses are given, the handle forwards to them instead\n")
+		fmt.Printf("  confirm <secret> <token>         \tconfirms the account target that received the given token\n")
 		fmt.Printf("  delete account <secret>          \tdeletes the account registered with the given secret\n")
 		fmt.Printf("  delete handle <handle> <secret>  \tdeletes the given handle. Uses the given secret to confirm account ownership\n")
 		fmt.Printf("  list <secret>                    \tlists all handles registered for the account with the given secret\n")
+		fmt.Printf("  id <secret>                      \tprints the account ID for the given secret, used to configure permissions for that account only\n")
+		fmt.Printf("  audit <secret>                   \tprints every change made to the account with the given secret\n")
+		fmt.Printf("  invite new                       \tcreates a new invite code, which can be used once to create an account from the add-on\n")
+		fmt.Printf("  invite list                      \tlists all invite codes that haven't been used yet\n")
+		fmt.Printf("  invite delete <code>             \tdeletes the given invite code\n")
+		fmt.Printf("  check-config                     \tchecks the configuration, listing every invalid value, and prints it with all defaults and overrides applied\n")
+		fmt.Printf("  reload                           \treads the configuration file of the current server process again, same as sending it SIGHUP\n")
 		fmt.Printf("  stop                             \tstops the current server process\n\n")
 		fmt.Printf("options:\n")
+		fmt.Printf("  --section.key=value\n")
+		fmt.Printf("    \toverrides a key from the configuration file, and can be repeated for keys with multiple values. Keys can also be set with INCOGNITOMAIL_SECTION_KEY environment variables\n")
 
 		flag.PrintDefaults()
 	}
 
 	flag.StringVar(&cliArguments.configPath, "config", "", "path to a configuration file")
 	flag.StringVar(&cliArguments.configPath, "c", "", "path to a configuration file (shorthand)")
-
-	filter := &logutils.LevelFilter{
-		Levels:   []logutils.LogLevel{"DEBUG", "INFO"},
-		MinLevel: logutils.LogLevel("DEBUG"),
-		Writer:   os.Stderr,
-	}
-	log.SetOutput(filter)
 }
 
 func main() {
-	flag.Parse()
+	// Errors found before logging is configured are printed the same way as the ones after it
+	log.SetFlags(0)
+
+	overrides, rest := incognitomail.SplitConfigFlags(os.Args[1:])
+	flag.CommandLine.Parse(rest)
+
+	// Checking the config needs the list of problems instead of a single error, so it's handled before anything else
+	if flag.Arg(0) == "check-config" {
+		if flag.NArg() != 1 {
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		os.Exit(checkConfig(overrides))
+	}
 
 	// Checking for config
-	if cliArguments.configPath != "" {
-		err := incognitomail.ReadConfigFromFile(cliArguments.configPath)
+	config := incognitomail.DefaultConfiguration()
+	if cliArguments.configPath != "" || len(overrides) > 0 || hasEnvironOverrides() {
+		var err error
+		config, err = incognitomail.LoadConfiguration(cliArguments.configPath, os.Environ(), overrides)
 
 		if err != nil {
-			log.Printf("[DEBUG] %s\n", err)
+			log.Printf("[ERROR] %s\n", err)
 			fmt.Println("The program was unsuccessful due to an error.")
 			os.Exit(1)
 		}
 	}
 
-	success, err := parseAndExecuteCommand()
+	err := incognitomail.ConfigureLogging(config.Logging)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		fmt.Println("The program was unsuccessful due to an error.")
+		os.Exit(1)
+	}
+
+	success, err := parseAndExecuteCommand(config)
 	if err == errWrongUsage {
 		flag.Usage()
 		os.Exit(2)
 	}
 
 	if !success {
-		log.Printf("[DEBUG] %s\n", err)
+		log.Printf("[ERROR] %s\n", err)
 		fmt.Println("The program was unsuccessful due to an error.")
 		os.Exit(1)
 	}
 }
 
-func parseAndExecuteCommand() (bool, error) {
+// checkConfig loads the configuration, then prints either every invalid value in it or the resolved configuration. Returns the exit code.
+func checkConfig(overrides []string) int {
+	config, err := incognitomail.LoadConfiguration(cliArguments.configPath, os.Environ(), overrides)
+
+	var configErr *incognitomail.ConfigError
+	if errors.As(err, &configErr) {
+		fmt.Println("The configuration is invalid:")
+		for _, f := range configErr.Fields {
+			fmt.Printf("  %s\n", f)
+		}
+
+		return 1
+	}
+
+	if err != nil {
+		fmt.Printf("Could not load the configuration: %s\n", err)
+		return 1
+	}
+
+	err = config.Write(os.Stdout)
+	if err != nil {
+		fmt.Printf("Could not print the configuration: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// hasEnvironOverrides returns true if any config key is set through the environment.
+func hasEnvironOverrides() bool {
+	for _, entry := range os.Environ() {
+		if strings.HasPrefix(entry, "INCOGNITOMAIL_") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseAndExecuteCommand(config *incognitomail.Configuration) (bool, error) {
 	numCommands := flag.NArg()
 
 	if numCommands == 0 {
 		// Start server
-		server, err := incognitomail.NewServer()
+		server, err := incognitomail.NewServer(config)
 		if err != nil {
 			return false, err
 		}
@@ -92,7 +158,17 @@ func parseAndExecuteCommand() (bool, error) {
 		return true, nil
 	}
 
-	c := incognitomail.CreateRPCServiceClient()
+	// The account ID doesn't depend on the server, so there's no need to connect to it
+	if flag.Arg(0) == "id" {
+		if flag.NArg() != 2 {
+			return false, errWrongUsage
+		}
+
+		fmt.Println(incognitomail.AccountID(flag.Arg(1)))
+		return true, nil
+	}
+
+	c := incognitomail.NewRPCServiceClient(config.General.UnixSockPath)
 
 	switch flag.Arg(0) {
 	case "stop":
@@ -102,28 +178,169 @@ func parseAndExecuteCommand() (bool, error) {
 		}
 
 		fmt.Println("Stopped server")
+	case "reload":
+		res, err := c.Call("Reload", nil)
+		if err != nil {
+			return false, err
+		}
+
+		// An empty list of settings may arrive as no response at all
+		restart, ok := res.([]string)
+		if !ok && res != nil {
+			return false, errUnexpectedResponse
+		}
+
+		for _, name := range restart {
+			fmt.Printf("%s changed, but will only be applied after a restart\n", name)
+		}
+
+		fmt.Println("Reloaded configuration")
+	case "new":
+		if flag.NArg() < 3 {
+			return false, errWrongUsage
+		}
+
+		switch flag.Arg(1) {
+		case "account":
+			res, err := c.Call("NewAccount", incognitomail.NewAccountRequest{Targets: flag.Args()[2:]})
+			if err != nil {
+				return false, err
+			}
+
+			account, ok := res.(incognitomail.NewAccountResponse)
+			if !ok {
+				return false, errUnexpectedResponse
+			}
+
+			fmt.Println(account.Secret)
+		case "handle":
+			res, err := c.Call("NewHandle", incognitomail.NewHandleRequest{Secret: flag.Arg(2), Targets: flag.Args()[3:]})
+			if err != nil {
+				return false, err
+			}
+
+			handle, ok := res.(incognitomail.NewHandleResponse)
+			if !ok {
+				return false, errUnexpectedResponse
+			}
+
+			fmt.Println(handle.Handle)
+		default:
+			return false, errWrongUsage
+		}
+	case "delete":
+		switch {
+		case flag.NArg() == 3 && flag.Arg(1) == "account":
+			_, err := c.Call("DeleteAccount", incognitomail.DeleteAccountRequest{Secret: flag.Arg(2)})
+			if err != nil {
+				return false, err
+			}
+		case flag.NArg() == 4 && flag.Arg(1) == "handle":
+			_, err := c.Call("DeleteHandle", incognitomail.DeleteHandleRequest{Handle: flag.Arg(2), Secret: flag.Arg(3)})
+			if err != nil {
+				return false, err
+			}
+		default:
+			return false, errWrongUsage
+		}
+
+		fmt.Println("success")
+	case "confirm":
+		if flag.NArg() != 3 {
+			return false, errWrongUsage
+		}
+
+		_, err := c.Call("ConfirmTarget", incognitomail.ConfirmTargetRequest{Secret: flag.Arg(1), Token: flag.Arg(2)})
+		if err != nil {
+			return false, err
+		}
+
+		fmt.Println("success")
 	case "list":
 		if flag.NArg() != 2 {
 			return false, errWrongUsage
 		}
 
-		res, err := c.Call("ListHandles", flag.Arg(1))
+		res, err := c.Call("ListHandles", incognitomail.ListHandlesRequest{Secret: flag.Arg(1)})
 		if err != nil {
 			return false, err
 		}
 
-		handles := res.([]string)
+		list, ok := res.(incognitomail.ListHandlesResponse)
+		if !ok {
+			return false, errUnexpectedResponse
+		}
 
-		for _, handle := range handles {
+		for _, handle := range list.Handles {
 			fmt.Println(handle)
 		}
-	default:
-		res, err := c.Call("SendCommand", strings.Join(flag.Args(), " "))
+	case "audit":
+		if flag.NArg() != 2 {
+			return false, errWrongUsage
+		}
+
+		res, err := c.Call("AuditLog", incognitomail.AuditLogRequest{Secret: flag.Arg(1)})
 		if err != nil {
 			return false, err
 		}
 
-		fmt.Println(res)
+		audit, ok := res.(incognitomail.AuditLogResponse)
+		if !ok {
+			return false, errUnexpectedResponse
+		}
+
+		for _, e := range audit.Entries {
+			line := fmt.Sprintf("%s %s %s %s", e.Time.Format(time.RFC3339), e.Source, e.RemoteAddr, e.Command)
+			if e.Handle != "" {
+				line += " " + e.Handle
+			}
+			line += ": " + e.Outcome
+			if e.Error != "" {
+				line += " (" + e.Error + ")"
+			}
+
+			fmt.Println(line)
+		}
+	case "invite":
+		switch {
+		case flag.NArg() == 2 && flag.Arg(1) == "new":
+			res, err := c.Call("NewInvite", incognitomail.NewInviteRequest{})
+			if err != nil {
+				return false, err
+			}
+
+			invite, ok := res.(incognitomail.NewInviteResponse)
+			if !ok {
+				return false, errUnexpectedResponse
+			}
+
+			fmt.Println(invite.Code)
+		case flag.NArg() == 2 && flag.Arg(1) == "list":
+			res, err := c.Call("ListInvites", incognitomail.ListInvitesRequest{})
+			if err != nil {
+				return false, err
+			}
+
+			invites, ok := res.(incognitomail.ListInvitesResponse)
+			if !ok {
+				return false, errUnexpectedResponse
+			}
+
+			for _, code := range invites.Codes {
+				fmt.Println(code)
+			}
+		case flag.NArg() == 3 && flag.Arg(1) == "delete":
+			_, err := c.Call("DeleteInvite", incognitomail.DeleteInviteRequest{Code: flag.Arg(2)})
+			if err != nil {
+				return false, err
+			}
+
+			fmt.Println("success")
+		default:
+			return false, errWrongUsage
+		}
+	default:
+		return false, errWrongUsage
 	}
 
 	return true, nil
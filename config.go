@@ -2,113 +2,554 @@ package incognitomail
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 
 	"gopkg.in/gcfg.v1"
 )
 
-type generalConfig struct {
+// GeneralConfig holds the [General] section.
+type GeneralConfig struct {
 	MailSystem    string
 	UnixSockPath  string
 	LockFilePath  string
 	ListenPath    string
+	APIPath       string
+	HealthPath    string
+	ReadyPath     string
 	ListenAddress string
 	TLSCertFile   string
 	TLSKeyFile    string
+	AllowedOrigin []string
+
+	AllowMissingOrigin  bool
+	SkipPreflightChecks bool
+	CommandTimeout      string
+	DrainTimeout        string
+
+	CertificateCheckInterval string
+	TLSMinVersion            string
+	TLSCipherSuite           []string
+	TLSClientCAFile          string
 }
 
-type persistenceConfig struct {
+// PersistenceConfig holds the [Persistence] section.
+type PersistenceConfig struct {
 	Type         string
 	DatabasePath string
 }
 
-type postfixConfig struct {
-	Domain      string
-	MapFilePath string
+// PostfixConfig holds the [PostfixConfig] section.
+type PostfixConfig struct {
+	Domain       string
+	MapFilePath  string
+	PostmapPath  string
+	PostconfPath string
+}
+
+// VerificationConfig holds the [Verification] section.
+type VerificationConfig struct {
+	Enabled     bool
+	SMTPAddress string
+	From        string
+}
+
+// SignupConfig holds the [Signup] section.
+type SignupConfig struct {
+	Policy        string
+	AllowedDomain []string
+}
+
+// PermissionConfig holds whether each command is allowed or denied, for a [Permissions] or [AccountPermissions] subsection. Empty values mean that a less specific setting should be used.
+type PermissionConfig struct {
+	NewAccount    string
+	NewHandle     string
+	DeleteHandle  string
+	DeleteAccount string
+	ListHandles   string
+	ConfirmTarget string
+	NewInvite     string
+	DeleteInvite  string
+	ListInvites   string
+	AuditLog      string
 }
 
-type config struct {
-	General       generalConfig
-	Persistence   persistenceConfig
-	PostfixConfig postfixConfig
+// BruteForceConfig holds the [BruteForce] section.
+type BruteForceConfig struct {
+	Enabled     bool
+	MaxFailures int
+	BaseDelay   string
+	MaxDelay    string
+	BanDuration string
+}
+
+// AuditConfig holds the [Audit] section.
+type AuditConfig struct {
+	FilePath   string
+	MaxSize    int64
+	MaxBackups int
+}
+
+// LoggingConfig holds the [Logging] section.
+type LoggingConfig struct {
+	Level     string
+	Format    string
+	Sink      string
+	FilePath  string
+	SyslogTag string
+}
+
+// MetricsConfig holds the [Metrics] section.
+type MetricsConfig struct {
+	Enabled       bool
+	Path          string
+	ListenAddress string
+}
+
+// RPCConfig holds the [RPC] section.
+type RPCConfig struct {
+	SocketMode   string
+	SocketGroup  string
+	AllowedUser  []string
+	AllowedGroup []string
+}
+
+// ACMEConfig holds the [ACME] section.
+type ACMEConfig struct {
+	Enabled         bool
+	Domain          []string
+	Email           string
+	CacheDir        string
+	DirectoryURL    string
+	DirectoryCAFile string
+	HTTPAddress     string
+}
+
+// Configuration holds every section of a config file. Use DefaultConfiguration to get one with all default values.
+type Configuration struct {
+	General       GeneralConfig
+	Persistence   PersistenceConfig
+	PostfixConfig PostfixConfig
+	Verification  VerificationConfig
+	Signup        SignupConfig
+	BruteForce    BruteForceConfig
+	Audit         AuditConfig
+	Logging       LoggingConfig
+	Metrics       MetricsConfig
+	RPC           RPCConfig
+	ACME          ACMEConfig
+
+	// Keyed by source, optionally followed by a network in CIDR notation, e.g. "websocket" or "websocket 10.0.0.0/8".
+	Permissions map[string]*PermissionConfig
+
+	// Keyed by account ID and source, e.g. "3f2a9c1d0e8b7a65:websocket".
+	AccountPermissions map[string]*PermissionConfig
+
+	// source is where the configuration was read from, which is read again when reloading.
+	source configSource
+}
+
+// configSource holds the arguments used to load a configuration.
+type configSource struct {
+	path      string
+	environ   []string
+	overrides []string
 }
 
 var (
-	defaultConfig = config{
-		General: generalConfig{
+	defaultConfig = Configuration{
+		General: GeneralConfig{
 			MailSystem:    "postfix",
 			UnixSockPath:  "/tmp/incognitomail.sock",
 			LockFilePath:  "/var/lock/incognitomail.lock",
 			ListenPath:    "/incognitomail",
+			APIPath:       "",
+			HealthPath:    "/healthz",
+			ReadyPath:     "/readyz",
 			ListenAddress: ":8080",
 			TLSCertFile:   "",
 			TLSKeyFile:    "",
+			AllowedOrigin: nil,
+
+			AllowMissingOrigin:  false,
+			SkipPreflightChecks: false,
+			CommandTimeout:      "30s",
+			DrainTimeout:        "30s",
+
+			CertificateCheckInterval: "1m",
+			TLSMinVersion:            "1.2",
+			TLSCipherSuite:           nil,
+			TLSClientCAFile:          "",
 		},
-		Persistence: persistenceConfig{
+		Persistence: PersistenceConfig{
 			Type:         "boltdb",
 			DatabasePath: "incognitomail.db",
 		},
-		PostfixConfig: postfixConfig{
-			Domain:      "",
-			MapFilePath: "",
+		PostfixConfig: PostfixConfig{
+			Domain:       "",
+			MapFilePath:  "",
+			PostmapPath:  "postmap",
+			PostconfPath: "postconf",
+		},
+		Verification: VerificationConfig{
+			Enabled:     false,
+			SMTPAddress: "localhost:25",
+			From:        "",
+		},
+		Signup: SignupConfig{
+			Policy:        signupPolicyDisabled,
+			AllowedDomain: nil,
+		},
+		BruteForce: BruteForceConfig{
+			Enabled:     true,
+			MaxFailures: 10,
+			BaseDelay:   "1s",
+			MaxDelay:    "1m",
+			BanDuration: "1h",
 		},
+		Audit: AuditConfig{
+			FilePath:   "",
+			MaxSize:    10 * 1024 * 1024,
+			MaxBackups: 5,
+		},
+		Logging: LoggingConfig{
+			Level:     logLevelInfo,
+			Format:    logFormatText,
+			Sink:      logSinkStderr,
+			FilePath:  "",
+			SyslogTag: "incognitomail",
+		},
+		Metrics: MetricsConfig{
+			Enabled:       false,
+			Path:          "/metrics",
+			ListenAddress: "",
+		},
+		RPC: RPCConfig{
+			SocketMode:   "0600",
+			SocketGroup:  "",
+			AllowedUser:  nil,
+			AllowedGroup: nil,
+		},
+		ACME: ACMEConfig{
+			Enabled:         false,
+			Domain:          nil,
+			Email:           "",
+			CacheDir:        "",
+			DirectoryURL:    "https://acme-v02.api.letsencrypt.org/directory",
+			DirectoryCAFile: "",
+			HTTPAddress:     "",
+		},
+		Permissions:        nil,
+		AccountPermissions: nil,
 	}
 
-	// Config holds all global configuration.
+	// Config holds the global configuration, kept for compatibility. It's used by the functions that don't take a Configuration, and by servers created without one.
 	Config = defaultConfig
 
 	// ErrInvalidConfig is used when loading a configuration with invalid values.
 	ErrInvalidConfig = errors.New("invalid configuration values")
 )
 
-// ResetConfig switches all values back to the default.
+// DefaultConfiguration returns a new Configuration with all default values.
+func DefaultConfiguration() *Configuration {
+	c := defaultConfig
+	return &c
+}
+
+// clone returns a copy of the configuration that doesn't share its permission maps, so changing either one never changes the other.
+func (c *Configuration) clone() *Configuration {
+	copied := *c
+	copied.Permissions = clonePermissions(c.Permissions)
+	copied.AccountPermissions = clonePermissions(c.AccountPermissions)
+	return &copied
+}
+
+// clonePermissions returns a copy of the given permission subsections.
+func clonePermissions(permissions map[string]*PermissionConfig) map[string]*PermissionConfig {
+	if permissions == nil {
+		return nil
+	}
+
+	copied := make(map[string]*PermissionConfig, len(permissions))
+	for name, p := range permissions {
+		if p != nil {
+			pc := *p
+			p = &pc
+		}
+		copied[name] = p
+	}
+
+	return copied
+}
+
+// ResetConfig switches all values in the global Config back to the default.
 func ResetConfig() {
 	Config = defaultConfig
 }
 
-// ReadConfigFromFile reads the file in the given path and parses all config data from it. Any value not defined in this configuration file will be kept as its default value.
+// ReadConfigFromFile reads the file in the given path into the global Config. See Configuration.ReadFile.
 func ReadConfigFromFile(path string) error {
+	return Config.ReadFile(path)
+}
+
+// ReadConfigFromReader reads config data from the given reader into the global Config. See Configuration.Read.
+func ReadConfigFromReader(reader io.Reader) error {
+	return Config.Read(reader)
+}
+
+// ValidConfig returns true if the global Config is valid, i.e. not likely to crash the server.
+func ValidConfig() bool {
+	return Config.Check() == nil
+}
+
+// CheckConfig returns a *ConfigError listing every invalid value in the global Config, or nil if it is valid.
+func CheckConfig() error {
+	return Config.Check()
+}
+
+// WriteConfig writes the global Config to w. See Configuration.Write.
+func WriteConfig(w io.Writer) error {
+	return Config.Write(w)
+}
+
+// ReadFile reads the file in the given path and parses all config data from it. Any value not defined in this configuration file will be kept as its current value. The file is read again when a server using this configuration is reloaded.
+func (c *Configuration) ReadFile(path string) error {
 	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	err = ReadConfigFromReader(f)
-	return err
+	before := *c
+
+	err = gcfg.ReadInto(c, f)
+	if err != nil {
+		return err
+	}
+
+	err = c.resolvePaths(path, &before)
+	if err != nil {
+		return err
+	}
+
+	err = c.Check()
+	if err != nil {
+		return err
+	}
+
+	c.source = configSource{path: path}
+	return nil
 }
 
-// ReadConfigFromReader parses all config data from the given reader. Any value not defined in the read string will be kept as its default value.
-func ReadConfigFromReader(reader io.Reader) error {
-	err := gcfg.ReadInto(&Config, reader)
+// resolvePaths makes every relative path set by the config file in the given path relative to the directory of the file, so the file can be used from any working directory. before holds the values from before the file was read, and paths that kept their value are left alone, so relative defaults stay relative to the working directory.
+// PostmapPath and PostconfPath are never changed, since relative ones are looked up in the PATH.
+func (c *Configuration) resolvePaths(path string, before *Configuration) error {
+	dir, err := filepath.Abs(filepath.Dir(path))
 	if err != nil {
 		return err
 	}
 
-	if !ValidConfig() {
-		return ErrInvalidConfig
+	resolve := func(value *string, old string) {
+		if *value != "" && *value != old && !filepath.IsAbs(*value) {
+			*value = filepath.Join(dir, *value)
+		}
 	}
 
+	resolve(&c.General.UnixSockPath, before.General.UnixSockPath)
+	resolve(&c.General.LockFilePath, before.General.LockFilePath)
+	resolve(&c.General.TLSCertFile, before.General.TLSCertFile)
+	resolve(&c.General.TLSKeyFile, before.General.TLSKeyFile)
+	resolve(&c.General.TLSClientCAFile, before.General.TLSClientCAFile)
+	resolve(&c.Persistence.DatabasePath, before.Persistence.DatabasePath)
+	resolve(&c.PostfixConfig.MapFilePath, before.PostfixConfig.MapFilePath)
+	resolve(&c.Audit.FilePath, before.Audit.FilePath)
+	resolve(&c.Logging.FilePath, before.Logging.FilePath)
+	resolve(&c.ACME.CacheDir, before.ACME.CacheDir)
+	resolve(&c.ACME.DirectoryCAFile, before.ACME.DirectoryCAFile)
+
 	return nil
 }
 
-// ValidConfig returns true if the current Config is valid, i.e. not likely to crash the server.
-func ValidConfig() bool {
-	invalid := false
+// Read parses all config data from the given reader. Any value not defined in the read string will be kept as its current value.
+// If any value is invalid, a *ConfigError listing all of them is returned.
+func (c *Configuration) Read(reader io.Reader) error {
+	err := gcfg.ReadInto(c, reader)
+	if err != nil {
+		return err
+	}
+
+	return c.Check()
+}
+
+// Check returns a *ConfigError listing every invalid value in the configuration, or nil if it is valid.
+func (c *Configuration) Check() error {
+	p := &configProblems{}
+
+	if c.General.MailSystem != "postfix" {
+		p.add("General.MailSystem", "%q is not supported, must be \"postfix\"", c.General.MailSystem)
+	}
+	p.required("General.UnixSockPath", c.General.UnixSockPath)
+	p.absolutePath("General.UnixSockPath", c.General.UnixSockPath)
+	p.required("General.LockFilePath", c.General.LockFilePath)
+	p.absolutePath("General.LockFilePath", c.General.LockFilePath)
+	p.required("General.ListenPath", c.General.ListenPath)
+	p.address("General.ListenAddress", c.General.ListenAddress)
+	p.absolutePath("General.TLSCertFile", c.General.TLSCertFile)
+	p.absolutePath("General.TLSKeyFile", c.General.TLSKeyFile)
+	p.keyPair("General.TLSCertFile", c.General.TLSCertFile, "General.TLSKeyFile", c.General.TLSKeyFile)
+	p.absolutePath("General.TLSClientCAFile", c.General.TLSClientCAFile)
+	p.duration("General.CommandTimeout", c.General.CommandTimeout, true)
+	p.duration("General.DrainTimeout", c.General.DrainTimeout, true)
+	p.duration("General.CertificateCheckInterval", c.General.CertificateCheckInterval, true)
+	for _, origin := range c.General.AllowedOrigin {
+		if !validOriginPattern(origin) {
+			p.add("General.AllowedOrigin", "%q must be \"null\" or in the form scheme://host", origin)
+		}
+	}
 
-	invalid = invalid || Config.General.MailSystem != "postfix"
-	invalid = invalid || Config.General.UnixSockPath == ""
-	invalid = invalid || Config.General.LockFilePath == ""
-	invalid = invalid || Config.General.ListenPath == ""
-	invalid = invalid || Config.General.ListenAddress == ""
-	invalid = invalid || Config.Persistence.Type != "boltdb"
-	invalid = invalid || Config.Persistence.DatabasePath == ""
+	if c.Persistence.Type != "boltdb" {
+		p.add("Persistence.Type", "%q is not supported, must be \"boltdb\"", c.Persistence.Type)
+	}
+	p.required("Persistence.DatabasePath", c.Persistence.DatabasePath)
+
+	if c.General.MailSystem == "postfix" {
+		switch {
+		case c.PostfixConfig.Domain == "":
+			p.add("PostfixConfig.Domain", "must be set")
+		case !strings.HasPrefix(c.PostfixConfig.Domain, "@"):
+			p.add("PostfixConfig.Domain", "%q must start with \"@\"", c.PostfixConfig.Domain)
+		case !validDomainName(c.PostfixConfig.Domain[1:]):
+			p.add("PostfixConfig.Domain", "%q is not a valid domain", c.PostfixConfig.Domain)
+		}
+		p.required("PostfixConfig.MapFilePath", c.PostfixConfig.MapFilePath)
+		p.absolutePath("PostfixConfig.MapFilePath", c.PostfixConfig.MapFilePath)
+		p.required("PostfixConfig.PostmapPath", c.PostfixConfig.PostmapPath)
+		p.required("PostfixConfig.PostconfPath", c.PostfixConfig.PostconfPath)
+	}
+
+	if c.Verification.Enabled {
+		p.address("Verification.SMTPAddress", c.Verification.SMTPAddress)
+		p.required("Verification.From", c.Verification.From)
+	}
+
+	switch c.Signup.Policy {
+	case signupPolicyDisabled, signupPolicyOpen, signupPolicyInvite:
+	case signupPolicyAllowList:
+		if len(c.Signup.AllowedDomain) == 0 {
+			p.add("Signup.AllowedDomain", "must be set when Policy is %q", signupPolicyAllowList)
+		}
+	default:
+		p.add("Signup.Policy", "%q must be one of %q, %q, %q or %q", c.Signup.Policy, signupPolicyDisabled, signupPolicyOpen, signupPolicyInvite, signupPolicyAllowList)
+	}
+
+	checkPermissionsConfig(c, p)
+	checkBruteForceConfig(c, p)
+
+	if c.Audit.FilePath != "" {
+		p.absolutePath("Audit.FilePath", c.Audit.FilePath)
+		if c.Audit.MaxSize <= 0 {
+			p.add("Audit.MaxSize", "must be bigger than zero")
+		}
+		if c.Audit.MaxBackups < 0 {
+			p.add("Audit.MaxBackups", "must not be negative")
+		}
+	}
+
+	checkLoggingConfig(c, p)
+
+	if !validSocketMode(c.RPC.SocketMode) {
+		p.add("RPC.SocketMode", "%q must be an octal file mode such as \"0660\"", c.RPC.SocketMode)
+	}
+
+	checkACMEConfig(c, p)
+	checkTLSPolicyConfig(c, p)
+
+	if c.Metrics.Enabled {
+		if !strings.HasPrefix(c.Metrics.Path, "/") {
+			p.add("Metrics.Path", "%q must start with \"/\"", c.Metrics.Path)
+		}
+		if c.Metrics.ListenAddress != "" {
+			p.address("Metrics.ListenAddress", c.Metrics.ListenAddress)
+		}
+	}
+
+	return p.err()
+}
+
+// Write writes the configuration to w in the config file format, including default values, so it can be inspected or read back as a config file.
+func (c *Configuration) Write(w io.Writer) error {
+	v := reflect.ValueOf(*c)
+
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).PkgPath != "" {
+			continue
+		}
+
+		name := v.Type().Field(i).Name
+		section := v.Field(i)
+
+		if section.Kind() != reflect.Map {
+			err := writeConfigSection(w, "["+name+"]", section)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		subsections := make([]string, 0, section.Len())
+		for _, key := range section.MapKeys() {
+			subsections = append(subsections, key.String())
+		}
+		sort.Strings(subsections)
+
+		for _, sub := range subsections {
+			header := "[" + name + "]"
+			if sub != "" {
+				header = "[" + name + " " + quoteConfigValue(sub) + "]"
+			}
+
+			err := writeConfigSection(w, header, section.MapIndex(reflect.ValueOf(sub)).Elem())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeConfigSection writes the header and every key in the section struct, with one line per value for multi-valued keys.
+func writeConfigSection(w io.Writer, header string, section reflect.Value) error {
+	lines := []string{header}
+
+	for i := 0; i < section.NumField(); i++ {
+		key := section.Type().Field(i).Name
+		value := section.Field(i)
+
+		if value.Kind() != reflect.Slice {
+			lines = append(lines, key+" = "+configValueString(value))
+			continue
+		}
+
+		for j := 0; j < value.Len(); j++ {
+			lines = append(lines, key+" = "+configValueString(value.Index(j)))
+		}
+	}
+
+	_, err := io.WriteString(w, strings.Join(lines, "\n")+"\n\n")
+	return err
+}
 
-	if Config.General.MailSystem == "postfix" {
-		invalid = invalid || Config.PostfixConfig.Domain == ""
-		invalid = invalid || Config.PostfixConfig.MapFilePath == ""
+// configValueString formats a single value the way it's written in a config file.
+func configValueString(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return quoteConfigValue(v.String())
 	}
 
-	return !invalid
+	return fmt.Sprint(v.Interface())
 }
@@ -1,8 +1,20 @@
 package incognitomail_test
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/danielsidhion/incognitomail"
 )
@@ -19,7 +31,7 @@ func TestConfig_empty(t *testing.T) {
 		t.Fatal("expected error")
 	}
 
-	if err != incognitomail.ErrInvalidConfig {
+	if !errors.Is(err, incognitomail.ErrInvalidConfig) {
 		t.Fatal("expected ErrInvalidConfig")
 	}
 }
@@ -37,6 +49,9 @@ func TestConfig_reset(t *testing.T) {
 	incognitomail.Config.Persistence.DatabasePath = "c0mpl3t3g4rb4g3"
 	incognitomail.Config.PostfixConfig.Domain = "c0mpl3t3g4rb4g3"
 	incognitomail.Config.PostfixConfig.MapFilePath = "c0mpl3t3g4rb4g3"
+	incognitomail.Config.PostfixConfig.PostmapPath = "c0mpl3t3g4rb4g3"
+	incognitomail.Config.PostfixConfig.PostconfPath = "c0mpl3t3g4rb4g3"
+	incognitomail.Config.General.SkipPreflightChecks = true
 
 	incognitomail.ResetConfig()
 
@@ -83,6 +98,18 @@ func TestConfig_reset(t *testing.T) {
 	if incognitomail.Config.PostfixConfig.MapFilePath != "" {
 		t.Errorf("Config.PostfixConfig.MapFilePath != \"%s\"", "")
 	}
+
+	if incognitomail.Config.PostfixConfig.PostmapPath != "postmap" {
+		t.Errorf("Config.PostfixConfig.PostmapPath != \"%s\"", "postmap")
+	}
+
+	if incognitomail.Config.PostfixConfig.PostconfPath != "postconf" {
+		t.Errorf("Config.PostfixConfig.PostconfPath != \"%s\"", "postconf")
+	}
+
+	if incognitomail.Config.General.SkipPreflightChecks {
+		t.Errorf("Config.General.SkipPreflightChecks != %t", false)
+	}
 }
 
 // Ensures that a minimal config (one with only required values) doesn't return any errors.
@@ -132,20 +159,28 @@ func TestConfig_full(t *testing.T) {
 		t.Errorf("Config.General.ListenAddress != \"%s\"", ":9090")
 	}
 
-	if incognitomail.Config.General.TLSCertFile != "server.pem" {
-		t.Errorf("Config.General.TLSCertFile != \"%s\"", "server.pem")
+	// Relative paths are relative to the directory of the config file
+	certFile, _ := filepath.Abs("testdata/server.pem")
+	if incognitomail.Config.General.TLSCertFile != certFile {
+		t.Errorf("Config.General.TLSCertFile != \"%s\"", certFile)
+	}
+
+	keyFile, _ := filepath.Abs("testdata/server.key")
+	if incognitomail.Config.General.TLSKeyFile != keyFile {
+		t.Errorf("Config.General.TLSKeyFile != \"%s\"", keyFile)
 	}
 
-	if incognitomail.Config.General.TLSKeyFile != "server.key" {
-		t.Errorf("Config.General.TLSKeyFile != \"%s\"", "server.key")
+	if !incognitomail.Config.General.SkipPreflightChecks {
+		t.Errorf("Config.General.SkipPreflightChecks != %t", true)
 	}
 
 	if incognitomail.Config.Persistence.Type != "boltdb" {
 		t.Errorf("Config.Persistence.Type != \"%s\"", "boltdb")
 	}
 
-	if incognitomail.Config.Persistence.DatabasePath != "incognito.db" {
-		t.Errorf("Config.Persistence.DatabasePath != \"%s\"", "incognito.db")
+	databasePath, _ := filepath.Abs("testdata/incognito.db")
+	if incognitomail.Config.Persistence.DatabasePath != databasePath {
+		t.Errorf("Config.Persistence.DatabasePath != \"%s\"", databasePath)
 	}
 
 	if incognitomail.Config.PostfixConfig.Domain != "@sidhion.com" {
@@ -155,4 +190,504 @@ func TestConfig_full(t *testing.T) {
 	if incognitomail.Config.PostfixConfig.MapFilePath != "/tmp/postfix/canonical" {
 		t.Errorf("Config.PostfixConfig.MapFilePath != \"%s\"", "/tmp/postfix/canonical")
 	}
+
+	if incognitomail.Config.PostfixConfig.PostmapPath != "/usr/sbin/postmap" {
+		t.Errorf("Config.PostfixConfig.PostmapPath != \"%s\"", "/usr/sbin/postmap")
+	}
+
+	if incognitomail.Config.PostfixConfig.PostconfPath != "/usr/sbin/postconf" {
+		t.Errorf("Config.PostfixConfig.PostconfPath != \"%s\"", "/usr/sbin/postconf")
+	}
+}
+
+// Ensures that permission sections are parsed, including the ones for networks and accounts.
+func TestConfig_permissions(t *testing.T) {
+	incognitomail.ResetConfig()
+
+	reader := strings.NewReader(`
+[PostfixConfig]
+Domain = "@sidhion.com"
+MapFilePath = "/tmp/postfix/canonical"
+
+[Permissions "websocket"]
+DeleteHandle = "allow"
+
+[Permissions "websocket 10.0.0.0/8"]
+NewHandle = "deny"
+
+[AccountPermissions "3f2a9c1d0e8b7a65:websocket"]
+ListHandles = "allow"
+`)
+
+	err := incognitomail.ReadConfigFromReader(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if incognitomail.Config.Permissions["websocket"].DeleteHandle != "allow" {
+		t.Errorf("Config.Permissions[\"websocket\"].DeleteHandle != \"%s\"", "allow")
+	}
+
+	if incognitomail.Config.Permissions["websocket 10.0.0.0/8"].NewHandle != "deny" {
+		t.Errorf("Config.Permissions[\"websocket 10.0.0.0/8\"].NewHandle != \"%s\"", "deny")
+	}
+
+	if incognitomail.Config.AccountPermissions["3f2a9c1d0e8b7a65:websocket"].ListHandles != "allow" {
+		t.Errorf("Config.AccountPermissions[\"3f2a9c1d0e8b7a65:websocket\"].ListHandles != \"%s\"", "allow")
+	}
+}
+
+// Ensures that invalid permission sections return an error.
+func TestConfig_invalidPermissions(t *testing.T) {
+	sections := []string{
+		"[Permissions \"websocket\"]\nNewHandle = \"maybe\"\n",
+		"[Permissions \"websocket 10.0.0.0/33\"]\nNewHandle = \"deny\"\n",
+		"[Permissions \"websocket 10.0.0.0/8 extra\"]\nNewHandle = \"deny\"\n",
+		"[AccountPermissions \"3f2a9c1d0e8b7a65\"]\nNewHandle = \"deny\"\n",
+	}
+
+	for _, section := range sections {
+		incognitomail.ResetConfig()
+
+		reader := strings.NewReader("[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n" + section)
+
+		err := incognitomail.ReadConfigFromReader(reader)
+		if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+			t.Errorf("expected ErrInvalidConfig for %q, got %v", section, err)
+		}
+	}
+}
+
+// Ensures that allowed origins are parsed, and that malformed ones return an error.
+func TestConfig_allowedOrigins(t *testing.T) {
+	incognitomail.ResetConfig()
+
+	reader := strings.NewReader(`
+[General]
+AllowedOrigin = "moz-extension://*"
+AllowedOrigin = "https://sidhion.com"
+AllowedOrigin = "null"
+
+[PostfixConfig]
+Domain = "@sidhion.com"
+MapFilePath = "/tmp/postfix/canonical"
+`)
+
+	err := incognitomail.ReadConfigFromReader(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(incognitomail.Config.General.AllowedOrigin) != 3 {
+		t.Fatal("expected 3 allowed origins, got ", incognitomail.Config.General.AllowedOrigin)
+	}
+
+	for _, origin := range []string{"sidhion.com", "https://", "https://sidhion.com/path"} {
+		incognitomail.ResetConfig()
+
+		reader := strings.NewReader("[General]\nAllowedOrigin = \"" + origin + "\"\n[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n")
+
+		err := incognitomail.ReadConfigFromReader(reader)
+		if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+			t.Errorf("expected ErrInvalidConfig for %q, got %v", origin, err)
+		}
+	}
+}
+
+// Ensures that malformed brute-force protection settings return an error.
+func TestConfig_invalidBruteForce(t *testing.T) {
+	sections := []string{
+		"[BruteForce]\nBaseDelay = \"soon\"\n",
+		"[BruteForce]\nMaxDelay = \"-1s\"\n",
+		"[BruteForce]\nMaxFailures = 0\n",
+	}
+
+	for _, section := range sections {
+		incognitomail.ResetConfig()
+
+		reader := strings.NewReader("[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n" + section)
+
+		err := incognitomail.ReadConfigFromReader(reader)
+		if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+			t.Errorf("expected ErrInvalidConfig for %q, got %v", section, err)
+		}
+	}
+}
+
+func TestConfig_invalidAudit(t *testing.T) {
+	sections := []string{
+		"[Audit]\nFilePath = \"/tmp/audit.log\"\nMaxSize = 0\n",
+		"[Audit]\nFilePath = \"/tmp/audit.log\"\nMaxBackups = -1\n",
+	}
+
+	for _, section := range sections {
+		incognitomail.ResetConfig()
+
+		reader := strings.NewReader("[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n" + section)
+
+		err := incognitomail.ReadConfigFromReader(reader)
+		if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+			t.Errorf("expected ErrInvalidConfig for %q, got %v", section, err)
+		}
+	}
+}
+
+func TestConfig_invalidLogging(t *testing.T) {
+	sections := []string{
+		"[Logging]\nLevel = \"verbose\"\n",
+		"[Logging]\nFormat = \"xml\"\n",
+		"[Logging]\nSink = \"file\"\n",
+		"[Logging]\nSink = \"network\"\n",
+	}
+
+	for _, section := range sections {
+		incognitomail.ResetConfig()
+
+		reader := strings.NewReader("[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n" + section)
+
+		err := incognitomail.ReadConfigFromReader(reader)
+		if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+			t.Errorf("expected ErrInvalidConfig for %q, got %v", section, err)
+		}
+	}
+}
+
+func TestConfig_invalidMetrics(t *testing.T) {
+	incognitomail.ResetConfig()
+
+	reader := strings.NewReader("[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n[Metrics]\nEnabled = true\nPath = \"metrics\"\n")
+
+	err := incognitomail.ReadConfigFromReader(reader)
+	if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+		t.Errorf("expected ErrInvalidConfig, got %v", err)
+	}
+}
+
+func TestConfig_invalidCommandTimeout(t *testing.T) {
+	for _, timeout := range []string{"forever", "0s", "-1s"} {
+		incognitomail.ResetConfig()
+
+		reader := strings.NewReader("[General]\nCommandTimeout = \"" + timeout + "\"\n[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n")
+
+		err := incognitomail.ReadConfigFromReader(reader)
+		if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+			t.Errorf("expected ErrInvalidConfig for %q, got %v", timeout, err)
+		}
+	}
+}
+
+func TestConfig_invalidDrainTimeout(t *testing.T) {
+	for _, timeout := range []string{"forever", "0s", "-1s"} {
+		incognitomail.ResetConfig()
+
+		reader := strings.NewReader("[General]\nDrainTimeout = \"" + timeout + "\"\n[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n")
+
+		err := incognitomail.ReadConfigFromReader(reader)
+		if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+			t.Errorf("expected ErrInvalidConfig for %q, got %v", timeout, err)
+		}
+	}
+}
+
+func TestConfig_invalidSocketMode(t *testing.T) {
+	for _, mode := range []string{"rw-------", "0800", "01777"} {
+		incognitomail.ResetConfig()
+
+		reader := strings.NewReader("[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n[RPC]\nSocketMode = \"" + mode + "\"\n")
+
+		err := incognitomail.ReadConfigFromReader(reader)
+		if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+			t.Errorf("expected ErrInvalidConfig for %q, got %v", mode, err)
+		}
+	}
+}
+
+func TestConfig_invalidACME(t *testing.T) {
+	sections := []string{
+		"[ACME]\nEnabled = true\nCacheDir = \"/tmp/acme\"\n",
+		"[ACME]\nEnabled = true\nDomain = \"sidhion.com\"\n",
+		"[ACME]\nEnabled = true\nDomain = \"sidhion.com\"\nCacheDir = \"/tmp/acme\"\n[General]\nTLSCertFile = \"server.pem\"\n",
+		"[ACME]\nEnabled = true\nDomain = \"sidhion.com\"\nCacheDir = \"/tmp/acme\"\nHTTPAddress = \"\"\n[General]\nTLSClientCAFile = \"/etc/incognitomail/clients.pem\"\n",
+	}
+
+	for _, section := range sections {
+		incognitomail.ResetConfig()
+
+		reader := strings.NewReader("[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n" + section)
+
+		err := incognitomail.ReadConfigFromReader(reader)
+		if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+			t.Errorf("expected ErrInvalidConfig for %q, got %v", section, err)
+		}
+	}
+
+	incognitomail.ResetConfig()
+
+	reader := strings.NewReader("[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n[ACME]\nEnabled = true\nDomain = \"sidhion.com\"\nDomain = \"www.sidhion.com\"\nCacheDir = \"/tmp/acme\"\n")
+
+	err := incognitomail.ReadConfigFromReader(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(incognitomail.Config.ACME.Domain) != 2 {
+		t.Errorf("expected 2 domains, got %v", incognitomail.Config.ACME.Domain)
+	}
+}
+
+func TestConfig_invalidTLSPolicy(t *testing.T) {
+	sections := []string{
+		"[General]\nTLSMinVersion = \"1.4\"\n",
+		"[General]\nTLSMinVersion = \"TLS12\"\n",
+		"[General]\nTLSCipherSuite = \"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256\"\nTLSCipherSuite = \"TLS_RSA_WITH_RC4_128_SHA\"\n",
+		"[General]\nTLSCipherSuite = \"TLS_AES_128_GCM_SHA256\"\n",
+	}
+
+	for _, section := range sections {
+		incognitomail.ResetConfig()
+
+		reader := strings.NewReader("[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n" + section)
+
+		err := incognitomail.ReadConfigFromReader(reader)
+		if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+			t.Errorf("expected ErrInvalidConfig for %q, got %v", section, err)
+		}
+	}
+}
+
+// Ensure flags override the environment, which overrides the config file, and that validation only happens after merging.
+func TestConfig_overrides(t *testing.T) {
+	incognitomail.ResetConfig()
+
+	path := filepath.Join(t.TempDir(), "incognitomail.conf")
+	err := os.WriteFile(path, []byte("[General]\nListenAddress = \":9000\"\nAllowedOrigin = \"moz-extension://*\"\n[PostfixConfig]\nMapFilePath = \"/tmp/postfix/canonical\"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	environ := []string{
+		"HOME=/root",
+		"INCOGNITOMAIL_POSTFIXCONFIG_DOMAIN=@sidhion.com",
+		"INCOGNITOMAIL_GENERAL_LISTENADDRESS=:9001",
+		"INCOGNITOMAIL_GENERAL_ALLOWEDORIGIN=https://a.example, https://b.example",
+		"INCOGNITOMAIL_PERMISSIONS_WEBSOCKET_NEWACCOUNT=deny",
+		"INCOGNITOMAIL_VERIFICATION_FROM=noreply@sidhion.com",
+	}
+
+	overrides, rest := incognitomail.SplitConfigFlags([]string{"-c", path, "--general.listenaddress=:9002", "--BruteForce.MaxFailures=3", "-verification.enabled", "--", "--general.apipath=/api"})
+	if len(rest) != 4 || rest[2] != "--" {
+		t.Fatalf("unexpected remaining arguments %v", rest)
+	}
+
+	err = incognitomail.LoadConfig(path, environ, overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if incognitomail.Config.General.ListenAddress != ":9002" {
+		t.Errorf("expected flag to win, got %q", incognitomail.Config.General.ListenAddress)
+	}
+
+	if incognitomail.Config.PostfixConfig.Domain != "@sidhion.com" {
+		t.Errorf("expected domain from environment, got %q", incognitomail.Config.PostfixConfig.Domain)
+	}
+
+	if origins := incognitomail.Config.General.AllowedOrigin; len(origins) != 2 || origins[0] != "https://a.example" {
+		t.Errorf("expected environment to replace allowed origins, got %v", origins)
+	}
+
+	if incognitomail.Config.BruteForce.MaxFailures != 3 {
+		t.Errorf("expected 3 max failures, got %d", incognitomail.Config.BruteForce.MaxFailures)
+	}
+
+	if !incognitomail.Config.Verification.Enabled {
+		t.Error("expected verification to be enabled")
+	}
+
+	if p := incognitomail.Config.Permissions["websocket"]; p == nil || p.NewAccount != "deny" {
+		t.Errorf("expected websocket permissions from environment, got %v", p)
+	}
+
+	// Verification is enabled without a From address, which is only noticed after merging everything
+	err = incognitomail.LoadConfig(path, environ, append(overrides, "verification.from="))
+	if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+		t.Errorf("expected ErrInvalidConfig, got %v", err)
+	}
+}
+
+// Ensure unknown keys are rejected instead of silently ignored.
+func TestConfig_unknownOverride(t *testing.T) {
+	incognitomail.ResetConfig()
+
+	err := incognitomail.LoadConfig("", []string{"INCOGNITOMAIL_GENERAL_LISTENADRESS=:9000"}, nil)
+	if err == nil {
+		t.Error("expected error for unknown environment variable")
+	}
+
+	err = incognitomail.LoadConfig("", nil, []string{"general.listenadress=:9000"})
+	if err == nil {
+		t.Error("expected error for unknown flag")
+	}
+
+	err = incognitomail.LoadConfig("", nil, []string{"bruteforce.maxfailures=many"})
+	if err == nil {
+		t.Error("expected error for invalid value")
+	}
+}
+
+// Ensure every invalid key is reported with its own reason.
+func TestConfig_fieldErrors(t *testing.T) {
+	incognitomail.ResetConfig()
+
+	reader := strings.NewReader("[General]\nListenAddress = \"8080\"\nLockFilePath = \"incognitomail.lock\"\n[PostfixConfig]\nDomain = \"sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n[Logging]\nLevel = \"loud\"\n")
+
+	err := incognitomail.ReadConfigFromReader(reader)
+	if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+		t.Fatalf("expected ErrInvalidConfig, got %v", err)
+	}
+
+	var configErr *incognitomail.ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected a ConfigError, got %T", err)
+	}
+
+	fields := map[string]bool{}
+	for _, f := range configErr.Fields {
+		fields[f.Field] = true
+	}
+
+	for _, field := range []string{"General.ListenAddress", "General.LockFilePath", "PostfixConfig.Domain", "Logging.Level"} {
+		if !fields[field] {
+			t.Errorf("expected %s to be reported, got %v", field, configErr)
+		}
+	}
+
+	if len(configErr.Fields) != 4 {
+		t.Errorf("expected 4 invalid fields, got %v", configErr)
+	}
+}
+
+func TestConfig_invalidDomain(t *testing.T) {
+	domains := []string{"@", "@sidhion", "@-sidhion.com", "@sidhion..com", "@sid hion.com", "sidhion.com@"}
+
+	for _, domain := range domains {
+		incognitomail.ResetConfig()
+
+		reader := strings.NewReader("[PostfixConfig]\nDomain = \"" + domain + "\"\nMapFilePath = \"/tmp/postfix/canonical\"\n")
+
+		err := incognitomail.ReadConfigFromReader(reader)
+		if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+			t.Errorf("expected ErrInvalidConfig for %q, got %v", domain, err)
+		}
+	}
+}
+
+// Ensure the certificate and key are checked to exist and belong together.
+func TestConfig_keyPair(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeKeyPair(t, dir, "a")
+	_, otherKeyFile := writeKeyPair(t, dir, "b")
+
+	tests := []struct {
+		cert, key string
+		valid     bool
+	}{
+		{certFile, keyFile, true},
+		{certFile, otherKeyFile, false},
+		{certFile, "", false},
+		{filepath.Join(dir, "missing.pem"), keyFile, false},
+	}
+
+	for _, test := range tests {
+		incognitomail.ResetConfig()
+
+		reader := strings.NewReader("[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n[General]\nTLSCertFile = \"" + test.cert + "\"\nTLSKeyFile = \"" + test.key + "\"\n")
+
+		err := incognitomail.ReadConfigFromReader(reader)
+		if test.valid && err != nil {
+			t.Errorf("expected %s and %s to be valid, got %v", test.cert, test.key, err)
+		}
+
+		if !test.valid && !errors.Is(err, incognitomail.ErrInvalidConfig) {
+			t.Errorf("expected ErrInvalidConfig for %s and %s, got %v", test.cert, test.key, err)
+		}
+	}
+}
+
+// Ensure the written configuration can be read back into the same values.
+func TestConfig_write(t *testing.T) {
+	incognitomail.ResetConfig()
+
+	err := incognitomail.ReadConfigFromReader(strings.NewReader("[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"/tmp/postfix/canonical\"\n[General]\nAllowedOrigin = \"moz-extension://*\"\nAllowedOrigin = \"null\"\n[Permissions \"websocket 10.0.0.0/8\"]\nDeleteHandle = \"allow\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = incognitomail.WriteConfig(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := buf.String()
+
+	incognitomail.ResetConfig()
+
+	err = incognitomail.ReadConfigFromReader(strings.NewReader(written))
+	if err != nil {
+		t.Fatalf("could not read back %s: %v", written, err)
+	}
+
+	if len(incognitomail.Config.General.AllowedOrigin) != 2 {
+		t.Errorf("expected 2 allowed origins, got %v", incognitomail.Config.General.AllowedOrigin)
+	}
+
+	if p := incognitomail.Config.Permissions["websocket 10.0.0.0/8"]; p == nil || p.DeleteHandle != "allow" {
+		t.Errorf("expected permissions to be written, got %s", written)
+	}
+}
+
+// writeKeyPair writes a self-signed certificate for localhost and its key to dir, returning their paths. The certificate can also be trusted as a CA, and used by both servers and clients.
+func writeKeyPair(t *testing.T, dir, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "sidhion.com"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+".key")
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
 }
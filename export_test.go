@@ -0,0 +1,78 @@
+package incognitomail
+
+import (
+	"crypto/tls"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Unexported functions used by the tests in incognitomail_test.
+var (
+	OriginAllowed    = originAllowed
+	CheckOrigin      = checkOrigin
+	NewRPCListener   = newRPCListenerFromConfig
+	PeerCredentials  = peerCredentials
+	NewACMEManager   = newACMEManagerFromConfig
+	ApplyTLSPolicy   = applyTLSPolicy
+	MetricsErrorName = metricsErrorName
+)
+
+// AuthLimiter is exported so tests can hold one.
+type AuthLimiter = authLimiter
+
+// NewAuthLimiter returns the limiter used for the given config, reading the current time from now.
+func NewAuthLimiter(c BruteForceConfig, now func() time.Time) *authLimiter {
+	l := newAuthLimiterFromConfig(c)
+	l.now = now
+	return l
+}
+
+func (l *authLimiter) Check(remoteAddr string) error  { return l.check(remoteAddr) }
+func (l *authLimiter) Failure(remoteAddr string) bool { return l.failure(remoteAddr, sourceWebsocket) }
+func (l *authLimiter) Success(remoteAddr string)      { l.success(remoteAddr) }
+
+// CounterVec and HistogramVec are exported so tests can check the exposition format.
+type (
+	CounterVec   = counterVec
+	HistogramVec = histogramVec
+)
+
+var (
+	NewCounterVec   = newCounterVec
+	NewHistogramVec = newHistogramVec
+)
+
+func (c *counterVec) Inc(labelValues ...string)                  { c.inc(labelValues...) }
+func (c *counterVec) Write(w io.Writer)                          { c.writeTo(w) }
+func (h *histogramVec) Observe(v float64, labelValues ...string) { h.observe(v, labelValues...) }
+func (h *histogramVec) Write(w io.Writer)                        { h.writeTo(w) }
+
+// WaitingCommands returns how many commands are waiting for the mail system.
+func (s *Service) WaitingCommands() int64 { return atomic.LoadInt64(&s.waitingCommands) }
+
+// RPCService is exported so tests can call the RPC methods without a dispatcher.
+type RPCService = rpcService
+
+// NewRPCService returns the service registered in the RPC dispatcher of s, marking s as started so its commands are executed without listening anywhere.
+func NewRPCService(s *Server) *rpcService {
+	s.stopMu.Lock()
+	s.started = true
+	s.stopMu.Unlock()
+
+	return &rpcService{server: s}
+}
+
+func (l *rpcListener) Allowed(uid, gid uint32) bool { return l.allowed(uid, gid) }
+
+// CertificateProvider is exported so tests can check certificates being replaced.
+type CertificateProvider = certificateProvider
+
+func (c *certificateProvider) Load(certFile, keyFile string) error { return c.load(certFile, keyFile) }
+func (c *certificateProvider) ReloadIfChanged(certFile, keyFile string) (bool, error) {
+	return c.reloadIfChanged(certFile, keyFile)
+}
+func (c *certificateProvider) Check(certFile, keyFile string) { c.check(certFile, keyFile) }
+func (c *certificateProvider) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.getCertificate(hello)
+}
@@ -0,0 +1,124 @@
+package incognitomail
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthStatusOK    = "ok"
+	healthStatusError = "error"
+)
+
+var (
+	// ErrCommandsStalled is used when a health check finds a command that has been changing the mail system for longer than the command timeout.
+	ErrCommandsStalled = errors.New("commands are not being executed")
+
+	// ErrLockFileLost is used when the lock file held by the server was removed or replaced.
+	ErrLockFileLost = errors.New("lock file is no longer held by this server")
+)
+
+// healthCheck is the result of a single check, as sent in the JSON response.
+type healthCheck struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthResponse is the JSON response of the health and readiness endpoints.
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+// serveHealth answers if the server is alive, i.e. if the database and the goroutine executing commands still respond. A failure here means the server should be restarted.
+func (s *Service) serveHealth(w http.ResponseWriter, req *http.Request) {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+
+	writeHealthResponse(w, map[string]error{
+		"database": s.persistence.Ping(),
+		"commands": s.pingCommands(),
+	})
+}
+
+// serveReady answers if the server can execute commands right now. Besides the checks done for health, also checks the mail system and anything added by the daemon, such as the lock file.
+func (s *Service) serveReady(w http.ResponseWriter, req *http.Request) {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+
+	results := map[string]error{
+		"database":    s.persistence.Ping(),
+		"commands":    s.pingCommands(),
+		"mail_system": s.mailSystemWriter.Writable(),
+	}
+
+	for name, check := range s.readyChecks {
+		results[name] = check()
+	}
+
+	writeHealthResponse(w, results)
+}
+
+// writeHealthResponse writes the result of every check as JSON, with status 503 if any of them failed.
+func writeHealthResponse(w http.ResponseWriter, results map[string]error) {
+	response := healthResponse{
+		Status: healthStatusOK,
+		Checks: make(map[string]healthCheck, len(results)),
+	}
+
+	for name, err := range results {
+		check := healthCheck{Status: healthStatusOK}
+		if err != nil {
+			check = healthCheck{Status: healthStatusError, Error: err.Error()}
+			response.Status = healthStatusError
+		}
+
+		response.Checks[name] = check
+	}
+
+	status := http.StatusOK
+	if response.Status != healthStatusOK {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// pingCommands returns ErrCommandsStalled if a command has been changing the mail system for longer than the command timeout, so every command waiting for it times out. It never waits for the mail system itself, so a busy server isn't reported as unavailable.
+func (s *Service) pingCommands() error {
+	lockedAt := atomic.LoadInt64(&s.mailSystemLockedAt)
+	if lockedAt != 0 && time.Since(time.Unix(0, lockedAt)) > s.currentConfig().commandTimeout() {
+		return ErrCommandsStalled
+	}
+
+	return nil
+}
+
+// checkLockFile returns an error if the lock file acquired when the server started is not in its place anymore.
+func (s *Server) checkLockFile() error {
+	if s.lockFileHandle == nil {
+		return ErrLockFileNotFound
+	}
+
+	held, err := s.lockFileHandle.Stat()
+	if err != nil {
+		return err
+	}
+
+	current, err := os.Stat(s.currentConfig().General.LockFilePath)
+	if err != nil {
+		return err
+	}
+
+	if !os.SameFile(held, current) {
+		return ErrLockFileLost
+	}
+
+	return nil
+}
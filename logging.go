@@ -0,0 +1,301 @@
+package incognitomail
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	logLevelDebug = "DEBUG"
+	logLevelInfo  = "INFO"
+	logLevelError = "ERROR"
+
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	logSinkStderr = "stderr"
+	logSinkFile   = "file"
+	logSinkSyslog = "syslog"
+)
+
+var (
+	// logLevels holds every known level, from the least to the most severe.
+	logLevels = []string{logLevelDebug, logLevelInfo, logLevelError}
+
+	// ErrSyslogUnavailable is used when logging to syslog in a system that doesn't support it.
+	ErrSyslogUnavailable = errors.New("syslog is not available in this system")
+
+	// defaultLogger is used until logging is configured.
+	defaultLogger = newLogger(logLevelInfo, logFormatText, os.Stderr, nil)
+
+	// currentLogger holds the logger installed by ConfigureLogging, which replaces it as a whole.
+	currentLogger atomic.Pointer[logger]
+)
+
+// logFields holds structured data attached to a log entry, e.g. the command being executed or its latency.
+type logFields map[string]interface{}
+
+// syslogWriter is the subset of a syslog connection used by logger, so the sink can be left out in systems without syslog.
+type syslogWriter interface {
+	Debug(m string) error
+	Info(m string) error
+	Err(m string) error
+	Close() error
+}
+
+// logger writes leveled log entries, optionally with structured fields, to either a writer or syslog. Once installed by ConfigureLogging, it also acts as the output for the standard log package, so messages logged with log.Printf and a "[LEVEL]" prefix go through the same filtering and formatting.
+type logger struct {
+	mu       sync.Mutex
+	minLevel int
+	format   string
+	out      io.Writer
+	syslog   syslogWriter
+
+	// Set once the sink is closed, after which entries go to the current logger instead
+	closed bool
+}
+
+// newLogger creates a logger that discards anything less severe than minLevel. If sl is not nil, entries go to syslog instead of out.
+func newLogger(minLevel, format string, out io.Writer, sl syslogWriter) *logger {
+	return &logger{
+		minLevel: logLevelIndex(minLevel),
+		format:   format,
+		out:      out,
+		syslog:   sl,
+	}
+}
+
+// logLevelIndex returns the severity of the level, or -1 if it's unknown.
+func logLevelIndex(level string) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// SetupLogging replaces the current logger with one following the [Logging] section of the global Config. See ConfigureLogging.
+func SetupLogging() error {
+	return ConfigureLogging(Config.Logging)
+}
+
+// ConfigureLogging replaces the current logger with one following the given [Logging] section. Messages logged from then on, including the ones from the standard log package, use the new settings. The logger is shared by the whole process.
+func ConfigureLogging(c LoggingConfig) error {
+	var out io.Writer
+	var sl syslogWriter
+
+	switch c.Sink {
+	case logSinkStderr:
+		out = os.Stderr
+	case logSinkFile:
+		f, err := os.OpenFile(c.FilePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return err
+		}
+		out = f
+	case logSinkSyslog:
+		var err error
+		sl, err = openSyslog(c.SyslogTag)
+		if err != nil {
+			return err
+		}
+	}
+
+	l := newLogger(strings.ToUpper(c.Level), c.Format, out, sl)
+
+	old := currentLogger.Swap(l)
+	log.SetFlags(0)
+	log.SetOutput(l)
+
+	// Goroutines may still be logging with the old logger, and their entries are passed on to the new one once it's closed
+	if old != nil {
+		old.close()
+	}
+
+	return nil
+}
+
+// checkLoggingConfig records any invalid value in the [Logging] section of the configuration.
+func checkLoggingConfig(c *Configuration, p *configProblems) {
+	if logLevelIndex(strings.ToUpper(c.Logging.Level)) < 0 {
+		p.add("Logging.Level", "%q must be one of %s", c.Logging.Level, strings.Join(logLevels, ", "))
+	}
+
+	if c.Logging.Format != logFormatText && c.Logging.Format != logFormatJSON {
+		p.add("Logging.Format", "%q must be %q or %q", c.Logging.Format, logFormatText, logFormatJSON)
+	}
+
+	switch c.Logging.Sink {
+	case logSinkStderr, logSinkSyslog:
+	case logSinkFile:
+		p.required("Logging.FilePath", c.Logging.FilePath)
+		p.absolutePath("Logging.FilePath", c.Logging.FilePath)
+	default:
+		p.add("Logging.Sink", "%q must be one of %q, %q or %q", c.Logging.Sink, logSinkStderr, logSinkFile, logSinkSyslog)
+	}
+}
+
+// activeLogger returns the logger installed by ConfigureLogging, or the default one if logging wasn't configured.
+func activeLogger() *logger {
+	if l := currentLogger.Load(); l != nil {
+		return l
+	}
+
+	return defaultLogger
+}
+
+// logEntry logs msg with the given level and fields using the current logger.
+func logEntry(level, msg string, fields logFields) {
+	activeLogger().log(time.Now(), level, msg, fields)
+}
+
+// logFatal logs err with the ERROR level and exits, the same as log.Fatal.
+func logFatal(err error) {
+	logEntry(logLevelError, err.Error(), nil)
+	os.Exit(1)
+}
+
+// Write implements io.Writer for the standard log package. Messages starting with "[LEVEL]" are logged with that level, anything else with INFO.
+func (l *logger) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	level := logLevelInfo
+
+	if strings.HasPrefix(msg, "[") {
+		end := strings.Index(msg, "]")
+		if end > 0 && logLevelIndex(msg[1:end]) >= 0 {
+			level = msg[1:end]
+			msg = strings.TrimLeft(msg[end+1:], " ")
+		}
+	}
+
+	l.log(time.Now(), level, msg, nil)
+
+	return len(p), nil
+}
+
+// log formats and writes a single entry, unless its level is below the minimum one.
+func (l *logger) log(t time.Time, level, msg string, fields logFields) {
+	if logLevelIndex(level) < l.minLevel {
+		return
+	}
+
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+
+		// Replaced while the entry was being logged, so it goes to the logger that replaced this one
+		activeLogger().log(t, level, msg, fields)
+		return
+	}
+	defer l.mu.Unlock()
+
+	// Syslog already records the time of every message
+	withTime := l.syslog == nil
+
+	var line string
+	if l.format == logFormatJSON {
+		line = formatJSONLogEntry(t, withTime, level, msg, fields)
+	} else {
+		line = formatTextLogEntry(t, withTime, level, msg, fields)
+	}
+
+	if l.syslog != nil {
+		switch level {
+		case logLevelDebug:
+			l.syslog.Debug(line)
+		case logLevelError:
+			l.syslog.Err(line)
+		default:
+			l.syslog.Info(line)
+		}
+		return
+	}
+
+	fmt.Fprintln(l.out, line)
+}
+
+// close releases the sink used by the logger, if it's not shared with anything else. Entries logged afterwards go to the current logger.
+func (l *logger) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+
+	if l.syslog != nil {
+		l.syslog.Close()
+	}
+
+	if f, ok := l.out.(*os.File); ok && f != os.Stderr && f != os.Stdout {
+		f.Close()
+	}
+}
+
+// sortedFieldNames returns the field names in a stable order, so text entries are easier to compare.
+func sortedFieldNames(fields logFields) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// formatTextLogEntry formats an entry as "time [LEVEL] msg key=value...".
+func formatTextLogEntry(t time.Time, withTime bool, level, msg string, fields logFields) string {
+	var b bytes.Buffer
+
+	if withTime {
+		b.WriteString(t.Format("2006/01/02 15:04:05 "))
+	}
+
+	fmt.Fprintf(&b, "[%s] %s", level, msg)
+
+	for _, name := range sortedFieldNames(fields) {
+		value := fmt.Sprint(fields[name])
+		if value == "" || strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+
+		fmt.Fprintf(&b, " %s=%s", name, value)
+	}
+
+	return b.String()
+}
+
+// formatJSONLogEntry formats an entry as a single JSON object, with the fields alongside "time", "level" and "msg".
+func formatJSONLogEntry(t time.Time, withTime bool, level, msg string, fields logFields) string {
+	entry := make(map[string]interface{}, len(fields)+3)
+	for name, value := range fields {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[name] = value
+	}
+
+	if withTime {
+		entry["time"] = t.UTC().Format(time.RFC3339Nano)
+	}
+	entry["level"] = level
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Sprintf(`{"level":%q,"msg":%q}`, level, msg)
+	}
+
+	return string(line)
+}
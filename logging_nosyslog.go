@@ -0,0 +1,9 @@
+//go:build windows || nacl || plan9
+// +build windows nacl plan9
+
+package incognitomail
+
+// openSyslog always fails, since syslog is not available in this system.
+func openSyslog(tag string) (syslogWriter, error) {
+	return nil, ErrSyslogUnavailable
+}
@@ -0,0 +1,11 @@
+//go:build !windows && !nacl && !plan9
+// +build !windows,!nacl,!plan9
+
+package incognitomail
+
+import "log/syslog"
+
+// openSyslog connects to the local syslog daemon, tagging every message with tag.
+func openSyslog(tag string) (syslogWriter, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
@@ -0,0 +1,187 @@
+package incognitomail_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+func TestSetupLogging_jsonFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incognitomail_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	incognitomail.ResetConfig()
+	incognitomail.Config.Logging.Sink = "file"
+	incognitomail.Config.Logging.FilePath = filepath.Join(dir, "incognitomail.log")
+	incognitomail.Config.Logging.Format = "json"
+
+	err = incognitomail.SetupLogging()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Going back to the default logger also closes the log file
+	defer func() {
+		incognitomail.ResetConfig()
+		incognitomail.SetupLogging()
+	}()
+
+	log.Printf("[DEBUG] should be filtered out\n")
+	log.Printf("[ERROR] something failed\n")
+	log.Printf("no level\n")
+
+	content, err := ioutil.ReadFile(incognitomail.Config.Logging.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %d: %q", len(lines), lines)
+	}
+
+	expected := []struct{ level, msg string }{
+		{"ERROR", "something failed"},
+		{"INFO", "no level"},
+	}
+
+	for i, line := range lines {
+		var entry map[string]interface{}
+
+		err = json.Unmarshal([]byte(line), &entry)
+		if err != nil {
+			t.Fatalf("line %q is not JSON: %s", line, err)
+		}
+
+		if entry["level"] != expected[i].level || entry["msg"] != expected[i].msg {
+			t.Errorf("expected %s %q, got %v %v", expected[i].level, expected[i].msg, entry["level"], entry["msg"])
+		}
+
+		if _, ok := entry["time"]; !ok {
+			t.Errorf("line %q has no time", line)
+		}
+	}
+}
+
+// Ensure messages logged by the package keep their details as separate fields.
+func TestLogging_fields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incognitomail_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := incognitomail.DefaultConfiguration().Logging
+	config.Sink = "file"
+	config.FilePath = filepath.Join(dir, "incognitomail.log")
+	config.Format = "json"
+
+	err = incognitomail.ConfigureLogging(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer incognitomail.ConfigureLogging(incognitomail.DefaultConfiguration().Logging)
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/incognitomail", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Origin", "https://example.com")
+
+	incognitomail.CheckOrigin(nil, false, req)
+
+	content, err := ioutil.ReadFile(config.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entry map[string]interface{}
+
+	err = json.Unmarshal(content, &entry)
+	if err != nil {
+		t.Fatalf("log %q is not a single JSON entry: %s", content, err)
+	}
+
+	if entry["level"] != "INFO" || entry["origin"] != "https://example.com" || entry["remote_addr"] != "192.0.2.1:1234" {
+		t.Errorf("expected the origin and remote address as fields, got %v", entry)
+	}
+}
+
+// Ensure no entry is lost while the logger is replaced, even if it was being written with the old one.
+func TestConfigureLogging_Concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incognitomail_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configs := make([]incognitomail.LoggingConfig, 2)
+	for i := range configs {
+		configs[i] = incognitomail.DefaultConfiguration().Logging
+		configs[i].Sink = "file"
+		configs[i].FilePath = filepath.Join(dir, fmt.Sprintf("incognitomail%d.log", i))
+	}
+
+	err = incognitomail.ConfigureLogging(configs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer incognitomail.ConfigureLogging(incognitomail.DefaultConfiguration().Logging)
+
+	req, err := http.NewRequest(http.MethodGet, "http://localhost/incognitomail", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "https://example.com")
+
+	const writers, entries = 4, 200
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Every refused origin is logged
+			for j := 0; j < entries; j++ {
+				incognitomail.CheckOrigin(nil, false, req)
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		err = incognitomail.ConfigureLogging(configs[(i+1)%2])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wg.Wait()
+
+	total := 0
+	for _, c := range configs {
+		content, err := ioutil.ReadFile(c.FilePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		total += strings.Count(string(content), "\n")
+	}
+
+	if total != writers*entries {
+		t.Errorf("expected %d entries, got %d", writers*entries, total)
+	}
+}
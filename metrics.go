@@ -0,0 +1,335 @@
+package incognitomail
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	// metricsLabelSeparator joins label values into a single map key. It can't appear in valid UTF-8, so it never clashes with the values themselves.
+	metricsLabelSeparator = "\xff"
+
+	// metricsInvalidCommand is the command label of commands that couldn't be parsed.
+	metricsInvalidCommand = "invalid"
+)
+
+var (
+	// metricsDurationBuckets are the upper bounds, in seconds, of the buckets used in every latency histogram.
+	metricsDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+	// metricsErrorNames labels sentinel errors in metrics. Any other error is labeled "other", so the number of label values stays bounded.
+	metricsErrorNames = map[error]string{
+		ErrAccountExists:      "ErrAccountExists",
+		ErrAccountNotFound:    "ErrAccountNotFound",
+		ErrAccountPending:     "ErrAccountPending",
+		ErrAuditDisabled:      "ErrAuditDisabled",
+		ErrCommandCancelled:   "ErrCommandCancelled",
+		ErrCommandTimeout:     "ErrCommandTimeout",
+		ErrEmptyCommand:       "ErrEmptyCommand",
+		ErrEmptyInvite:        "ErrEmptyInvite",
+		ErrEmptySecret:        "ErrEmptySecret",
+		ErrEmptyTarget:        "ErrEmptyTarget",
+		ErrHandleExists:       "ErrHandleExists",
+		ErrHandleNotFound:     "ErrHandleNotFound",
+		ErrInvalidPermission:  "ErrInvalidPermission",
+		ErrInvalidTarget:      "ErrInvalidTarget",
+		ErrInviteExists:       "ErrInviteExists",
+		ErrInviteNotFound:     "ErrInviteNotFound",
+		ErrInviteRequired:     "ErrInviteRequired",
+		ErrMalformedMapFile:   "ErrMalformedMapFile",
+		ErrOriginNotAllowed:   "ErrOriginNotAllowed",
+		ErrServerStopping:     "ErrServerStopping",
+		ErrTargetNotAllowed:   "ErrTargetNotAllowed",
+		ErrTargetNotConfirmed: "ErrTargetNotConfirmed",
+		ErrTokenNotFound:      "ErrTokenNotFound",
+		ErrTooManyAttempts:    "ErrTooManyAttempts",
+		ErrTooManyTargets:     "ErrTooManyTargets",
+		ErrUnknownCommand:     "ErrUnknownCommand",
+		ErrWrongCommand:       "ErrWrongCommand",
+	}
+)
+
+// serviceMetrics holds the metrics of a single Service, so services running in the same process don't count each other's commands.
+type serviceMetrics struct {
+	commandsTotal         *counterVec
+	commandErrorsTotal    *counterVec
+	commandDuration       *histogramVec
+	mailSystemErrorsTotal *counterVec
+	postmapDuration       *histogramVec
+
+	// Number of websocket connections currently open
+	websocketConnections int64
+}
+
+// newServiceMetrics returns metrics with nothing counted yet.
+func newServiceMetrics() *serviceMetrics {
+	return &serviceMetrics{
+		commandsTotal:         newCounterVec("incognitomail_commands_total", "Commands executed, by command, source and outcome.", "command", "source", "outcome"),
+		commandErrorsTotal:    newCounterVec("incognitomail_command_errors_total", "Commands that failed, by command and error.", "command", "error"),
+		commandDuration:       newHistogramVec("incognitomail_command_duration_seconds", "Time taken to execute commands, including the time waiting in the queue.", metricsDurationBuckets, "command"),
+		mailSystemErrorsTotal: newCounterVec("incognitomail_mail_system_errors_total", "Failed changes to the mail system, by operation.", "operation"),
+		postmapDuration:       newHistogramVec("incognitomail_postmap_duration_seconds", "Time taken by postmap to rebuild the map file.", metricsDurationBuckets),
+	}
+}
+
+// counterVec is a set of Prometheus counters sharing a name, one for each combination of label values.
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+// histogramVec is a set of Prometheus histograms sharing a name and buckets, one for each combination of label values.
+type histogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+// histogram holds the cumulative bucket counts, the count and the sum of the observed values.
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// gauge is a Prometheus gauge without labels, whose value is read only when the metrics are collected.
+type gauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+// inc adds one to the counter with the given label values, which must be in the same order as the labels of the counterVec.
+func (c *counterVec) inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.values[strings.Join(labelValues, metricsLabelSeparator)]++
+}
+
+// observe records v in the histogram with the given label values, which must be in the same order as the labels of the histogramVec.
+func (h *histogramVec) observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labelValues, metricsLabelSeparator)
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+// observeSince records the time elapsed since start, in seconds.
+func (h *histogramVec) observeSince(start time.Time, labelValues ...string) {
+	h.observe(time.Since(start).Seconds(), labelValues...)
+}
+
+// writeTo writes the counters in the Prometheus text format.
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeMetricHeader(w, c.name, c.help, "counter")
+
+	for _, key := range sortedMetricKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatMetricLabels(c.labels, key, ""), formatMetricValue(c.values[key]))
+	}
+}
+
+// writeTo writes the histograms in the Prometheus text format.
+func (h *histogramVec) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeMetricHeader(w, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := h.values[key]
+
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatMetricLabels(h.labels, key, formatMetricValue(upper)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatMetricLabels(h.labels, key, "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatMetricLabels(h.labels, key, ""), formatMetricValue(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatMetricLabels(h.labels, key, ""), hist.count)
+	}
+}
+
+// writeTo writes the gauge in the Prometheus text format.
+func (g gauge) writeTo(w io.Writer) {
+	writeMetricHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatMetricValue(g.value()))
+}
+
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func sortedMetricKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// formatMetricLabels formats the label values joined in key as {label="value",...}. If le is not empty, it's added as the histogram bucket label.
+func formatMetricLabels(labels []string, key, le string) string {
+	var pairs []string
+
+	if len(labels) > 0 {
+		values := strings.Split(key, metricsLabelSeparator)
+		for i, label := range labels {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", label, escapeMetricLabelValue(values[i])))
+		}
+	}
+
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=\"%s\"", le))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeMetricLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricsErrorName returns the label used for err in metrics.
+func metricsErrorName(err error) string {
+	name, ok := metricsErrorNames[err]
+	if !ok {
+		return "other"
+	}
+
+	return name
+}
+
+// recordCommand updates all command metrics after a command has been executed.
+func (m *serviceMetrics) recordCommand(command interface{}, source string, start time.Time, err error) {
+	name := commandName(command)
+
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+		m.commandErrorsTotal.inc(name, metricsErrorName(err))
+	}
+
+	m.commandsTotal.inc(name, source, outcome)
+	m.commandDuration.observeSince(start, name)
+}
+
+// recordInvalidCommand updates the command metrics after a command couldn't be parsed.
+func (m *serviceMetrics) recordInvalidCommand(source string, err error) {
+	m.commandErrorsTotal.inc(metricsInvalidCommand, metricsErrorName(err))
+	m.commandsTotal.inc(metricsInvalidCommand, source, "error")
+}
+
+// newMetricsHandler returns a handler that exposes all metrics in the Prometheus text format, including the ones that depend on the state of s.
+func newMetricsHandler(s *Service) http.Handler {
+	gauges := []gauge{
+		{
+			name:  "incognitomail_command_queue_length",
+			help:  "Commands waiting for other commands to finish changing the mail system.",
+			value: func() float64 { return float64(atomic.LoadInt64(&s.waitingCommands)) },
+		},
+		{
+			name:  "incognitomail_websocket_connections",
+			help:  "Websocket connections currently open.",
+			value: func() float64 { return float64(atomic.LoadInt64(&s.metrics.websocketConnections)) },
+		},
+		{
+			name: "incognitomail_database_size_bytes",
+			help: "Size of the database.",
+			value: func() float64 {
+				size, err := s.persistence.Size()
+				if err != nil {
+					logEntry(logLevelDebug, "Could not get the database size", logFields{"error": err})
+					return math.NaN()
+				}
+
+				return float64(size)
+			},
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+
+		s.metrics.commandsTotal.writeTo(w)
+		s.metrics.commandErrorsTotal.writeTo(w)
+		s.metrics.commandDuration.writeTo(w)
+		s.metrics.mailSystemErrorsTotal.writeTo(w)
+		s.metrics.postmapDuration.writeTo(w)
+
+		for _, g := range gauges {
+			g.writeTo(w)
+		}
+	})
+}
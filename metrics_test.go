@@ -0,0 +1,143 @@
+package incognitomail_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+// Ensure counters are written in the Prometheus text format, with label values escaped.
+func TestCounterVec_Write(t *testing.T) {
+	t.Parallel()
+
+	c := incognitomail.NewCounterVec("test_total", "Test counter.", "command", "source")
+	c.Inc("new handle", "rpc")
+	c.Inc("new handle", "rpc")
+	c.Inc(`quote " backslash \ newline`+"\n", "websocket")
+
+	var b bytes.Buffer
+	c.Write(&b)
+
+	expected := "# HELP test_total Test counter.\n" +
+		"# TYPE test_total counter\n" +
+		`test_total{command="new handle",source="rpc"} 2` + "\n" +
+		`test_total{command="quote \" backslash \\ newline\n",source="websocket"} 1` + "\n"
+
+	if b.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+// Ensure histograms are written with cumulative buckets, the +Inf bucket, the sum and the count.
+func TestHistogramVec_Write(t *testing.T) {
+	t.Parallel()
+
+	h := incognitomail.NewHistogramVec("test_seconds", "Test histogram.", []float64{0.1, 1}, "command")
+	h.Observe(0.05, "list")
+	h.Observe(0.5, "list")
+	h.Observe(5, "list")
+
+	var b bytes.Buffer
+	h.Write(&b)
+
+	expected := "# HELP test_seconds Test histogram.\n" +
+		"# TYPE test_seconds histogram\n" +
+		`test_seconds_bucket{command="list",le="0.1"} 1` + "\n" +
+		`test_seconds_bucket{command="list",le="1"} 2` + "\n" +
+		`test_seconds_bucket{command="list",le="+Inf"} 3` + "\n" +
+		`test_seconds_sum{command="list"} 5.55` + "\n" +
+		`test_seconds_count{command="list"} 3` + "\n"
+
+	if b.String() != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, b.String())
+	}
+}
+
+// withMetrics is a configure func for newTestService exposing the metrics in the handler of the service.
+func withMetrics(c *incognitomail.Configuration) {
+	c.Metrics.Enabled = true
+	c.Metrics.ListenAddress = ""
+}
+
+// readMetrics returns the metrics exposed by the handler of service.
+func readMetrics(t *testing.T, service *incognitomail.Service) string {
+	ts := httptest.NewServer(service.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + incognitomail.DefaultConfiguration().Metrics.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+// Ensure sentinel errors are labeled with their own names, and any other error as "other".
+func TestMetricsErrorName(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err  error
+		name string
+	}{
+		{incognitomail.ErrTargetNotConfirmed, "ErrTargetNotConfirmed"},
+		{incognitomail.ErrOriginNotAllowed, "ErrOriginNotAllowed"},
+		{incognitomail.ErrInviteNotFound, "ErrInviteNotFound"},
+		{errors.New("invite code not found"), "other"},
+	}
+
+	for _, test := range tests {
+		if name := incognitomail.MetricsErrorName(test.err); name != test.name {
+			t.Errorf("expected %v to be labeled %q, got %q", test.err, test.name, name)
+		}
+	}
+}
+
+// Ensure commands that can't be parsed are counted as well.
+func TestMetrics_InvalidCommands(t *testing.T) {
+	t.Parallel()
+
+	service, _ := newTestService(t, withMetrics)
+
+	for _, args := range []string{"", "bogus", "new handle"} {
+		service.SendCommand("", args)
+	}
+
+	body := readMetrics(t, service)
+
+	for _, name := range []string{"ErrEmptyCommand", "ErrUnknownCommand", "ErrWrongCommand"} {
+		if !strings.Contains(body, `incognitomail_command_errors_total{command="invalid",error="`+name+`"} 1`) {
+			t.Errorf("expected %s to be counted once, got:\n%s", name, body)
+		}
+	}
+}
+
+// Ensure each service only counts its own commands.
+func TestMetrics_PerService(t *testing.T) {
+	t.Parallel()
+
+	first, _ := newTestService(t, withMetrics)
+	second, _ := newTestService(t, withMetrics)
+
+	first.SendCommand("", "bogus")
+
+	if !strings.Contains(readMetrics(t, first), `incognitomail_commands_total{command="invalid"`) {
+		t.Error("expected the command to be counted by the service running it")
+	}
+
+	if body := readMetrics(t, second); strings.Contains(body, `incognitomail_commands_total{`) {
+		t.Errorf("expected no commands to be counted by the other service, got:\n%s", body)
+	}
+}
@@ -0,0 +1,75 @@
+package incognitomail
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// Browsers send this origin for requests coming from local files and some sandboxed pages.
+	nullOrigin = "null"
+
+	// An allowed origin ending with this accepts any host with the same scheme, e.g. "moz-extension://*".
+	anyHostSuffix = "://*"
+)
+
+var (
+	// ErrOriginNotAllowed is used when a request comes from a browser page whose origin isn't in the list of allowed origins.
+	ErrOriginNotAllowed = errors.New("origin not allowed")
+)
+
+// validOriginPattern returns true if the pattern is either "null" or in the form scheme://host, where host may be "*".
+func validOriginPattern(pattern string) bool {
+	if pattern == nullOrigin {
+		return true
+	}
+
+	parts := strings.SplitN(pattern, "://", 2)
+	return len(parts) == 2 && parts[0] != "" && parts[1] != "" && !strings.Contains(parts[1], "/")
+}
+
+// originAllowed returns true if the origin matches any of the allowed origins. Origins are compared case-insensitively, as browsers may normalize them.
+func originAllowed(allowedOrigins []string, origin string) bool {
+	for _, pattern := range allowedOrigins {
+		if strings.HasSuffix(pattern, anyHostSuffix) {
+			scheme := strings.TrimSuffix(pattern, "*")
+			if len(origin) > len(scheme) && strings.EqualFold(origin[:len(scheme)], scheme) {
+				return true
+			}
+
+			continue
+		}
+
+		if strings.EqualFold(origin, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkOrigin returns ErrOriginNotAllowed unless the request comes from one of the allowed origins. If no allowed origins are configured, every origin is refused.
+// Requests without an Origin header don't come from browser pages, which always send it for websockets and cross-origin requests, but they are only accepted if allowMissing is true, so nothing gets through without being configured.
+func checkOrigin(allowedOrigins []string, allowMissing bool, req *http.Request) error {
+	origin := req.Header.Get("Origin")
+
+	if origin == "" {
+		if allowMissing {
+			return nil
+		}
+	} else if originAllowed(allowedOrigins, origin) {
+		return nil
+	}
+
+	logEntry(logLevelInfo, "Refused request from origin", logFields{"origin": origin, "remote_addr": req.RemoteAddr})
+	return ErrOriginNotAllowed
+}
+
+// checkWebsocketOrigin is used as the handshake function of the websocket server, refusing connections with checkOrigin.
+func (s *Service) checkWebsocketOrigin(wsConfig *websocket.Config, req *http.Request) error {
+	config := s.currentConfig()
+	return checkOrigin(config.General.AllowedOrigin, config.General.AllowMissingOrigin, req)
+}
@@ -0,0 +1,81 @@
+package incognitomail_test
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+// Ensure origins only match exact patterns, or any host of a "scheme://*" pattern, ignoring case.
+func TestOriginAllowed(t *testing.T) {
+	t.Parallel()
+
+	allowed := []string{"moz-extension://*", "https://sidhion.com", "null"}
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://sidhion.com", true},
+		{"HTTPS://SIDHION.COM", true},
+		{"moz-extension://3f2a9c1d-0e8b-7a65", true},
+		{"MOZ-EXTENSION://abc", true},
+		{"null", true},
+		{"https://sidhion.com.example.com", false},
+		{"http://sidhion.com", false},
+		{"https://example.com", false},
+		{"moz-extension://", false},
+		{"moz-extension:/abc", false},
+		{"chrome-extension://abc", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if incognitomail.OriginAllowed(allowed, test.origin) != test.allowed {
+			t.Errorf("expected %q allowed to be %v", test.origin, test.allowed)
+		}
+	}
+
+	if incognitomail.OriginAllowed(nil, "https://sidhion.com") {
+		t.Error("expected no origin to be allowed without patterns")
+	}
+}
+
+// Ensure requests are refused unless their origin is allowed, and requests without an origin only if allowed explicitly.
+func TestCheckOrigin(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		allowed      []string
+		allowMissing bool
+		origin       string
+		err          error
+	}{
+		{nil, false, "https://sidhion.com", incognitomail.ErrOriginNotAllowed},
+		{nil, false, "", incognitomail.ErrOriginNotAllowed},
+		{nil, true, "", nil},
+		{nil, true, "https://sidhion.com", incognitomail.ErrOriginNotAllowed},
+		{[]string{"https://sidhion.com"}, false, "https://sidhion.com", nil},
+		{[]string{"https://sidhion.com"}, false, "https://example.com", incognitomail.ErrOriginNotAllowed},
+		{[]string{"https://sidhion.com"}, false, "", incognitomail.ErrOriginNotAllowed},
+		{[]string{"https://sidhion.com"}, true, "", nil},
+		{[]string{"null"}, false, "null", nil},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost/incognitomail", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+
+		err = incognitomail.CheckOrigin(test.allowed, test.allowMissing, req)
+		if err != test.err {
+			t.Errorf("expected %v for origin %q with %v (missing allowed: %v), got %v", test.err, test.origin, test.allowed, test.allowMissing, err)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package incognitomail
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/gcfg.v1"
+)
+
+// envPrefix starts the name of every environment variable that overrides a config key.
+const envPrefix = "INCOGNITOMAIL_"
+
+// configKey is a single config key, with the names used in the config file.
+type configKey struct {
+	section    string
+	subsection string
+	key        string
+
+	multiValued bool
+}
+
+// configOverride is a value for a config key coming from outside the config file. A blank value has no "=" at all, which sets bool keys to true and clears multi-valued keys.
+type configOverride struct {
+	configKey
+	value string
+	blank bool
+}
+
+// LoadConfig loads the global Config with LoadConfiguration, only changing it if the result is valid.
+func LoadConfig(path string, environ, overrides []string) error {
+	c, err := LoadConfiguration(path, environ, overrides)
+	if err != nil {
+		return err
+	}
+
+	Config = *c
+	return nil
+}
+
+// LoadConfiguration builds a configuration by merging, from lowest to highest precedence, the default values, the file in the given path (if not empty), environment variables and command-line overrides.
+// environ holds "INCOGNITOMAIL_SECTION_KEY=value" entries as returned by os.Environ, with any variables without the prefix being ignored. overrides holds "section.key=value" entries as returned by SplitConfigFlags. The configuration is only validated after everything has been merged, and all sources are read again when a server using it is reloaded.
+func LoadConfiguration(path string, environ, overrides []string) (*Configuration, error) {
+	c := DefaultConfiguration()
+	c.source = configSource{path: path, environ: environ, overrides: overrides}
+
+	err := c.readSources()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.Check()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// SplitConfigFlags separates "--section.key=value" (or "-section.key=value") arguments from the others, so the rest can be parsed with the flag package. Arguments after a "--" terminator are never taken as overrides.
+func SplitConfigFlags(args []string) (overrides, rest []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+
+		name := strings.TrimLeft(arg, "-")
+		if len(name) == len(arg) || len(arg)-len(name) > 2 || !strings.Contains(strings.SplitN(name, "=", 2)[0], ".") {
+			rest = append(rest, arg)
+			continue
+		}
+
+		overrides = append(overrides, name)
+	}
+
+	return overrides, rest
+}
+
+// readSources reads the file, the environment and the command-line overrides in the configuration source into c, in that order.
+func (c *Configuration) readSources() error {
+	if c.source.path != "" {
+		f, err := os.Open(c.source.path)
+		if err != nil {
+			return err
+		}
+
+		before := *c
+
+		err = gcfg.ReadInto(c, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		err = c.resolvePaths(c.source.path, &before)
+		if err != nil {
+			return err
+		}
+	}
+
+	fromEnv, err := parseEnvironOverrides(c.source.environ)
+	if err != nil {
+		return err
+	}
+
+	err = applyConfigOverrides(c, fromEnv)
+	if err != nil {
+		return err
+	}
+
+	fromFlags, err := parseFlagOverrides(c.source.overrides)
+	if err != nil {
+		return err
+	}
+
+	return applyConfigOverrides(c, fromFlags)
+}
+
+// parseEnvironOverrides returns the overrides in environment variables named INCOGNITOMAIL_SECTION_KEY or INCOGNITOMAIL_SECTION_SUBSECTION_KEY. Subsection names are lowercased, and multi-valued keys take a comma-separated list.
+func parseEnvironOverrides(environ []string) ([]configOverride, error) {
+	var result []configOverride
+
+	for _, entry := range environ {
+		if !strings.HasPrefix(entry, envPrefix) {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		name := parts[0]
+		value := ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+
+		names := strings.Split(strings.TrimPrefix(name, envPrefix), "_")
+		if len(names) < 2 {
+			return nil, fmt.Errorf("unknown configuration key in environment variable %s", name)
+		}
+
+		subsection := strings.ToLower(strings.Join(names[1:len(names)-1], "_"))
+		key, ok := lookupConfigKey(names[0], subsection, names[len(names)-1])
+		if !ok {
+			return nil, fmt.Errorf("unknown configuration key in environment variable %s", name)
+		}
+
+		if !key.multiValued {
+			result = append(result, configOverride{configKey: key, value: value})
+			continue
+		}
+
+		// The environment replaces the list from the file instead of adding to it
+		result = append(result, configOverride{configKey: key, blank: true})
+		if value == "" {
+			continue
+		}
+
+		for _, v := range strings.Split(value, ",") {
+			result = append(result, configOverride{configKey: key, value: strings.TrimSpace(v)})
+		}
+	}
+
+	return result, nil
+}
+
+// parseFlagOverrides returns the overrides in "section.key=value" or "section.subsection.key=value" entries. Multi-valued keys can be given more than once.
+func parseFlagOverrides(overrides []string) ([]configOverride, error) {
+	var result []configOverride
+	seen := map[configKey]bool{}
+
+	for _, entry := range overrides {
+		parts := strings.SplitN(entry, "=", 2)
+		name := parts[0]
+
+		first := strings.Index(name, ".")
+		last := strings.LastIndex(name, ".")
+		if first < 0 {
+			return nil, fmt.Errorf("unknown configuration key %s", name)
+		}
+
+		subsection := ""
+		if first != last {
+			subsection = name[first+1 : last]
+		}
+
+		key, ok := lookupConfigKey(name[:first], subsection, name[last+1:])
+		if !ok {
+			return nil, fmt.Errorf("unknown configuration key %s", name)
+		}
+
+		// The first value of a multi-valued key replaces the list from the file and environment, and later ones are added to it
+		if key.multiValued && !seen[key] {
+			seen[key] = true
+			result = append(result, configOverride{configKey: key, blank: true})
+		}
+
+		if len(parts) == 1 {
+			if !key.multiValued {
+				result = append(result, configOverride{configKey: key, blank: true})
+			}
+			continue
+		}
+
+		result = append(result, configOverride{configKey: key, value: parts[1]})
+	}
+
+	return result, nil
+}
+
+// lookupConfigKey finds the config key with the given names, ignoring case for section and key names like config files do.
+func lookupConfigKey(section, subsection, key string) (configKey, bool) {
+	configType := reflect.TypeOf(Configuration{})
+
+	for i := 0; i < configType.NumField(); i++ {
+		sectionField := configType.Field(i)
+		if sectionField.PkgPath != "" || !strings.EqualFold(sectionField.Name, section) {
+			continue
+		}
+
+		sectionType := sectionField.Type
+		if sectionType.Kind() == reflect.Map {
+			sectionType = sectionType.Elem().Elem()
+		} else if subsection != "" {
+			return configKey{}, false
+		}
+
+		for j := 0; j < sectionType.NumField(); j++ {
+			keyField := sectionType.Field(j)
+			if !strings.EqualFold(keyField.Name, key) {
+				continue
+			}
+
+			return configKey{
+				section:     sectionField.Name,
+				subsection:  subsection,
+				key:         keyField.Name,
+				multiValued: keyField.Type.Kind() == reflect.Slice,
+			}, true
+		}
+	}
+
+	return configKey{}, false
+}
+
+// applyConfigOverrides sets every override in c, in order, parsing values the same way as the config file.
+func applyConfigOverrides(c *Configuration, overrides []configOverride) error {
+	for _, o := range overrides {
+		err := gcfg.ReadStringInto(c, o.String())
+		if err != nil {
+			return fmt.Errorf("invalid value for configuration key %s: %s", o.name(), err)
+		}
+	}
+
+	return nil
+}
+
+// name returns the key in the same format used by command-line overrides.
+func (k configKey) name() string {
+	if k.subsection == "" {
+		return k.section + "." + k.key
+	}
+
+	return k.section + "." + k.subsection + "." + k.key
+}
+
+// String returns the override as a config file snippet.
+func (o configOverride) String() string {
+	header := "[" + o.section + "]"
+	if o.subsection != "" {
+		header = fmt.Sprintf("[%s %s]", o.section, quoteConfigValue(o.subsection))
+	}
+
+	if o.blank {
+		return header + "\n" + o.key + "\n"
+	}
+
+	return header + "\n" + o.key + " = " + quoteConfigValue(o.value) + "\n"
+}
+
+// quoteConfigValue quotes s so it's read back exactly as it is from a config file.
+func quoteConfigValue(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`)
+	return `"` + r.Replace(s) + `"`
+}
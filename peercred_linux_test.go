@@ -0,0 +1,60 @@
+package incognitomail_test
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+// socketPair returns both ends of a connected pair of unix sockets.
+func socketPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conns[i] = conn.(*net.UnixConn)
+	}
+
+	return conns[0], conns[1]
+}
+
+// Ensure the credentials of the process on the other side of a socket are found, and that they are the ones checked against the allowed users.
+func TestPeerCredentials(t *testing.T) {
+	t.Parallel()
+
+	a, b := socketPair(t)
+	defer a.Close()
+	defer b.Close()
+
+	uid, gid, err := incognitomail.PeerCredentials(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uid != uint32(os.Getuid()) || gid != uint32(os.Getgid()) {
+		t.Errorf("expected uid %d and gid %d, got %d and %d", os.Getuid(), os.Getgid(), uid, gid)
+	}
+
+	l, err := incognitomail.NewRPCListener(incognitomail.RPCConfig{SocketMode: "0600", AllowedUser: []string{"54321"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !l.Allowed(uid, gid) {
+		t.Error("expected the user running the server to be allowed")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package incognitomail
+
+import "net"
+
+// peerCredentials always fails, since SO_PEERCRED is only available in linux.
+func peerCredentials(conn *net.UnixConn) (uint32, uint32, error) {
+	return 0, 0, ErrPeerCredentialsUnavailable
+}
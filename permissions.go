@@ -0,0 +1,223 @@
+package incognitomail
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+const (
+	permissionAllow = "allow"
+	permissionDeny  = "deny"
+
+	// Names of the command sources used in the permission matrix.
+	sourceWebsocket = "websocket"
+	sourceRPC       = "rpc"
+	sourceHTTP      = "http"
+
+	// Names of the commands used in the permission matrix. They match the keys in the config file.
+	permissionNewAccount    = "NewAccount"
+	permissionNewHandle     = "NewHandle"
+	permissionDeleteHandle  = "DeleteHandle"
+	permissionDeleteAccount = "DeleteAccount"
+	permissionListHandles   = "ListHandles"
+	permissionConfirmTarget = "ConfirmTarget"
+	permissionNewInvite     = "NewInvite"
+	permissionDeleteInvite  = "DeleteInvite"
+	permissionListInvites   = "ListInvites"
+	permissionAuditLog      = "AuditLog"
+
+	// Separates the account ID from the source in the names of the AccountPermissions sections.
+	accountPermissionSeparator = ":"
+)
+
+var (
+	// defaultPermissions is used for every command that isn't allowed or denied in the config. Sources not listed here can't execute anything unless allowed in the config.
+	defaultPermissions = map[string]PermissionConfig{
+		sourceWebsocket: {
+			NewAccount:    permissionAllow, // Still subject to the signup policy
+			NewHandle:     permissionAllow,
+			DeleteHandle:  permissionDeny,
+			DeleteAccount: permissionDeny,
+			ListHandles:   permissionDeny,
+			ConfirmTarget: permissionAllow,
+			NewInvite:     permissionDeny,
+			DeleteInvite:  permissionDeny,
+			ListInvites:   permissionDeny,
+			AuditLog:      permissionDeny,
+		},
+		sourceHTTP: {
+			NewAccount:    permissionAllow, // Still subject to the signup policy
+			NewHandle:     permissionAllow,
+			DeleteHandle:  permissionAllow, // Handles can only be deleted by their own account
+			DeleteAccount: permissionDeny,
+			ListHandles:   permissionAllow,
+			ConfirmTarget: permissionAllow,
+			NewInvite:     permissionDeny,
+			DeleteInvite:  permissionDeny,
+			ListInvites:   permissionDeny,
+			AuditLog:      permissionDeny,
+		},
+		sourceRPC: {
+			NewAccount:    permissionAllow,
+			NewHandle:     permissionAllow,
+			DeleteHandle:  permissionAllow,
+			DeleteAccount: permissionAllow,
+			ListHandles:   permissionAllow,
+			ConfirmTarget: permissionAllow,
+			NewInvite:     permissionAllow,
+			DeleteInvite:  permissionAllow,
+			ListInvites:   permissionAllow,
+			AuditLog:      permissionAllow,
+		},
+	}
+)
+
+// get returns "allow" or "deny" if the given command is set in the permissions, or an empty string otherwise.
+func (p *PermissionConfig) get(command string) string {
+	switch command {
+	case permissionNewAccount:
+		return p.NewAccount
+	case permissionNewHandle:
+		return p.NewHandle
+	case permissionDeleteHandle:
+		return p.DeleteHandle
+	case permissionDeleteAccount:
+		return p.DeleteAccount
+	case permissionListHandles:
+		return p.ListHandles
+	case permissionConfirmTarget:
+		return p.ConfirmTarget
+	case permissionNewInvite:
+		return p.NewInvite
+	case permissionDeleteInvite:
+		return p.DeleteInvite
+	case permissionListInvites:
+		return p.ListInvites
+	case permissionAuditLog:
+		return p.AuditLog
+	}
+
+	return ""
+}
+
+// check records every command in the permissions that isn't either unset, "allow" or "deny". section is the name of the section holding the permissions.
+func (p *PermissionConfig) check(problems *configProblems, section string) {
+	for _, command := range []string{permissionNewAccount, permissionNewHandle, permissionDeleteHandle, permissionDeleteAccount, permissionListHandles, permissionConfirmTarget, permissionNewInvite, permissionDeleteInvite, permissionListInvites, permissionAuditLog} {
+		v := p.get(command)
+		if v != "" && v != permissionAllow && v != permissionDeny {
+			problems.add(section+"."+command, "%q must be %q or %q", v, permissionAllow, permissionDeny)
+		}
+	}
+}
+
+// splitPermissionsName splits the name of a Permissions section into the source and the network it applies to. The network is nil if the section applies to the source regardless of the remote address.
+func splitPermissionsName(name string) (string, *net.IPNet, error) {
+	fields := strings.Fields(name)
+
+	switch len(fields) {
+	case 1:
+		return fields[0], nil, nil
+	case 2:
+		_, network, err := net.ParseCIDR(fields[1])
+		if err != nil {
+			return "", nil, err
+		}
+
+		return fields[0], network, nil
+	}
+
+	return "", nil, ErrInvalidConfig
+}
+
+// checkPermissionsConfig records every Permissions and AccountPermissions section with an invalid name or values.
+func checkPermissionsConfig(c *Configuration, problems *configProblems) {
+	for _, name := range sortedKeys(c.Permissions) {
+		section := fmt.Sprintf("Permissions %q", name)
+
+		_, _, err := splitPermissionsName(name)
+		if err != nil {
+			problems.add(section, "must be a source, optionally followed by a network in CIDR notation")
+		}
+
+		c.Permissions[name].check(problems, section)
+	}
+
+	for _, name := range sortedKeys(c.AccountPermissions) {
+		section := fmt.Sprintf("AccountPermissions %q", name)
+
+		parts := strings.Split(name, accountPermissionSeparator)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			problems.add(section, "must be an account ID and a source separated by %q", accountPermissionSeparator)
+		}
+
+		c.AccountPermissions[name].check(problems, section)
+	}
+}
+
+// sortedKeys returns the names of all subsections in a section, sorted so they are always reported in the same order.
+func sortedKeys(sections map[string]*PermissionConfig) []string {
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// remoteIP returns the IP from a remote address, which may or may not include a port. Returns nil if there's no IP in the address, which is the case for unix sockets.
+func remoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// allowed returns true if the command can be executed when received from the given source and remote address, for the account with the given secret. The secret may be empty for commands that don't act on an account.
+// The most specific setting wins: account overrides, then the Permissions section for the source with the longest network containing the remote address, then the section for the source alone, and finally the defaults.
+func (c *Configuration) allowed(source, remoteAddr, secret, command string) bool {
+	if secret != "" {
+		p, ok := c.AccountPermissions[AccountID(secret)+accountPermissionSeparator+source]
+		if ok && p.get(command) != "" {
+			return p.get(command) == permissionAllow
+		}
+	}
+
+	ip := remoteIP(remoteAddr)
+	decision := ""
+	longestPrefix := -1
+
+	for name, p := range c.Permissions {
+		s, network, err := splitPermissionsName(name)
+		if err != nil || s != source || p.get(command) == "" {
+			continue
+		}
+
+		prefix := 0
+		if network != nil {
+			if ip == nil || !network.Contains(ip) {
+				continue
+			}
+
+			prefix, _ = network.Mask.Size()
+			// Any network is more specific than a section without a network, even 0.0.0.0/0
+			prefix++
+		}
+
+		if prefix > longestPrefix {
+			longestPrefix = prefix
+			decision = p.get(command)
+		}
+	}
+
+	if decision != "" {
+		return decision == permissionAllow
+	}
+
+	p, ok := defaultPermissions[source]
+	return ok && p.get(command) == permissionAllow
+}
@@ -1,7 +1,10 @@
 package incognitomail
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -13,9 +16,18 @@ type IncognitoData struct {
 }
 
 const (
-	targetsBucketName  = "targets"
-	accountsBucketName = "accounts"
-	handlesBucketName  = "handles"
+	targetsBucketName       = "targets"
+	accountsBucketName      = "accounts"
+	handlesBucketName       = "handles"
+	handleTargetsBucketName = "handletargets"
+	pendingBucketName       = "pending"
+	invitesBucketName       = "invites"
+
+	// Targets are stored joined by this separator, which is never allowed inside a target.
+	targetSeparator = ","
+
+	// Pending targets are keyed by the account secret and the target joined by this separator, so all pending targets of an account share the same prefix.
+	pendingKeySeparator = "\x00"
 )
 
 var (
@@ -36,11 +48,23 @@ var (
 
 	// ErrHandleExists is used when trying to create a handle, but it already exists.
 	ErrHandleExists = errors.New("handle already exists")
+
+	// ErrTokenNotFound is used when confirming a target with a token that doesn't belong to any of the account's pending targets.
+	ErrTokenNotFound = errors.New("confirmation token not found")
+
+	// ErrEmptyInvite is used when an empty invite code is used.
+	ErrEmptyInvite = errors.New("empty invite code")
+
+	// ErrInviteNotFound is used when an action requires an invite code to exist, but it wasn't found.
+	ErrInviteNotFound = errors.New("invite code not found")
+
+	// ErrInviteExists is used when trying to create an invite code, but it already exists.
+	ErrInviteExists = errors.New("invite code already exists")
 )
 
-// OpenIncognitoData returns an IncognitoData object with a successful "connection" to the persistence layer, ready to be used.
-func OpenIncognitoData() (*IncognitoData, error) {
-	db, err := bolt.Open(Config.Persistence.DatabasePath, 0600, nil)
+// OpenIncognitoData returns an IncognitoData object with a successful "connection" to the database in the given path, ready to be used.
+func OpenIncognitoData(path string) (*IncognitoData, error) {
+	db, err := bolt.Open(path, 0600, nil)
 
 	if err != nil {
 		return nil, err
@@ -63,6 +87,21 @@ func OpenIncognitoData() (*IncognitoData, error) {
 			return err
 		}
 
+		_, err = tx.CreateBucketIfNotExists([]byte(handleTargetsBucketName))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte(pendingBucketName))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists([]byte(invitesBucketName))
+		if err != nil {
+			return err
+		}
+
 		return nil
 	})
 
@@ -75,17 +114,40 @@ func OpenIncognitoData() (*IncognitoData, error) {
 	}, nil
 }
 
-// NewAccount generates a new account with the given secret and target email address.
-func (a *IncognitoData) NewAccount(secret, target string) error {
+// joinTargets returns the representation of the targets used for storage. Returns ErrEmptyTarget if there are no targets or if any of them is empty.
+func joinTargets(targets []string) ([]byte, error) {
+	if len(targets) == 0 {
+		return nil, ErrEmptyTarget
+	}
+
+	for _, t := range targets {
+		if t == "" {
+			return nil, ErrEmptyTarget
+		}
+	}
+
+	return []byte(strings.Join(targets, targetSeparator)), nil
+}
+
+// splitTargets returns the targets from their representation used for storage.
+func splitTargets(t []byte) []string {
+	// Note: boltdb only keeps the value of t until the transaction ends, so we must copy it somewhere else now.
+	// However, the call to string(t) internally does that for us, as it will ultimately call copy() to copy the values to a new byte slice for the resulting string.
+	return strings.Split(string(t), targetSeparator)
+}
+
+// NewAccount generates a new account with the given secret and target email addresses.
+func (a *IncognitoData) NewAccount(secret string, targets ...string) error {
 	if secret == "" {
 		return ErrEmptySecret
 	}
 
-	if target == "" {
-		return ErrEmptyTarget
+	target, err := joinTargets(targets)
+	if err != nil {
+		return err
 	}
 
-	err := a.db.Update(func(tx *bolt.Tx) error {
+	err = a.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(secret))
 
 		if b != nil {
@@ -98,7 +160,7 @@ func (a *IncognitoData) NewAccount(secret, target string) error {
 		}
 
 		b = tx.Bucket([]byte(targetsBucketName))
-		err = b.Put([]byte(secret), []byte(target))
+		err = b.Put([]byte(secret), target)
 		if err != nil {
 			return err
 		}
@@ -150,17 +212,113 @@ func (a *IncognitoData) DeleteAccount(secret string) {
 		b = tx.Bucket([]byte(accountsBucketName))
 		b.Delete([]byte(secret))
 
+		deletePendingTargets(tx, secret)
+
+		return nil
+	})
+}
+
+// pendingKeyPrefix returns the prefix shared by the keys of all pending targets from the account with the given secret.
+func pendingKeyPrefix(secret string) []byte {
+	return []byte(secret + pendingKeySeparator)
+}
+
+// deletePendingTargets deletes all pending targets from the account with the given secret.
+func deletePendingTargets(tx *bolt.Tx, secret string) {
+	prefix := pendingKeyPrefix(secret)
+	var keys [][]byte
+
+	// Deleting while iterating with a cursor is not supported by boltdb, so collect the keys first
+	c := tx.Bucket([]byte(pendingBucketName)).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), k...))
+	}
+
+	for _, k := range keys {
+		tx.Bucket([]byte(pendingBucketName)).Delete(k)
+	}
+}
+
+// AddPendingTarget marks the given target of the account with the given secret as waiting for confirmation with the given token.
+func (a *IncognitoData) AddPendingTarget(secret, target, token string) error {
+	if secret == "" {
+		return ErrEmptySecret
+	}
+
+	if target == "" {
+		return ErrEmptyTarget
+	}
+
+	return a.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(accountsBucketName)).Get([]byte(secret)) == nil {
+			return ErrAccountNotFound
+		}
+
+		b := tx.Bucket([]byte(pendingBucketName))
+		return b.Put(append(pendingKeyPrefix(secret), target...), []byte(token))
+	})
+}
+
+// ConfirmPendingTarget confirms the pending target of the account with the given secret that is waiting for the given token. If no pending target is waiting for the token, it returns ErrTokenNotFound.
+func (a *IncognitoData) ConfirmPendingTarget(secret, token string) error {
+	if secret == "" {
+		return ErrEmptySecret
+	}
+
+	if token == "" {
+		return ErrTokenNotFound
+	}
+
+	return a.db.Update(func(tx *bolt.Tx) error {
+		prefix := pendingKeyPrefix(secret)
+		b := tx.Bucket([]byte(pendingBucketName))
+
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if subtle.ConstantTimeCompare(v, []byte(token)) == 1 {
+				return b.Delete(append([]byte(nil), k...))
+			}
+		}
+
+		return ErrTokenNotFound
+	})
+}
+
+// HasPendingTargets returns true if any target from the account with the given secret is still waiting for confirmation, false otherwise.
+func (a *IncognitoData) HasPendingTargets(secret string) bool {
+	if secret == "" {
+		return false
+	}
+
+	pending := false
+	prefix := pendingKeyPrefix(secret)
+
+	a.db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket([]byte(pendingBucketName)).Cursor().Seek(prefix)
+		pending = k != nil && bytes.HasPrefix(k, prefix)
 		return nil
 	})
+
+	return pending
 }
 
-// NewAccountHandle stores the given handle for the account with the given secret.
-func (a *IncognitoData) NewAccountHandle(secret, handle string) error {
+// NewAccountHandle stores the given handle for the account with the given secret. If any targets are given, they override the account targets for this handle only.
+func (a *IncognitoData) NewAccountHandle(secret, handle string, targets ...string) error {
 	if secret == "" {
 		return ErrEmptySecret
 	}
 
-	err := a.db.Update(func(tx *bolt.Tx) error {
+	var target []byte
+	var err error
+
+	if len(targets) > 0 {
+		target, err = joinTargets(targets)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = a.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(secret))
 		if b == nil {
 			return ErrAccountNotFound
@@ -187,6 +345,14 @@ func (a *IncognitoData) NewAccountHandle(secret, handle string) error {
 			return err
 		}
 
+		if target != nil {
+			tb := tx.Bucket([]byte(handleTargetsBucketName))
+			err = tb.Put([]byte(handle), target)
+			if err != nil {
+				return err
+			}
+		}
+
 		return nil
 	})
 
@@ -212,20 +378,22 @@ func (a *IncognitoData) DeleteAccountHandle(secret, handle string) {
 
 		// Also delete from the global handles name
 		hb := tx.Bucket([]byte(handlesBucketName))
+		tb := tx.Bucket([]byte(handleTargetsBucketName))
 
 		b.Delete([]byte(handle))
 		hb.Delete([]byte(handle))
+		tb.Delete([]byte(handle))
 		return nil
 	})
 }
 
-// GetAccountTarget returns the target registered for the account with the given secret.
-func (a *IncognitoData) GetAccountTarget(secret string) (string, error) {
+// GetAccountTargets returns the targets registered for the account with the given secret.
+func (a *IncognitoData) GetAccountTargets(secret string) ([]string, error) {
 	if secret == "" {
-		return "", ErrEmptySecret
+		return nil, ErrEmptySecret
 	}
 
-	var target string
+	var targets []string
 
 	err := a.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(targetsBucketName))
@@ -234,17 +402,45 @@ func (a *IncognitoData) GetAccountTarget(secret string) (string, error) {
 			return ErrAccountNotFound
 		}
 
-		// Note: boltdb only keeps the value of t until the transaction ends, so we must copy it somewhere else now.
-		// However, the call to string(t) internally does that for us, as it will ultimately call copy() to copy the values to a new byte slice for the resulting string.
-		target = string(t)
+		targets = splitTargets(t)
 		return nil
 	})
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return target, nil
+	return targets, nil
+}
+
+// GetHandleTargets returns the targets that override the account targets for the given handle. If the handle uses the account targets, it returns nil.
+func (a *IncognitoData) GetHandleTargets(handle string) ([]string, error) {
+	if handle == "" {
+		return nil, ErrHandleNotFound
+	}
+
+	var targets []string
+
+	err := a.db.View(func(tx *bolt.Tx) error {
+		hb := tx.Bucket([]byte(handlesBucketName))
+		if hb.Get([]byte(handle)) == nil {
+			return ErrHandleNotFound
+		}
+
+		tb := tx.Bucket([]byte(handleTargetsBucketName))
+		t := tb.Get([]byte(handle))
+		if t != nil {
+			targets = splitTargets(t)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return targets, nil
 }
 
 // HasAccount returns true if an account with the given secret exists, false otherwise.
@@ -285,6 +481,28 @@ func (a *IncognitoData) HasHandleGlobal(handle string) bool {
 	return err == nil
 }
 
+// HasAccountHandle returns true if the given handle belongs to the account with the given secret, false otherwise.
+func (a *IncognitoData) HasAccountHandle(secret, handle string) bool {
+	if secret == "" || handle == "" {
+		return false
+	}
+
+	err := a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(secret))
+		if b == nil {
+			return ErrAccountNotFound
+		}
+
+		if b.Get([]byte(handle)) == nil {
+			return ErrHandleNotFound
+		}
+
+		return nil
+	})
+
+	return err == nil
+}
+
 // ListAccountHandles returns an array with all handles from the account with the given secret.
 func (a *IncognitoData) ListAccountHandles(secret string) ([]string, error) {
 	if secret == "" {
@@ -313,6 +531,106 @@ func (a *IncognitoData) ListAccountHandles(secret string) ([]string, error) {
 	return result, nil
 }
 
+// NewInvite stores the given invite code, which can later be used once to create an account.
+func (a *IncognitoData) NewInvite(code string) error {
+	if code == "" {
+		return ErrEmptyInvite
+	}
+
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(invitesBucketName))
+		if b.Get([]byte(code)) != nil {
+			return ErrInviteExists
+		}
+
+		now, err := time.Now().GobEncode()
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(code), now)
+	})
+}
+
+// HasInvite returns true if the given invite code exists, false otherwise.
+func (a *IncognitoData) HasInvite(code string) bool {
+	if code == "" {
+		return false
+	}
+
+	err := a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(invitesBucketName))
+		if b.Get([]byte(code)) == nil {
+			return ErrInviteNotFound
+		}
+
+		return nil
+	})
+
+	return err == nil
+}
+
+// DeleteInvite deletes the given invite code. If the invite code does not exist, it returns ErrInviteNotFound.
+func (a *IncognitoData) DeleteInvite(code string) error {
+	if code == "" {
+		return ErrEmptyInvite
+	}
+
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(invitesBucketName))
+		if b.Get([]byte(code)) == nil {
+			return ErrInviteNotFound
+		}
+
+		return b.Delete([]byte(code))
+	})
+}
+
+// ListInvites returns an array with all invite codes that haven't been used yet.
+func (a *IncognitoData) ListInvites() ([]string, error) {
+	var result []string
+
+	err := a.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(invitesBucketName))
+
+		return b.ForEach(func(k, v []byte) error {
+			// Note: boltdb only keeps the values of k and v until the transaction ends, so we must copy these values somewhere else now.
+			// However, the call to string(k) internally does that for us, as it will ultimately call copy() to copy the values to a new byte slice for the resulting string.
+			result = append(result, string(k))
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Ping checks if the database answers a read transaction.
+func (a *IncognitoData) Ping() error {
+	return a.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(accountsBucketName)) == nil {
+			return bolt.ErrBucketNotFound
+		}
+
+		return nil
+	})
+}
+
+// Size returns the size of the database in bytes.
+func (a *IncognitoData) Size() (int64, error) {
+	var size int64
+
+	err := a.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+
+	return size, err
+}
+
 // Close closes the "connection" with the persistence layer.
 func (a *IncognitoData) Close() {
 	a.db.Close()
@@ -29,46 +29,48 @@ func handleInsideList(s string, slice []string) bool {
 	return false
 }
 
-// newDBFileName creates a new temporary file to force a brand new DB.
-func newDBFileName(t *testing.T) {
+// newDBFileName creates a new temporary file to force a brand new DB, returning its path.
+func newDBFileName(t *testing.T) string {
 	f, err := ioutil.TempFile("", "incognitomail_test_")
 	if err != nil {
 		t.Log("could not create temporary file")
 		t.Fatal(err)
 	}
 
-	incognitomail.Config.Persistence.DatabasePath = f.Name()
 	f.Close()
+	return f.Name()
 }
 
 // removeCurrDB removes the temporary file created with newDBFileName().
-func removeCurrDB(t *testing.T) {
-	err := os.Remove(incognitomail.Config.Persistence.DatabasePath)
+func removeCurrDB(t *testing.T, path string) {
+	err := os.Remove(path)
 	if err != nil {
 		t.Log("could not remove temporary file used for database")
 	}
 }
 
-// commonSetup should be called at the beginning of each test to ensure a clean DB.
-func commonSetup(t *testing.T) *incognitomail.IncognitoData {
-	newDBFileName(t)
-	data, err := incognitomail.OpenIncognitoData()
+// commonSetup should be called at the beginning of each test to ensure a clean DB. Returns the path of the DB, so every test removes its own.
+func commonSetup(t *testing.T) (*incognitomail.IncognitoData, string) {
+	path := newDBFileName(t)
+	data, err := incognitomail.OpenIncognitoData(path)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	return data
+	return data, path
 }
 
 // commonTeardown should be called at the end of each test to clean up the generated DB.
-func commonTeardown(t *testing.T, data *incognitomail.IncognitoData) {
+func commonTeardown(t *testing.T, data *incognitomail.IncognitoData, path string) {
 	data.Close()
-	removeCurrDB(t)
+	removeCurrDB(t, path)
 }
 
 // Ensure a new account can be created without errors.
 func TestPersistence_NewAccount(t *testing.T) {
-	data := commonSetup(t)
+	t.Parallel()
+
+	data, path := commonSetup(t)
 
 	err := data.NewAccount(accountSecret1, accountTarget1)
 	if err != nil {
@@ -80,12 +82,14 @@ func TestPersistence_NewAccount(t *testing.T) {
 		t.Fatal("account created is not present")
 	}
 
-	commonTeardown(t, data)
+	commonTeardown(t, data, path)
 }
 
 // Ensure a new account needs a non-empty secret.
 func TestPersistence_NewAccount_SecretRequired(t *testing.T) {
-	data := commonSetup(t)
+	t.Parallel()
+
+	data, path := commonSetup(t)
 
 	err := data.NewAccount("", accountTarget1)
 	if err == nil {
@@ -96,12 +100,14 @@ func TestPersistence_NewAccount_SecretRequired(t *testing.T) {
 		t.Fatal("expected ErrEmptySecret")
 	}
 
-	commonTeardown(t, data)
+	commonTeardown(t, data, path)
 }
 
 // Ensure a new account needs a non-empty target.
 func TestPersistence_NewAccount_TargetRequired(t *testing.T) {
-	data := commonSetup(t)
+	t.Parallel()
+
+	data, path := commonSetup(t)
 
 	err := data.NewAccount(accountSecret1, "")
 	if err == nil {
@@ -112,33 +118,74 @@ func TestPersistence_NewAccount_TargetRequired(t *testing.T) {
 		t.Fatal("expected ErrEmptyTarget")
 	}
 
-	commonTeardown(t, data)
+	commonTeardown(t, data, path)
 }
 
 // Ensure an account's target is successfully retrieved after creating.
 func TestPersistence_CheckTarget(t *testing.T) {
-	data := commonSetup(t)
+	t.Parallel()
+
+	data, path := commonSetup(t)
 
 	err := data.NewAccount(accountSecret1, accountTarget1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	target, err := data.GetAccountTarget(accountSecret1)
+	targets, err := data.GetAccountTargets(accountSecret1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if target != accountTarget1 {
+	if len(targets) != 1 || targets[0] != accountTarget1 {
 		t.Fatal("retrieved account target is not the same as inserted")
 	}
 
-	commonTeardown(t, data)
+	commonTeardown(t, data, path)
+}
+
+// Ensure all of an account's targets are successfully retrieved after creating.
+func TestPersistence_CheckMultipleTargets(t *testing.T) {
+	t.Parallel()
+
+	data, path := commonSetup(t)
+
+	err := data.NewAccount(accountSecret1, accountTarget1, accountTarget2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets, err := data.GetAccountTargets(accountSecret1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(targets) != 2 || targets[0] != accountTarget1 || targets[1] != accountTarget2 {
+		t.Fatal("retrieved account targets are not the same as inserted")
+	}
+
+	commonTeardown(t, data, path)
+}
+
+// Ensure a new account can't have any empty target.
+func TestPersistence_NewAccount_EmptyTargetInList(t *testing.T) {
+	t.Parallel()
+
+	data, path := commonSetup(t)
+
+	err := data.NewAccount(accountSecret1, accountTarget1, "")
+	if err != incognitomail.ErrEmptyTarget {
+		t.Fatal("expected ErrEmptyTarget")
+	}
+
+	commonTeardown(t, data, path)
 }
 
 // Ensure deleting an account actually deletes its secret from the DB.
 func TestPersistence_DeleteAccount(t *testing.T) {
-	data := commonSetup(t)
+	t.Parallel()
+
+	data, path := commonSetup(t)
 
 	err := data.NewAccount(accountSecret1, accountTarget1)
 	if err != nil {
@@ -152,12 +199,14 @@ func TestPersistence_DeleteAccount(t *testing.T) {
 		t.Fatal("deleted account is still present")
 	}
 
-	commonTeardown(t, data)
+	commonTeardown(t, data, path)
 }
 
 // Ensure a new handle can be created without errors.
 func TestPersistence_NewHandle(t *testing.T) {
-	data := commonSetup(t)
+	t.Parallel()
+
+	data, path := commonSetup(t)
 
 	err := data.NewAccount(accountSecret1, accountTarget1)
 	if err != nil {
@@ -169,12 +218,63 @@ func TestPersistence_NewHandle(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	commonTeardown(t, data)
+	commonTeardown(t, data, path)
+}
+
+// Ensure a handle without targets uses the account targets, and one with targets overrides them.
+func TestPersistence_HandleTargets(t *testing.T) {
+	t.Parallel()
+
+	data, path := commonSetup(t)
+
+	err := data.NewAccount(accountSecret1, accountTarget1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.NewAccountHandle(accountSecret1, accountHandle1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.NewAccountHandle(accountSecret1, accountHandle2, accountTarget1, accountTarget2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets, err := data.GetHandleTargets(accountHandle1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if targets != nil {
+		t.Fatal("handle without targets has override ", targets)
+	}
+
+	targets, err = data.GetHandleTargets(accountHandle2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(targets) != 2 || targets[0] != accountTarget1 || targets[1] != accountTarget2 {
+		t.Fatal("retrieved handle targets are not the same as inserted")
+	}
+
+	data.DeleteAccountHandle(accountSecret1, accountHandle2)
+
+	_, err = data.GetHandleTargets(accountHandle2)
+	if err != incognitomail.ErrHandleNotFound {
+		t.Fatal("expected ErrHandleNotFound")
+	}
+
+	commonTeardown(t, data, path)
 }
 
 // Ensure a repeated handle can't be created (same account).
 func TestPersistence_RepeatedHandle_SameAccount(t *testing.T) {
-	data := commonSetup(t)
+	t.Parallel()
+
+	data, path := commonSetup(t)
 
 	err := data.NewAccount(accountSecret1, accountTarget1)
 	if err != nil {
@@ -195,12 +295,14 @@ func TestPersistence_RepeatedHandle_SameAccount(t *testing.T) {
 		t.Fatal("expected ErrHandleExists")
 	}
 
-	commonTeardown(t, data)
+	commonTeardown(t, data, path)
 }
 
 // Ensure a repeated handle can't be created (different accounts).
 func TestPersistence_RepeatedHandle_DifferentAccounts(t *testing.T) {
-	data := commonSetup(t)
+	t.Parallel()
+
+	data, path := commonSetup(t)
 
 	err := data.NewAccount(accountSecret1, accountTarget1)
 	if err != nil {
@@ -226,12 +328,14 @@ func TestPersistence_RepeatedHandle_DifferentAccounts(t *testing.T) {
 		t.Fatal("expected ErrHandleExists")
 	}
 
-	commonTeardown(t, data)
+	commonTeardown(t, data, path)
 }
 
 // Ensure an account's handles are listed successfully.
 func TestPersistence_ListHandles(t *testing.T) {
-	data := commonSetup(t)
+	t.Parallel()
+
+	data, path := commonSetup(t)
 
 	err := data.NewAccount(accountSecret1, accountTarget1)
 	if err != nil {
@@ -265,12 +369,14 @@ func TestPersistence_ListHandles(t *testing.T) {
 		t.Fatal("list of handles does not contain ", accountHandle2)
 	}
 
-	commonTeardown(t, data)
+	commonTeardown(t, data, path)
 }
 
 // Ensure an account's handles make it into the global handle list.
 func TestPersistence_CheckHandlesGlobal(t *testing.T) {
-	data := commonSetup(t)
+	t.Parallel()
+
+	data, path := commonSetup(t)
 
 	err := data.NewAccount(accountSecret1, accountTarget1)
 	if err != nil {
@@ -288,12 +394,50 @@ func TestPersistence_CheckHandlesGlobal(t *testing.T) {
 		t.Fatal("global handle check did not identify inserted handle")
 	}
 
-	commonTeardown(t, data)
+	commonTeardown(t, data, path)
+}
+
+// Ensure a handle only belongs to the account that created it.
+func TestPersistence_HasAccountHandle(t *testing.T) {
+	t.Parallel()
+
+	data, path := commonSetup(t)
+
+	err := data.NewAccount(accountSecret1, accountTarget1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.NewAccount(accountSecret2, accountTarget2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.NewAccountHandle(accountSecret1, accountHandle1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !data.HasAccountHandle(accountSecret1, accountHandle1) {
+		t.Error("handle not found in the account that created it")
+	}
+
+	if data.HasAccountHandle(accountSecret2, accountHandle1) {
+		t.Error("handle found in another account")
+	}
+
+	if data.HasAccountHandle(accountSecret1, neverUsedHandle) {
+		t.Error("handle that was never created found in the account")
+	}
+
+	commonTeardown(t, data, path)
 }
 
 // Ensure a deleted handle is removed from the account's handle list and the global handle list.
 func TestPersistence_DeleteHandle(t *testing.T) {
-	data := commonSetup(t)
+	t.Parallel()
+
+	data, path := commonSetup(t)
 
 	err := data.NewAccount(accountSecret1, accountTarget1)
 	if err != nil {
@@ -322,12 +466,14 @@ func TestPersistence_DeleteHandle(t *testing.T) {
 		t.Fatal("global handle check still identifies deleted handle ", accountHandle1)
 	}
 
-	commonTeardown(t, data)
+	commonTeardown(t, data, path)
 }
 
 // Ensure a deleted account also deletes the handles from the global list.
 func TestPersistence_DeleteAccount_GlobalHandles(t *testing.T) {
-	data := commonSetup(t)
+	t.Parallel()
+
+	data, path := commonSetup(t)
 
 	err := data.NewAccount(accountSecret1, accountTarget1)
 	if err != nil {
@@ -347,5 +493,167 @@ func TestPersistence_DeleteAccount_GlobalHandles(t *testing.T) {
 		t.Fatal("global handle check still identifies deleted account's handle ", accountHandle1)
 	}
 
-	commonTeardown(t, data)
+	commonTeardown(t, data, path)
+}
+
+// Ensure an account stays pending until every target is confirmed with its own token.
+func TestPersistence_PendingTargets(t *testing.T) {
+	t.Parallel()
+
+	data, path := commonSetup(t)
+
+	err := data.NewAccount(accountSecret1, accountTarget1, accountTarget2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.AddPendingTarget(accountSecret1, accountTarget1, "token1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.AddPendingTarget(accountSecret1, accountTarget2, "token2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !data.HasPendingTargets(accountSecret1) {
+		t.Fatal("account with pending targets is not pending")
+	}
+
+	err = data.ConfirmPendingTarget(accountSecret1, "wrongtoken")
+	if err != incognitomail.ErrTokenNotFound {
+		t.Fatal("expected ErrTokenNotFound")
+	}
+
+	err = data.ConfirmPendingTarget(accountSecret1, "token1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !data.HasPendingTargets(accountSecret1) {
+		t.Fatal("account with one pending target is not pending")
+	}
+
+	err = data.ConfirmPendingTarget(accountSecret1, "token2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data.HasPendingTargets(accountSecret1) {
+		t.Fatal("account with all targets confirmed is still pending")
+	}
+
+	commonTeardown(t, data, path)
+}
+
+// Ensure pending targets from an account can't be confirmed with tokens from another account.
+func TestPersistence_PendingTargets_OtherAccount(t *testing.T) {
+	t.Parallel()
+
+	data, path := commonSetup(t)
+
+	err := data.NewAccount(accountSecret1, accountTarget1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.NewAccount(accountSecret2, accountTarget2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.AddPendingTarget(accountSecret1, accountTarget1, "token1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.ConfirmPendingTarget(accountSecret2, "token1")
+	if err != incognitomail.ErrTokenNotFound {
+		t.Fatal("expected ErrTokenNotFound")
+	}
+
+	data.DeleteAccount(accountSecret1)
+
+	if data.HasPendingTargets(accountSecret1) {
+		t.Fatal("deleted account still has pending targets")
+	}
+
+	commonTeardown(t, data, path)
+}
+
+// Ensure invite codes can be created, listed and deleted.
+func TestPersistence_Invites(t *testing.T) {
+	t.Parallel()
+
+	data, path := commonSetup(t)
+
+	err := data.NewInvite("invite1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = data.NewInvite("invite1")
+	if err != incognitomail.ErrInviteExists {
+		t.Fatal("expected ErrInviteExists")
+	}
+
+	if !data.HasInvite("invite1") {
+		t.Fatal("invite created is not present")
+	}
+
+	invites, err := data.ListInvites()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(invites) != 1 || invites[0] != "invite1" {
+		t.Fatal("list of invites differs from invites inserted")
+	}
+
+	err = data.DeleteInvite("invite1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data.HasInvite("invite1") {
+		t.Fatal("deleted invite is still present")
+	}
+
+	err = data.DeleteInvite("invite1")
+	if err != incognitomail.ErrInviteNotFound {
+		t.Fatal("expected ErrInviteNotFound")
+	}
+
+	commonTeardown(t, data, path)
+}
+
+// Ensure the database size is reported.
+func TestPersistence_Size(t *testing.T) {
+	t.Parallel()
+
+	data, path := commonSetup(t)
+	defer commonTeardown(t, data, path)
+
+	size, err := data.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size <= 0 {
+		t.Errorf("expected a positive size, got %d", size)
+	}
+}
+
+// Ensure an open database answers pings.
+func TestPersistence_Ping(t *testing.T) {
+	t.Parallel()
+
+	data, path := commonSetup(t)
+	defer commonTeardown(t, data, path)
+
+	err := data.Ping()
+	if err != nil {
+		t.Fatal(err)
+	}
 }
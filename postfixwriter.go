@@ -2,43 +2,70 @@ package incognitomail
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 // PostfixWriter holds all the information required to add or remove handles to a postfix system.
 type PostfixWriter struct {
-	mapFilename string
-	domain      string
+	mapFilename  string
+	domain       string
+	postmapPath  string
+	postconfPath string
+
+	// Records how long postmap takes, if not nil
+	postmapDuration *histogramVec
+}
+
+const (
+	// The writer only ever touches lines between these two markers, so the map file can be shared with hand-written entries.
+	blockBeginMarker = "# BEGIN incognitomail"
+	blockEndMarker   = "# END incognitomail"
+)
+
+var (
+	// ErrMalformedMapFile is used when the map file has missing, repeated or out of order block markers.
+	ErrMalformedMapFile = errors.New("malformed incognitomail block in map file")
+)
+
+// mapFileContents holds the lines of a map file split around the block managed by the writer.
+type mapFileContents struct {
+	before []string
+	block  []string
+	after  []string
 }
 
-// NewPostfixWriter returns a PostfixWriter object initialized with values from the config.
-func NewPostfixWriter() *PostfixWriter {
+// NewPostfixWriter returns a PostfixWriter object initialized with values from the [PostfixConfig] section.
+func NewPostfixWriter(c PostfixConfig) *PostfixWriter {
 	return &PostfixWriter{
-		mapFilename: Config.PostfixConfig.MapFilePath,
-		domain:      Config.PostfixConfig.Domain,
+		mapFilename:  c.MapFilePath,
+		domain:       c.Domain,
+		postmapPath:  c.PostmapPath,
+		postconfPath: c.PostconfPath,
 	}
 }
 
-// AddHandle adds a handle to the map file.
-func (p *PostfixWriter) AddHandle(h string, t string) (string, error) {
-	f, err := os.OpenFile(p.mapFilename, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+// AddHandle adds a handle to the managed block of the map file. Multiple targets are written as a comma-separated list of recipients.
+func (p *PostfixWriter) AddHandle(h string, t []string) (string, error) {
+	contents, err := p.readMapFile()
 	if err != nil {
 		return "", err
 	}
-	defer f.Close()
 
 	fullHandle := fmt.Sprintf("%s%s", h, p.domain)
+	contents.block = append(contents.block, fmt.Sprintf("%s %s", fullHandle, strings.Join(t, ", ")))
 
-	_, err = f.WriteString(fmt.Sprintf("%s %s\n", fullHandle, t))
+	err = p.writeMapFile(contents)
 	if err != nil {
 		return "", err
 	}
 
-	f.Close()
 	err = p.invokePostmap()
 	if err != nil {
 		return "", err
@@ -47,43 +74,282 @@ func (p *PostfixWriter) AddHandle(h string, t string) (string, error) {
 	return fullHandle, nil
 }
 
-// RemoveHandle scans a map file for a line starting with the handle and removes it.
+// RemoveHandle scans the managed block of the map file for the line with the handle and removes it. Lines outside the block are left alone, unless the handle isn't in the block at all.
+// Versions without the block wrote handles anywhere in the file, so a handle only found outside the block is removed from there, with a warning. A handle found nowhere is only logged, since the mail system already doesn't forward it.
 func (p *PostfixWriter) RemoveHandle(h string) error {
-	f, err := os.OpenFile(p.mapFilename, os.O_RDWR, 0600)
+	contents, err := p.readMapFile()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	t, err := ioutil.TempFile("", "")
+	fullHandle := fmt.Sprintf("%s%s", h, p.domain)
+
+	var removed bool
+	contents.block, removed = removeMapLines(contents.block, fullHandle)
+
+	if !removed {
+		var removedBefore, removedAfter bool
+		contents.before, removedBefore = removeMapLines(contents.before, fullHandle)
+		contents.after, removedAfter = removeMapLines(contents.after, fullHandle)
+
+		if !removedBefore && !removedAfter {
+			logEntry(logLevelInfo, "Handle to remove was not found in the map file", logFields{"handle": fullHandle, "path": p.mapFilename})
+			return nil
+		}
+
+		logEntry(logLevelInfo, "Removed handle written outside the incognitomail block of the map file", logFields{"handle": fullHandle, "path": p.mapFilename})
+	}
+
+	err = p.writeMapFile(contents)
+	if err != nil {
+		return err
+	}
+
+	err = p.invokePostmap()
 	if err != nil {
 		return err
 	}
 
+	return nil
+}
+
+// removeMapLines returns the lines without the ones mapping the given handle, and whether there were any.
+func removeMapLines(lines []string, fullHandle string) ([]string, bool) {
+	var kept []string
+	removed := false
+
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == fullHandle {
+			removed = true
+			continue
+		}
+
+		kept = append(kept, line)
+	}
+
+	return kept, removed
+}
+
+// readMapFile reads the map file and splits its lines around the managed block. If the file doesn't exist yet, it is treated as an empty file. If the file has no block at all, every line ends up in before and the block will be appended to the end of the file when writing.
+func (p *PostfixWriter) readMapFile() (*mapFileContents, error) {
+	contents := &mapFileContents{}
+
+	f, err := os.Open(p.mapFilename)
+	if os.IsNotExist(err) {
+		return contents, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	const (
+		beforeBlock = iota
+		insideBlock
+		afterBlock
+	)
+
+	state := beforeBlock
 	scanner := bufio.NewScanner(f)
 
 	for scanner.Scan() {
-		if !strings.HasPrefix(scanner.Text(), h) {
-			t.WriteString(fmt.Sprintf("%s\n", scanner.Text()))
+		line := scanner.Text()
+
+		switch strings.TrimSpace(line) {
+		case blockBeginMarker:
+			if state != beforeBlock {
+				return nil, ErrMalformedMapFile
+			}
+
+			state = insideBlock
+			continue
+		case blockEndMarker:
+			if state != insideBlock {
+				return nil, ErrMalformedMapFile
+			}
+
+			state = afterBlock
+			continue
 		}
+
+		switch state {
+		case beforeBlock:
+			contents.before = append(contents.before, line)
+		case insideBlock:
+			contents.block = append(contents.block, line)
+		case afterBlock:
+			contents.after = append(contents.after, line)
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
 	}
 
-	t.Close()
-	f.Close()
-	os.Rename(t.Name(), f.Name())
+	// A block that was opened but never closed means we can't tell which lines belong to us
+	if state == insideBlock {
+		return nil, ErrMalformedMapFile
+	}
 
-	err = p.invokePostmap()
+	return contents, nil
+}
+
+// writeMapFile writes the given contents to a temporary file in the same directory as the map file, and then renames it over the map file so postmap never sees a partially written file.
+func (p *PostfixWriter) writeMapFile(contents *mapFileContents) error {
+	mode := os.FileMode(0600)
+
+	info, err := os.Stat(p.mapFilename)
+	if err == nil {
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	t, err := ioutil.TempFile(filepath.Dir(p.mapFilename), ".incognitomail")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(t.Name())
 
-	return nil
+	w := bufio.NewWriter(t)
+
+	for _, line := range contents.before {
+		fmt.Fprintln(w, line)
+	}
+
+	fmt.Fprintln(w, blockBeginMarker)
+	for _, line := range contents.block {
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintln(w, blockEndMarker)
+
+	for _, line := range contents.after {
+		fmt.Fprintln(w, line)
+	}
+
+	err = w.Flush()
+	if err != nil {
+		t.Close()
+		return err
+	}
+
+	err = t.Chmod(mode)
+	if err != nil {
+		t.Close()
+		return err
+	}
+
+	err = t.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(t.Name(), p.mapFilename)
+}
+
+// Preflight checks if the map file and its directory are writable, if postmap can be executed, if the map file is readable by the postfix user and if the domain is one postfix handles mail for.
+func (p *PostfixWriter) Preflight() error {
+	problems := &PreflightError{}
+
+	err := checkFileWritable(p.mapFilename)
+	if err != nil {
+		problems.add("map file is not writable: %s", err)
+	}
+
+	err = checkDirWritable(filepath.Dir(p.mapFilename))
+	if err != nil {
+		problems.add("map file directory is not writable: %s", err)
+	}
+
+	_, err = exec.LookPath(p.postmapPath)
+	if err != nil {
+		problems.add("postmap can't be executed: %s", err)
+	}
+
+	owner, err := p.postconf("mail_owner")
+	if err != nil {
+		problems.add("could not query postconf for the postfix user: %s", err)
+	} else {
+		err = checkReadableByUser(p.mapFilename, owner)
+		if err != nil {
+			problems.add("map file won't be readable by postfix: %s", err)
+		}
+	}
+
+	err = p.checkDomain()
+	if err != nil {
+		problems.add("%s", err)
+	}
+
+	return problems.errorOrNil()
+}
+
+// Writable checks if the map file and its directory are still writable, without changing anything in the directory.
+func (p *PostfixWriter) Writable() error {
+	err := checkFileWritable(p.mapFilename)
+	if err != nil {
+		return err
+	}
+
+	return checkDirAccess(filepath.Dir(p.mapFilename))
+}
+
+// checkDomain returns an error if the configured domain isn't listed in either virtual_alias_domains or mydestination.
+func (p *PostfixWriter) checkDomain() error {
+	domain := strings.TrimPrefix(p.domain, "@")
+	hasTables := false
+
+	for _, param := range []string{"virtual_alias_domains", "mydestination"} {
+		value, err := p.postconf(param)
+		if err != nil {
+			return fmt.Errorf("could not query postconf for %s: %s", param, err)
+		}
+
+		entries := strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == '\n'
+		})
+
+		for _, entry := range entries {
+			// Lookup tables (e.g. hash:/etc/postfix/domains) and files can't be checked from here
+			if strings.ContainsAny(entry, ":/") {
+				hasTables = true
+				continue
+			}
+
+			if strings.EqualFold(entry, domain) {
+				return nil
+			}
+		}
+	}
+
+	if hasTables {
+		logEntry(logLevelInfo, "Could not find the domain in postfix parameters, but they use lookup tables that can't be checked. Assuming the domain is handled by postfix", logFields{"domain": domain})
+		return nil
+	}
+
+	return fmt.Errorf("%s is not listed in virtual_alias_domains or mydestination", domain)
+}
+
+// postconf runs the 'postconf' command to read the expanded value of a postfix parameter.
+func (p *PostfixWriter) postconf(param string) (string, error) {
+	out, err := exec.Command(p.postconfPath, "-x", "-h", param).Output()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
 }
 
 // invokePostmap runs the 'postmap' command in the shell to update the map file in postfix.
 func (p *PostfixWriter) invokePostmap() error {
-	cmd := "postmap"
-	args := []string{Config.PostfixConfig.MapFilePath}
+	cmd := p.postmapPath
+	args := []string{p.mapFilename}
+
+	if p.postmapDuration != nil {
+		defer p.postmapDuration.observeSince(time.Now())
+	}
 
 	err := exec.Command(cmd, args...).Run()
 	if err != nil {
@@ -0,0 +1,366 @@
+package incognitomail_test
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+const (
+	handwrittenMap = "postmaster@sidhion.com root\n" +
+		"testhandle1@sidhion.com someone@example.com\n"
+)
+
+// postfixSetup creates a temporary map file with the given contents and fake postmap and postconf binaries, and returns a config pointing at them, so tests using it can run in parallel. It also returns the directory holding everything, which should be passed to postfixTeardown.
+func postfixSetup(t *testing.T, contents string) (string, incognitomail.PostfixConfig) {
+	dir, err := ioutil.TempDir("", "incognitomail_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "postmap"), []byte("#!/bin/sh\nexit 0\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The fake postconf answers with the values of the last argument, which is the parameter name
+	postconf := "#!/bin/sh\n" +
+		"for p; do :; done\n" +
+		"case \"$p\" in\n" +
+		"mail_owner) echo " + u.Username + " ;;\n" +
+		"virtual_alias_domains) echo \"$VIRTUAL_ALIAS_DOMAINS\" ;;\n" +
+		"mydestination) echo localhost ;;\n" +
+		"esac\n"
+
+	err = ioutil.WriteFile(filepath.Join(dir, "postconf"), []byte(postconf), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapFile := filepath.Join(dir, "virtual")
+	if contents != "" {
+		err = ioutil.WriteFile(mapFile, []byte(contents), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := incognitomail.DefaultConfiguration().PostfixConfig
+	config.Domain = "@sidhion.com"
+	config.MapFilePath = mapFile
+	config.PostmapPath = filepath.Join(dir, "postmap")
+	config.PostconfPath = filepath.Join(dir, "postconf")
+
+	return dir, config
+}
+
+// postfixTeardown removes everything created by postfixSetup.
+func postfixTeardown(t *testing.T, dir string) {
+	err := os.RemoveAll(dir)
+	if err != nil {
+		t.Log("could not remove temporary directory used for the map file")
+	}
+}
+
+// readMap returns the current contents of the map file in the config.
+func readMap(t *testing.T, config incognitomail.PostfixConfig) string {
+	contents, err := ioutil.ReadFile(config.MapFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(contents)
+}
+
+// Ensure adding a handle to a file without a block keeps hand-written entries and appends the block.
+func TestPostfixWriter_AddHandle_KeepsHandwritten(t *testing.T) {
+	t.Parallel()
+
+	dir, config := postfixSetup(t, handwrittenMap)
+	defer postfixTeardown(t, dir)
+
+	w := incognitomail.NewPostfixWriter(config)
+
+	fullHandle, err := w.AddHandle(accountHandle2, []string{accountTarget1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fullHandle != accountHandle2+"@sidhion.com" {
+		t.Fatal("unexpected full handle ", fullHandle)
+	}
+
+	expected := handwrittenMap +
+		"# BEGIN incognitomail\n" +
+		"testhandle2@sidhion.com testtarget1@example.com\n" +
+		"# END incognitomail\n"
+
+	if readMap(t, config) != expected {
+		t.Fatalf("unexpected map file contents:\n%s", readMap(t, config))
+	}
+}
+
+// Ensure a handle with multiple targets is written as a comma-separated list of recipients.
+func TestPostfixWriter_AddHandle_MultipleTargets(t *testing.T) {
+	t.Parallel()
+
+	dir, config := postfixSetup(t, "")
+	defer postfixTeardown(t, dir)
+
+	w := incognitomail.NewPostfixWriter(config)
+
+	_, err := w.AddHandle(accountHandle1, []string{accountTarget1, accountTarget2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "# BEGIN incognitomail\n" +
+		"testhandle1@sidhion.com testtarget1@example.com, testtarget2@example.com\n" +
+		"# END incognitomail\n"
+
+	if readMap(t, config) != expected {
+		t.Fatalf("unexpected map file contents:\n%s", readMap(t, config))
+	}
+}
+
+// Ensure removing a handle only touches lines inside the block.
+func TestPostfixWriter_RemoveHandle_OnlyBlock(t *testing.T) {
+	t.Parallel()
+
+	dir, config := postfixSetup(t, handwrittenMap)
+	defer postfixTeardown(t, dir)
+
+	w := incognitomail.NewPostfixWriter(config)
+
+	_, err := w.AddHandle(accountHandle1, []string{accountTarget1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.RemoveHandle(accountHandle1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := handwrittenMap +
+		"# BEGIN incognitomail\n" +
+		"# END incognitomail\n"
+
+	if readMap(t, config) != expected {
+		t.Fatalf("unexpected map file contents:\n%s", readMap(t, config))
+	}
+}
+
+// Ensure handles written before the block existed are removed from outside the block, and that removing a handle missing from the file leaves it untouched.
+func TestPostfixWriter_RemoveHandle_Legacy(t *testing.T) {
+	t.Parallel()
+
+	legacyMap := "postmaster@sidhion.com root\n" +
+		accountHandle2 + "@sidhion.com " + accountTarget1 + "\n" +
+		"abuse@sidhion.com root\n"
+
+	dir, config := postfixSetup(t, legacyMap)
+	defer postfixTeardown(t, dir)
+
+	w := incognitomail.NewPostfixWriter(config)
+
+	err := w.RemoveHandle(neverUsedHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readMap(t, config) != legacyMap {
+		t.Fatalf("expected the map file to be untouched, got:\n%s", readMap(t, config))
+	}
+
+	err = w.RemoveHandle(accountHandle2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "postmaster@sidhion.com root\n" +
+		"abuse@sidhion.com root\n" +
+		"# BEGIN incognitomail\n" +
+		"# END incognitomail\n"
+
+	if readMap(t, config) != expected {
+		t.Fatalf("unexpected map file contents:\n%s", readMap(t, config))
+	}
+}
+
+// Ensure the file mode of an existing map file is kept.
+func TestPostfixWriter_KeepsMode(t *testing.T) {
+	t.Parallel()
+
+	dir, config := postfixSetup(t, handwrittenMap)
+	defer postfixTeardown(t, dir)
+
+	w := incognitomail.NewPostfixWriter(config)
+
+	_, err := w.AddHandle(accountHandle1, []string{accountTarget1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(config.MapFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0640 {
+		t.Fatal("map file mode changed to ", info.Mode().Perm())
+	}
+}
+
+// Ensure a map file with malformed markers is refused and left untouched.
+func TestPostfixWriter_MalformedMarkers(t *testing.T) {
+	t.Parallel()
+
+	malformed := []string{
+		"# BEGIN incognitomail\n",
+		"# END incognitomail\n",
+		"# END incognitomail\n# BEGIN incognitomail\n",
+		"# BEGIN incognitomail\n# BEGIN incognitomail\n# END incognitomail\n",
+		"# BEGIN incognitomail\n# END incognitomail\n# END incognitomail\n",
+	}
+
+	for _, m := range malformed {
+		dir, config := postfixSetup(t, handwrittenMap+m)
+
+		w := incognitomail.NewPostfixWriter(config)
+
+		_, err := w.AddHandle(accountHandle1, []string{accountTarget1})
+		if err != incognitomail.ErrMalformedMapFile {
+			t.Errorf("expected ErrMalformedMapFile for %q, got %v", m, err)
+		}
+
+		err = w.RemoveHandle(accountHandle1)
+		if err != incognitomail.ErrMalformedMapFile {
+			t.Errorf("expected ErrMalformedMapFile for %q, got %v", m, err)
+		}
+
+		if readMap(t, config) != handwrittenMap+m {
+			t.Errorf("map file was changed for %q", m)
+		}
+
+		postfixTeardown(t, dir)
+	}
+}
+
+// Ensure preflight checks pass when everything is set up correctly.
+func TestPostfixWriter_Preflight(t *testing.T) {
+	dir, config := postfixSetup(t, handwrittenMap)
+	defer postfixTeardown(t, dir)
+
+	os.Setenv("VIRTUAL_ALIAS_DOMAINS", "example.com, sidhion.com")
+	defer os.Unsetenv("VIRTUAL_ALIAS_DOMAINS")
+
+	err := incognitomail.NewPostfixWriter(config).Preflight()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Ensure preflight checks fail when postfix doesn't handle the configured domain.
+func TestPostfixWriter_Preflight_UnknownDomain(t *testing.T) {
+	dir, config := postfixSetup(t, handwrittenMap)
+	defer postfixTeardown(t, dir)
+
+	os.Setenv("VIRTUAL_ALIAS_DOMAINS", "example.com")
+	defer os.Unsetenv("VIRTUAL_ALIAS_DOMAINS")
+
+	err := incognitomail.NewPostfixWriter(config).Preflight()
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	preflightErr, ok := err.(*incognitomail.PreflightError)
+	if !ok {
+		t.Fatal("expected PreflightError")
+	}
+
+	if len(preflightErr.Problems) != 1 {
+		t.Fatal("expected a single problem, got ", preflightErr.Problems)
+	}
+}
+
+// Ensure the map file is reported as writable only while its directory exists.
+func TestPostfixWriter_Writable(t *testing.T) {
+	t.Parallel()
+
+	dir, config := postfixSetup(t, handwrittenMap)
+	defer postfixTeardown(t, dir)
+
+	w := incognitomail.NewPostfixWriter(config)
+
+	err := w.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Writable()
+	if err == nil {
+		t.Error("expected error after removing the map file directory")
+	}
+}
+
+// Ensure checking if the map file is writable doesn't create anything in its directory, and that directories without write permission are reported.
+func TestPostfixWriter_Writable_NoChanges(t *testing.T) {
+	t.Parallel()
+
+	dir, config := postfixSetup(t, handwrittenMap)
+	defer postfixTeardown(t, dir)
+
+	// Creating or removing a file would change the modification time of the directory
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err := os.Chtimes(dir, past, past)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := incognitomail.NewPostfixWriter(config)
+
+	err = w.Writable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.ModTime().Equal(past) {
+		t.Errorf("expected the directory to be left alone, modified at %s", info.ModTime())
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("permissions don't apply to root")
+	}
+
+	err = os.Chmod(dir, 0500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0700)
+
+	err = w.Writable()
+	if err == nil {
+		t.Error("expected error for a directory without write permission")
+	}
+}
@@ -0,0 +1,143 @@
+package incognitomail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// PreflightError lists every problem found while checking if the server has enough permissions to change the mail system.
+type PreflightError struct {
+	Problems []string
+}
+
+// Error returns all problems found, separated by semicolons.
+func (e *PreflightError) Error() string {
+	return fmt.Sprintf("preflight checks failed: %s", strings.Join(e.Problems, "; "))
+}
+
+// add records a new problem. Arguments are handled in the manner of fmt.Sprintf.
+func (e *PreflightError) add(format string, a ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, a...))
+}
+
+// errorOrNil returns nil if no problems were found, so callers don't end up with a non-nil error interface holding an empty PreflightError.
+func (e *PreflightError) errorOrNil() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// checkFileWritable returns an error if the file in the given path exists but can't be opened for writing. The file is never modified.
+func checkFileWritable(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// checkDirWritable returns an error if new files can't be created in the given directory.
+func checkDirWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".incognitomail")
+	if err != nil {
+		return err
+	}
+
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Modes checked by syscall.Access, which are the same in every POSIX system.
+const (
+	accessExecute = 0x1
+	accessWrite   = 0x2
+)
+
+// checkDirAccess returns an error if the permissions of the given directory don't allow this process to create files in it. Unlike checkDirWritable, nothing is created, so it can be called as often as needed, but problems such as a full disk go unnoticed.
+func checkDirAccess(dir string) error {
+	err := syscall.Access(dir, accessWrite|accessExecute)
+	if err != nil {
+		return &os.PathError{Op: "access", Path: dir, Err: err}
+	}
+
+	return nil
+}
+
+// readableByUser returns true if a file with the given owner and permissions can be read by the given user.
+func readableByUser(u *user.User, uid, gid uint32, mode os.FileMode) (bool, error) {
+	userID, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return false, err
+	}
+
+	if userID == 0 || mode&0004 != 0 {
+		return true, nil
+	}
+
+	if uint32(userID) == uid {
+		return mode&0400 != 0, nil
+	}
+
+	if mode&0040 == 0 {
+		return false, nil
+	}
+
+	groups, err := u.GroupIds()
+	if err != nil {
+		return false, err
+	}
+
+	for _, g := range groups {
+		if g == strconv.FormatUint(uint64(gid), 10) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// checkReadableByUser returns an error if the file in the given path can't be read by the user with the given name. If the file doesn't exist yet, it checks the owner and permissions the file will have once it's created by this process.
+func checkReadableByUser(path, username string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+
+	uid, gid := uint32(os.Geteuid()), uint32(os.Getegid())
+	mode := os.FileMode(0600)
+
+	info, err := os.Stat(path)
+	if err == nil {
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("could not read ownership of %s", path)
+		}
+
+		uid, gid, mode = stat.Uid, stat.Gid, info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	readable, err := readableByUser(u, uid, gid, mode)
+	if err != nil {
+		return err
+	}
+
+	if !readable {
+		return fmt.Errorf("%s is not readable by user %s", filepath.Clean(path), username)
+	}
+
+	return nil
+}
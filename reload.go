@@ -0,0 +1,175 @@
+package incognitomail
+
+import (
+	"errors"
+	"reflect"
+)
+
+var (
+	// ErrNoConfigFile is used when reloading the configuration, but the server was started without a configuration file.
+	ErrNoConfigFile = errors.New("no configuration file to reload")
+)
+
+// Reload reads the configuration file again and applies it without stopping the server. Commands wait while the new configuration is applied, so they see either the old or the new one, never a mix of both.
+// Settings that are only read when the server starts, such as listening addresses and the database, keep their current values, and their names are returned so they can be reported. If the new configuration is invalid, its certificate can't be loaded or the new mail system settings fail the preflight checks, nothing changes.
+func (s *Server) Reload() ([]string, error) {
+	restart, err := s.reload()
+	if err != nil {
+		logEntry(logLevelInfo, "Could not reload the configuration", logFields{"error": err})
+		return nil, err
+	}
+
+	for _, name := range restart {
+		logEntry(logLevelInfo, "Setting changed, but will only be applied after a restart", logFields{"setting": name})
+	}
+
+	logEntry(logLevelInfo, "Reloaded configuration", nil)
+	return restart, nil
+}
+
+// reload does the work of Reload, without logging the results.
+func (s *Server) reload() ([]string, error) {
+	source := s.currentConfig().source
+	if source.path == "" {
+		return nil, ErrNoConfigFile
+	}
+
+	fresh := DefaultConfiguration()
+	fresh.source = source
+
+	err := fresh.readSources()
+	if err != nil {
+		return nil, err
+	}
+
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	old := s.currentConfig()
+	restart := keepRestartSettings(*old, fresh)
+
+	err = fresh.Check()
+	if err != nil {
+		return nil, err
+	}
+
+	var writer MailSystemHandleWriter
+	if !reflect.DeepEqual(old.PostfixConfig, fresh.PostfixConfig) {
+		writer = mailSystemWriterFromConfig(fresh, s.metrics)
+
+		if !fresh.General.SkipPreflightChecks {
+			err = writer.Preflight()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if fresh.tlsEnabled() {
+		err = s.certificates.load(fresh.General.TLSCertFile, fresh.General.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !reflect.DeepEqual(old.Audit, fresh.Audit) {
+		auditLog, err := openAuditLogFromConfig(fresh.Audit)
+		if err != nil {
+			return nil, err
+		}
+
+		if s.auditLog != nil {
+			s.auditLog.close()
+		}
+		s.auditLog = auditLog
+	}
+
+	s.config.Store(fresh)
+
+	if writer != nil {
+		// No command runs while reloading, but holding the mail system lock anyway keeps the writer from ever being replaced in the middle of a change
+		s.mailSystemLock <- struct{}{}
+		s.mailSystemWriter = writer
+		<-s.mailSystemLock
+	}
+
+	if !reflect.DeepEqual(old.Logging, fresh.Logging) {
+		err = ConfigureLogging(fresh.Logging)
+		if err != nil {
+			// Everything else was already applied, so just keep logging as before
+			logEntry(logLevelInfo, "Could not apply the new logging settings", logFields{"error": err})
+		}
+	}
+
+	s.verifier = nil
+	if fresh.Verification.Enabled {
+		s.verifier = NewSMTPVerifierFromConfig(fresh.Verification)
+	}
+
+	// Replacing the limiter forgets every failure, so only do it if its settings changed
+	if !reflect.DeepEqual(old.BruteForce, fresh.BruteForce) {
+		s.authLimiter = newAuthLimiterFromConfig(fresh.BruteForce)
+	}
+
+	return restart, nil
+}
+
+// keepRestartSettings copies from old to fresh every setting that is only read when the server starts, returning the names of the ones that changed.
+func keepRestartSettings(old Configuration, fresh *Configuration) []string {
+	var changed []string
+
+	keep := func(name string, oldValue string, freshValue *string) {
+		if *freshValue != oldValue {
+			changed = append(changed, name)
+			*freshValue = oldValue
+		}
+	}
+
+	keep("General.MailSystem", old.General.MailSystem, &fresh.General.MailSystem)
+	keep("General.UnixSockPath", old.General.UnixSockPath, &fresh.General.UnixSockPath)
+	keep("General.LockFilePath", old.General.LockFilePath, &fresh.General.LockFilePath)
+	keep("General.ListenPath", old.General.ListenPath, &fresh.General.ListenPath)
+	keep("General.APIPath", old.General.APIPath, &fresh.General.APIPath)
+	keep("General.HealthPath", old.General.HealthPath, &fresh.General.HealthPath)
+	keep("General.ReadyPath", old.General.ReadyPath, &fresh.General.ReadyPath)
+	keep("General.ListenAddress", old.General.ListenAddress, &fresh.General.ListenAddress)
+
+	// Certificates can be replaced, but the server can't switch between plain HTTP and TLS
+	oldTLS := old.General.TLSCertFile != "" && old.General.TLSKeyFile != ""
+	freshTLS := fresh.General.TLSCertFile != "" && fresh.General.TLSKeyFile != ""
+	if oldTLS != freshTLS {
+		changed = append(changed, "General.TLSCertFile", "General.TLSKeyFile")
+		fresh.General.TLSCertFile = old.General.TLSCertFile
+		fresh.General.TLSKeyFile = old.General.TLSKeyFile
+	}
+
+	keep("General.TLSMinVersion", old.General.TLSMinVersion, &fresh.General.TLSMinVersion)
+	keep("General.TLSClientCAFile", old.General.TLSClientCAFile, &fresh.General.TLSClientCAFile)
+
+	if !reflect.DeepEqual(old.General.TLSCipherSuite, fresh.General.TLSCipherSuite) {
+		changed = append(changed, "General.TLSCipherSuite")
+		fresh.General.TLSCipherSuite = old.General.TLSCipherSuite
+	}
+
+	if !reflect.DeepEqual(old.Persistence, fresh.Persistence) {
+		changed = append(changed, "Persistence")
+		fresh.Persistence = old.Persistence
+	}
+
+	if !reflect.DeepEqual(old.Metrics, fresh.Metrics) {
+		changed = append(changed, "Metrics")
+		fresh.Metrics = old.Metrics
+	}
+
+	if !reflect.DeepEqual(old.ACME, fresh.ACME) {
+		changed = append(changed, "ACME")
+		fresh.ACME = old.ACME
+	}
+
+	if !reflect.DeepEqual(old.RPC, fresh.RPC) {
+		changed = append(changed, "RPC")
+		fresh.RPC = old.RPC
+	}
+
+	return changed
+}
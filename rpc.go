@@ -0,0 +1,260 @@
+package incognitomail
+
+import (
+	"context"
+
+	"github.com/valyala/gorpc"
+)
+
+const rpcServiceName = "IncognitoRPCService"
+
+// NewAccountRequest holds the arguments of the NewAccount RPC method.
+type NewAccountRequest struct {
+	Targets []string
+}
+
+// NewAccountResponse holds the results of the NewAccount RPC method.
+type NewAccountResponse struct {
+	Secret string
+}
+
+// NewHandleRequest holds the arguments of the NewHandle RPC method. If Targets is empty, the handle forwards to the account targets.
+type NewHandleRequest struct {
+	Secret  string
+	Targets []string
+}
+
+// NewHandleResponse holds the results of the NewHandle RPC method.
+type NewHandleResponse struct {
+	Handle string
+}
+
+// ConfirmTargetRequest holds the arguments of the ConfirmTarget RPC method.
+type ConfirmTargetRequest struct {
+	Secret string
+	Token  string
+}
+
+// DeleteHandleRequest holds the arguments of the DeleteHandle RPC method.
+type DeleteHandleRequest struct {
+	Secret string
+	Handle string
+}
+
+// DeleteAccountRequest holds the arguments of the DeleteAccount RPC method.
+type DeleteAccountRequest struct {
+	Secret string
+}
+
+// ListHandlesRequest holds the arguments of the ListHandles RPC method.
+type ListHandlesRequest struct {
+	Secret string
+}
+
+// ListHandlesResponse holds the results of the ListHandles RPC method.
+type ListHandlesResponse struct {
+	Handles []string
+}
+
+// NewInviteRequest holds the arguments of the NewInvite RPC method, which has none for now.
+type NewInviteRequest struct{}
+
+// NewInviteResponse holds the results of the NewInvite RPC method.
+type NewInviteResponse struct {
+	Code string
+}
+
+// DeleteInviteRequest holds the arguments of the DeleteInvite RPC method.
+type DeleteInviteRequest struct {
+	Code string
+}
+
+// ListInvitesRequest holds the arguments of the ListInvites RPC method, which has none for now.
+type ListInvitesRequest struct{}
+
+// ListInvitesResponse holds the results of the ListInvites RPC method.
+type ListInvitesResponse struct {
+	Codes []string
+}
+
+// AuditLogRequest holds the arguments of the AuditLog RPC method.
+type AuditLogRequest struct {
+	Secret string
+}
+
+// AuditLogResponse holds the results of the AuditLog RPC method.
+type AuditLogResponse struct {
+	Entries []AuditEntry
+}
+
+func init() {
+	// Requests and responses are sent through RPC, so they must be known by the encoder on both sides
+	gorpc.RegisterType(NewAccountRequest{})
+	gorpc.RegisterType(NewAccountResponse{})
+	gorpc.RegisterType(NewHandleRequest{})
+	gorpc.RegisterType(NewHandleResponse{})
+	gorpc.RegisterType(ConfirmTargetRequest{})
+	gorpc.RegisterType(DeleteHandleRequest{})
+	gorpc.RegisterType(DeleteAccountRequest{})
+	gorpc.RegisterType(ListHandlesRequest{})
+	gorpc.RegisterType(ListHandlesResponse{})
+	gorpc.RegisterType(NewInviteRequest{})
+	gorpc.RegisterType(NewInviteResponse{})
+	gorpc.RegisterType(DeleteInviteRequest{})
+	gorpc.RegisterType(ListInvitesRequest{})
+	gorpc.RegisterType(ListInvitesResponse{})
+	gorpc.RegisterType(AuditLogRequest{})
+	gorpc.RegisterType(AuditLogResponse{})
+}
+
+// rpcService holds the methods available through the RPC interface. Every exported method is registered in gorpc, so they must follow its rules: at most a client address and one argument, and at most one result and an error.
+// Methods that read or change accounts, handles or invites go through the same permission checks and metrics as commands from any other source, and the ones that change something are also written to the audit log.
+type rpcService struct {
+	server *Server
+}
+
+// run executes the command built from an RPC call. The RPC interface has no way to cancel a call, so only the command timeout applies.
+func (r *rpcService) run(clientAddr string, command interface{}) (interface{}, error) {
+	return r.server.runCommand(context.Background(), sourceRPC, clientAddr, command)
+}
+
+// SendCommand executes a command typed in the command line, with clientAddr being the address of the RPC client. Kept for clients that don't use the typed methods.
+func (r *rpcService) SendCommand(clientAddr, args string) (string, error) {
+	return r.server.SendCommand(clientAddr, args)
+}
+
+// NewAccount creates an account forwarding to the given targets.
+func (r *rpcService) NewAccount(clientAddr string, req NewAccountRequest) (NewAccountResponse, error) {
+	res, err := r.run(clientAddr, newAccountCommand{
+		source:     sourceRPC,
+		remoteAddr: clientAddr,
+		targets:    req.Targets,
+	})
+
+	secret, _ := res.(string)
+	return NewAccountResponse{Secret: secret}, err
+}
+
+// NewHandle creates a handle for the account with the given secret.
+func (r *rpcService) NewHandle(clientAddr string, req NewHandleRequest) (NewHandleResponse, error) {
+	res, err := r.run(clientAddr, newHandleCommand{
+		source:        sourceRPC,
+		remoteAddr:    clientAddr,
+		accountSecret: req.Secret,
+		targets:       req.Targets,
+	})
+
+	handle, _ := res.(string)
+	return NewHandleResponse{Handle: handle}, err
+}
+
+// ConfirmTarget confirms the account target that received the given token.
+func (r *rpcService) ConfirmTarget(clientAddr string, req ConfirmTargetRequest) error {
+	_, err := r.run(clientAddr, confirmTargetCommand{
+		source:     sourceRPC,
+		remoteAddr: clientAddr,
+		secret:     req.Secret,
+		token:      req.Token,
+	})
+
+	return err
+}
+
+// DeleteHandle deletes a handle from the account with the given secret.
+func (r *rpcService) DeleteHandle(clientAddr string, req DeleteHandleRequest) error {
+	_, err := r.run(clientAddr, deleteHandleCommand{
+		source:     sourceRPC,
+		remoteAddr: clientAddr,
+		secret:     req.Secret,
+		handle:     req.Handle,
+	})
+
+	return err
+}
+
+// DeleteAccount deletes the account with the given secret and all its handles.
+func (r *rpcService) DeleteAccount(clientAddr string, req DeleteAccountRequest) error {
+	_, err := r.run(clientAddr, deleteAccountCommand{
+		source:     sourceRPC,
+		remoteAddr: clientAddr,
+		secret:     req.Secret,
+	})
+
+	return err
+}
+
+// ListHandles returns all handles of the account with the given secret.
+func (r *rpcService) ListHandles(clientAddr string, req ListHandlesRequest) (ListHandlesResponse, error) {
+	res, err := r.run(clientAddr, listHandlesCommand{
+		source:     sourceRPC,
+		remoteAddr: clientAddr,
+		secret:     req.Secret,
+	})
+	if err != nil {
+		return ListHandlesResponse{}, err
+	}
+
+	handles, _ := res.([]string)
+	return ListHandlesResponse{Handles: handles}, nil
+}
+
+// NewInvite creates a new invite code.
+func (r *rpcService) NewInvite(clientAddr string, req NewInviteRequest) (NewInviteResponse, error) {
+	res, err := r.run(clientAddr, newInviteCommand{
+		source:     sourceRPC,
+		remoteAddr: clientAddr,
+	})
+
+	code, _ := res.(string)
+	return NewInviteResponse{Code: code}, err
+}
+
+// DeleteInvite deletes the given invite code.
+func (r *rpcService) DeleteInvite(clientAddr string, req DeleteInviteRequest) error {
+	_, err := r.run(clientAddr, deleteInviteCommand{
+		source:     sourceRPC,
+		remoteAddr: clientAddr,
+		code:       req.Code,
+	})
+
+	return err
+}
+
+// ListInvites returns all invite codes that haven't been used yet.
+func (r *rpcService) ListInvites(clientAddr string, req ListInvitesRequest) (ListInvitesResponse, error) {
+	res, err := r.run(clientAddr, listInvitesCommand{
+		source:     sourceRPC,
+		remoteAddr: clientAddr,
+	})
+	if err != nil {
+		return ListInvitesResponse{}, err
+	}
+
+	codes, _ := res.([]string)
+	return ListInvitesResponse{Codes: codes}, nil
+}
+
+// AuditLog returns all audit log entries for the account with the given secret.
+func (r *rpcService) AuditLog(clientAddr string, req AuditLogRequest) (AuditLogResponse, error) {
+	res, err := r.run(clientAddr, auditLogCommand{
+		source:     sourceRPC,
+		remoteAddr: clientAddr,
+		secret:     req.Secret,
+	})
+	if err != nil {
+		return AuditLogResponse{}, err
+	}
+
+	entries, _ := res.([]AuditEntry)
+	return AuditLogResponse{Entries: entries}, nil
+}
+
+// Stop stops the server in its own goroutine, since stopping the RPC server waits for the calls it's handling, including this one, and the reply must still be sent.
+func (r *rpcService) Stop() {
+	go r.server.Stop()
+}
+
+// Reload reads the configuration file again, returning the names of the settings that will only be applied after a restart.
+func (r *rpcService) Reload() ([]string, error) {
+	return r.server.Reload()
+}
@@ -0,0 +1,165 @@
+package incognitomail_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+// newRPCTest returns the RPC service of a server created by newTestServer, requiring invites to sign up from anywhere but RPC, with the permissions of the rpc source replaced by the given ones if not nil.
+func newRPCTest(t *testing.T, permissions *incognitomail.PermissionConfig) *incognitomail.RPCService {
+	server, _ := newTestServer(t, func(c *incognitomail.Configuration) {
+		c.Audit.FilePath = filepath.Join(filepath.Dir(c.Persistence.DatabasePath), "audit.log")
+		c.Signup.Policy = "invite"
+
+		if permissions != nil {
+			c.Permissions = map[string]*incognitomail.PermissionConfig{"rpc": permissions}
+		}
+	})
+
+	return incognitomail.NewRPCService(server)
+}
+
+// Ensure every RPC method executes its command with the default permissions.
+func TestRPCService_Methods(t *testing.T) {
+	t.Parallel()
+
+	r := newRPCTest(t, nil)
+
+	account, err := r.NewAccount("", incognitomail.NewAccountRequest{Targets: []string{accountTarget1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = r.NewHandle("", incognitomail.NewHandleRequest{Secret: account.Secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handles, err := r.ListHandles("", incognitomail.ListHandlesRequest{Secret: account.Secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(handles.Handles) != 1 {
+		t.Fatalf("expected one handle, got %v", handles.Handles)
+	}
+
+	err = r.DeleteHandle("", incognitomail.DeleteHandleRequest{Secret: account.Secret, Handle: handles.Handles[0]})
+	if err != nil {
+		t.Errorf("expected handle to be deleted, got %v", err)
+	}
+
+	invite, err := r.NewInvite("", incognitomail.NewInviteRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invites, err := r.ListInvites("", incognitomail.ListInvitesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(invites.Codes) != 1 || invites.Codes[0] != invite.Code {
+		t.Errorf("expected the created invite code, got %v", invites.Codes)
+	}
+
+	err = r.DeleteInvite("", incognitomail.DeleteInviteRequest{Code: invite.Code})
+	if err != nil {
+		t.Errorf("expected invite code to be deleted, got %v", err)
+	}
+
+	audit, err := r.AuditLog("", incognitomail.AuditLogRequest{Secret: account.Secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var commands []string
+	for _, e := range audit.Entries {
+		commands = append(commands, e.Command)
+	}
+
+	expected := []string{"new account", "new handle", "delete handle"}
+	if len(commands) != len(expected) {
+		t.Fatalf("expected audit entries for %v, got %v", expected, commands)
+	}
+
+	for i := range expected {
+		if commands[i] != expected[i] {
+			t.Errorf("expected audit entries for %v, got %v", expected, commands)
+			break
+		}
+	}
+
+	err = r.DeleteAccount("", incognitomail.DeleteAccountRequest{Secret: account.Secret})
+	if err != nil {
+		t.Errorf("expected account to be deleted, got %v", err)
+	}
+}
+
+// Ensure every RPC method is refused when its command is denied for the rpc source.
+func TestRPCService_Methods_Denied(t *testing.T) {
+	t.Parallel()
+
+	r := newRPCTest(t, &incognitomail.PermissionConfig{
+		NewAccount:    "deny",
+		NewHandle:     "deny",
+		DeleteHandle:  "deny",
+		DeleteAccount: "deny",
+		ListHandles:   "deny",
+		ConfirmTarget: "deny",
+		NewInvite:     "deny",
+		DeleteInvite:  "deny",
+		ListInvites:   "deny",
+		AuditLog:      "deny",
+	})
+
+	secret := "secret"
+
+	calls := map[string]func() error{
+		"NewAccount": func() error {
+			_, err := r.NewAccount("", incognitomail.NewAccountRequest{Targets: []string{accountTarget1}})
+			return err
+		},
+		"NewHandle": func() error {
+			_, err := r.NewHandle("", incognitomail.NewHandleRequest{Secret: secret})
+			return err
+		},
+		"DeleteHandle": func() error {
+			return r.DeleteHandle("", incognitomail.DeleteHandleRequest{Secret: secret, Handle: "handle"})
+		},
+		"DeleteAccount": func() error {
+			return r.DeleteAccount("", incognitomail.DeleteAccountRequest{Secret: secret})
+		},
+		"ListHandles": func() error {
+			_, err := r.ListHandles("", incognitomail.ListHandlesRequest{Secret: secret})
+			return err
+		},
+		"ConfirmTarget": func() error {
+			return r.ConfirmTarget("", incognitomail.ConfirmTargetRequest{Secret: secret, Token: "token"})
+		},
+		"NewInvite": func() error {
+			_, err := r.NewInvite("", incognitomail.NewInviteRequest{})
+			return err
+		},
+		"DeleteInvite": func() error {
+			return r.DeleteInvite("", incognitomail.DeleteInviteRequest{Code: "code"})
+		},
+		"ListInvites": func() error {
+			_, err := r.ListInvites("", incognitomail.ListInvitesRequest{})
+			return err
+		},
+		"AuditLog": func() error {
+			_, err := r.AuditLog("", incognitomail.AuditLogRequest{Secret: secret})
+			return err
+		},
+	}
+
+	for name, call := range calls {
+		err := call()
+		if err != incognitomail.ErrInvalidPermission {
+			t.Errorf("%s: expected ErrInvalidPermission, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package incognitomail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+var (
+	// ErrPeerCredentialsUnavailable is used when the user connecting to the RPC socket can't be found, e.g. in systems without SO_PEERCRED.
+	ErrPeerCredentialsUnavailable = errors.New("peer credentials are not available in this system")
+)
+
+// rpcListener listens in a unix socket with the configured permissions, and only accepts connections from allowed users. Implements gorpc.Listener.
+type rpcListener struct {
+	listener *net.UnixListener
+	addr     string
+
+	mode  os.FileMode
+	group string
+
+	// Only checked if any of them is not empty. The user running the server is always allowed.
+	allowedUIDs map[uint32]bool
+	allowedGIDs map[uint32]bool
+}
+
+// newRPCListenerFromConfig creates a listener with the values from the [RPC] section, resolving every user and group name.
+func newRPCListenerFromConfig(c RPCConfig) (*rpcListener, error) {
+	// Already checked when validating the config
+	mode, _ := strconv.ParseUint(c.SocketMode, 8, 32)
+
+	l := &rpcListener{
+		mode:        os.FileMode(mode),
+		group:       c.SocketGroup,
+		allowedUIDs: make(map[uint32]bool),
+		allowedGIDs: make(map[uint32]bool),
+	}
+
+	for _, name := range c.AllowedUser {
+		uid, err := lookupUserID(name)
+		if err != nil {
+			return nil, err
+		}
+
+		l.allowedUIDs[uid] = true
+	}
+
+	for _, name := range c.AllowedGroup {
+		gid, err := lookupGroupID(name)
+		if err != nil {
+			return nil, err
+		}
+
+		l.allowedGIDs[gid] = true
+	}
+
+	return l, nil
+}
+
+// Init starts listening in the socket at addr, replacing any stale socket left by a previous server.
+// The socket is created in a directory only the server can enter, and moved to addr once its mode and group are set, so nobody can connect while it still has the default permissions.
+func (l *rpcListener) Init(addr string) error {
+	err := os.Remove(addr)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(addr), ".rpc")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpAddr := filepath.Join(dir, "sock")
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpAddr, Net: "unix"})
+	if err != nil {
+		return err
+	}
+
+	// The listener would only remove the socket at its original path, so Close removes it from addr instead
+	listener.SetUnlinkOnClose(false)
+
+	err = os.Chmod(tmpAddr, l.mode)
+	if err == nil && l.group != "" {
+		var gid uint32
+		gid, err = lookupGroupID(l.group)
+		if err == nil {
+			err = os.Chown(tmpAddr, -1, int(gid))
+		}
+	}
+
+	if err == nil {
+		err = os.Rename(tmpAddr, addr)
+	}
+
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	l.listener = listener
+	l.addr = addr
+	return nil
+}
+
+// Accept waits for the next connection from an allowed user, closing any other connections. The client address is the uid of the connecting user, so it shows up in logs and in the audit log.
+func (l *rpcListener) Accept() (io.ReadWriteCloser, string, error) {
+	for {
+		conn, err := l.listener.AcceptUnix()
+		if err != nil {
+			return nil, "", err
+		}
+
+		uid, gid, err := peerCredentials(conn)
+		if err != nil {
+			if !l.restricted() {
+				return conn, "", nil
+			}
+
+			logEntry(logLevelInfo, "Refused RPC connection", logFields{"error": err})
+			conn.Close()
+			continue
+		}
+
+		clientAddr := fmt.Sprintf("uid=%d", uid)
+
+		if !l.allowed(uid, gid) {
+			logEntry(logLevelInfo, "Refused RPC connection", logFields{"remote_addr": clientAddr})
+			conn.Close()
+			continue
+		}
+
+		return conn, clientAddr, nil
+	}
+}
+
+// Close stops listening and removes the socket file.
+func (l *rpcListener) Close() error {
+	err := l.listener.Close()
+
+	removeErr := os.Remove(l.addr)
+	if err == nil && !os.IsNotExist(removeErr) {
+		err = removeErr
+	}
+
+	return err
+}
+
+// ListenAddr returns the address of the socket.
+func (l *rpcListener) ListenAddr() net.Addr {
+	return &net.UnixAddr{Name: l.addr, Net: "unix"}
+}
+
+// restricted returns true if only some users are allowed to connect.
+func (l *rpcListener) restricted() bool {
+	return len(l.allowedUIDs) > 0 || len(l.allowedGIDs) > 0
+}
+
+// allowed returns true if the user with the given uid and primary gid may use the RPC interface. Supplementary groups of the user are also checked.
+func (l *rpcListener) allowed(uid, gid uint32) bool {
+	if !l.restricted() || uid == uint32(os.Geteuid()) || l.allowedUIDs[uid] || l.allowedGIDs[gid] {
+		return true
+	}
+
+	if len(l.allowedGIDs) == 0 {
+		return false
+	}
+
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return false
+	}
+
+	groups, err := u.GroupIds()
+	if err != nil {
+		return false
+	}
+
+	for _, g := range groups {
+		id, err := strconv.ParseUint(g, 10, 32)
+		if err == nil && l.allowedGIDs[uint32(id)] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookupUserID returns the uid of the user with the given name. Numeric names are taken as the uid itself.
+func lookupUserID(name string) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.ParseUint(u.Uid, 10, 32)
+	return uint32(id), err
+}
+
+// lookupGroupID returns the gid of the group with the given name. Numeric names are taken as the gid itself.
+func lookupGroupID(name string) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.ParseUint(g.Gid, 10, 32)
+	return uint32(id), err
+}
+
+// validSocketMode returns true if mode is an octal file mode with only permission bits.
+func validSocketMode(mode string) bool {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	return err == nil && m <= 0777
+}
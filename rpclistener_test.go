@@ -0,0 +1,113 @@
+package incognitomail_test
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+// Ensure the socket only shows up in its path with the configured mode, and is removed when the listener is closed.
+func TestRPCListener_Init(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "incognitomail_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l, err := incognitomail.NewRPCListener(incognitomail.RPCConfig{SocketMode: "0600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := filepath.Join(dir, "incognitomail.sock")
+
+	err = l.Init(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("expected a socket with mode 0600, got %v", info.Mode())
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("expected only the socket in the directory, got %d entries", len(entries))
+	}
+
+	conn, err := net.Dial("unix", addr)
+	if err != nil {
+		t.Fatalf("expected to connect to the socket, got %v", err)
+	}
+	conn.Close()
+
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(addr)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+}
+
+// Ensure only the allowed users and groups, and the user running the server, may connect once any of them is configured.
+func TestRPCListener_allowed(t *testing.T) {
+	t.Parallel()
+
+	const (
+		allowedUID = 54321
+		allowedGID = 54322
+		otherID    = 54323
+	)
+
+	open, err := incognitomail.NewRPCListener(incognitomail.RPCConfig{SocketMode: "0600"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !open.Allowed(otherID, otherID) {
+		t.Error("expected anyone to be allowed without allowed users or groups")
+	}
+
+	l, err := incognitomail.NewRPCListener(incognitomail.RPCConfig{
+		SocketMode:   "0600",
+		AllowedUser:  []string{"54321"},
+		AllowedGroup: []string{"54322"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		uid, gid uint32
+		allowed  bool
+	}{
+		{allowedUID, otherID, true},
+		{otherID, allowedGID, true},
+		{uint32(os.Geteuid()), otherID, true},
+		{otherID, otherID, false},
+	}
+
+	for _, test := range tests {
+		if l.Allowed(test.uid, test.gid) != test.allowed {
+			t.Errorf("expected uid %d and gid %d to be allowed: %v", test.uid, test.gid, test.allowed)
+		}
+	}
+}
@@ -1,80 +1,127 @@
 package incognitomail
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
+	"net/mail"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/valyala/gorpc"
-	"golang.org/x/net/websocket"
+	"golang.org/x/crypto/acme/autocert"
 	"gopkg.in/tylerb/graceful.v1"
 )
 
-// Server holds all the data required to run the server.
+// Server runs a Service as a daemon: it holds the lock file, listens for websocket, API and RPC connections, handles signals and reloads the configuration.
 type Server struct {
-	lockFileHandle *os.File
+	*Service
 
-	persistence      *IncognitoData
-	mailSystemWriter MailSystemHandleWriter
-	commandCh        chan interface{}
-	signalCh         chan os.Signal
+	lockFileHandle *os.File
+	certificates   *certificateProvider
+	signalCh       chan os.Signal
 
-	httpServer *graceful.Server
-	rpcServer  *gorpc.Server
+	httpServer    *graceful.Server
+	metricsServer *graceful.Server
+	acmeServer    *graceful.Server
+	rpcServer     *gorpc.Server
 
-	started  bool
+	stopOnce sync.Once
 	finishCh chan bool
 }
 
 // MailSystemHandleWriter has methods for adding and removing mappings from the mail system.
 type MailSystemHandleWriter interface {
-	AddHandle(string, string) (string, error)
+	// AddHandle maps the handle to the given targets, returning the complete email address for the handle.
+	AddHandle(string, []string) (string, error)
 	RemoveHandle(string) error
+
+	// Preflight checks if the mail system can be changed with the current permissions, returning an error that describes every problem found.
+	Preflight() error
+
+	// Writable is a lighter version of Preflight, only checking if the files changed by the writer can still be written. Meant to be called often while the server runs.
+	Writable() error
 }
 
 type newHandleCommand struct {
 	source        string
+	remoteAddr    string
 	accountSecret string
-	resultCh      chan string
-	errorCh       chan error
+	targets       []string
 }
 
 type newAccountCommand struct {
-	source   string
-	target   string
-	resultCh chan string
-	errorCh  chan error
+	source     string
+	remoteAddr string
+	targets    []string
+	inviteCode string
+}
+
+type newInviteCommand struct {
+	source     string
+	remoteAddr string
+}
+
+type deleteInviteCommand struct {
+	source     string
+	remoteAddr string
+	code       string
 }
 
 type deleteHandleCommand struct {
-	source   string
-	handle   string
-	secret   string
-	resultCh chan string
-	errorCh  chan error
+	source     string
+	remoteAddr string
+	handle     string
+	secret     string
+}
+
+type confirmTargetCommand struct {
+	source     string
+	remoteAddr string
+	secret     string
+	token      string
+}
+
+type listHandlesCommand struct {
+	source     string
+	remoteAddr string
+	secret     string
 }
 
 type deleteAccountCommand struct {
-	source   string
-	secret   string
-	resultCh chan string
-	errorCh  chan error
+	source     string
+	remoteAddr string
+	secret     string
 }
 
-type terminateCommand struct{}
+type listInvitesCommand struct {
+	source     string
+	remoteAddr string
+}
+
+type auditLogCommand struct {
+	source     string
+	remoteAddr string
+	secret     string
+}
 
 const (
 	accountSecretSize = 64
 	handleSize        = 18
+	maxTargets        = 10
+	accountIDSize     = 8
 
-	commandQueue                  = 10
 	httpServerTimeout             = 10 * time.Second
 	httpServerTCPKeepAliveTimeout = 3 * time.Minute
 )
@@ -98,35 +145,69 @@ var (
 	// ErrWrongCommand is used when a known command is received, but is malformed.
 	ErrWrongCommand = errors.New("wrong command usage")
 
-	// ErrInvalidPermission is used when a command has been received from the websocket, but the server shouldn't execute it.
+	// ErrInvalidPermission is used when a command has been received, but the permissions for its source don't allow the server to execute it.
 	ErrInvalidPermission = errors.New("invalid permission to do this")
+
+	// ErrInvalidTarget is used when a target can't be safely written to the mail system.
+	ErrInvalidTarget = errors.New("invalid target")
+
+	// ErrTooManyTargets is used when more than maxTargets targets are given for an account or handle.
+	ErrTooManyTargets = errors.New("too many targets")
+
+	// ErrServerStopping is used when a command is received while the server is stopping.
+	ErrServerStopping = errors.New("server is stopping")
+
+	// ErrCommandTimeout is used when a command takes longer than the configured timeout to start.
+	ErrCommandTimeout = errors.New("command timed out")
+
+	// ErrCommandCancelled is used when a command is cancelled by its client before it starts, e.g. because the connection was closed.
+	ErrCommandCancelled = errors.New("command cancelled")
+
+	// ErrAccountPending is used when an action requires an active account, but some of the account's targets haven't been confirmed yet.
+	ErrAccountPending = errors.New("account is waiting for target confirmation")
+
+	// ErrTargetNotConfirmed is used when target verification is enabled and a handle is created with targets that aren't confirmed targets of its account.
+	ErrTargetNotConfirmed = errors.New("target not confirmed")
 )
 
-func mailSystemWriterFromConfig() MailSystemHandleWriter {
-	switch Config.General.MailSystem {
+// mailSystemWriterFromConfig returns the writer for the mail system in the configuration, recording its metrics in m.
+func mailSystemWriterFromConfig(c *Configuration, m *serviceMetrics) MailSystemHandleWriter {
+	switch c.General.MailSystem {
 	case "postfix":
-		return NewPostfixWriter()
+		p := NewPostfixWriter(c.PostfixConfig)
+		p.postmapDuration = m.postmapDuration
+		return p
 	}
 
 	return nil
 }
 
-// NewServer returns an IncognitoMailServer object ready for use.
-func NewServer() (*Server, error) {
-	server := &Server{
-		mailSystemWriter: mailSystemWriterFromConfig(),
-		commandCh:        make(chan interface{}, commandQueue),
-		signalCh:         make(chan os.Signal, 1),
+// NewServer returns an IncognitoMailServer object ready for use, with a copy of the given configuration. If the configuration is nil, a copy of the global Config is used instead.
+// Several servers can run in the same process, each with its own metrics, but the logger is shared by all of them, so reloading one with new [Logging] settings changes the logging of every server.
+func NewServer(c *Configuration) (*Server, error) {
+	if c == nil {
+		c = &Config
 	}
 
-	data, err := OpenIncognitoData()
+	service, err := newService(c)
 	if err != nil {
 		return nil, err
 	}
 
-	server.persistence = data
+	server := &Server{
+		Service:      service,
+		signalCh:     make(chan os.Signal, 1),
+		finishCh:     make(chan bool),
+		certificates: &certificateProvider{},
+	}
+
+	service.readyChecks = map[string]func() error{
+		"lock": server.checkLockFile,
+	}
+
 	err = server.getLockFile()
 	if err != nil {
+		service.Close()
 		return nil, err
 	}
 
@@ -138,12 +219,14 @@ func (s *Server) getLockFile() error {
 		return ErrLockFileAlreadyExists
 	}
 
-	err := os.MkdirAll(filepath.Dir(Config.General.LockFilePath), os.FileMode(0755))
+	path := s.currentConfig().General.LockFilePath
+
+	err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755))
 	if err != nil {
 		return err
 	}
 
-	file, err := os.OpenFile(Config.General.LockFilePath, os.O_CREATE|os.O_RDWR, os.FileMode(0644))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, os.FileMode(0644))
 	if err != nil {
 		return err
 	}
@@ -172,10 +255,12 @@ func (s *Server) removeLockFile() error {
 
 	s.lockFileHandle.Close()
 
-	err = os.Remove(Config.General.LockFilePath)
+	path := s.currentConfig().General.LockFilePath
+
+	err = os.Remove(path)
 	if err != nil {
 		// If the lock file stays in the system, we won't have a problem when executing the program again, so just log the occurrence.
-		log.Printf("[DEBUG] Could not remove lock file in %s\n", Config.General.LockFilePath)
+		logEntry(logLevelDebug, "Could not remove lock file", logFields{"path": path, "error": err})
 	}
 
 	s.lockFileHandle = nil
@@ -185,10 +270,19 @@ func (s *Server) removeLockFile() error {
 // startRPCListener starts the RPC service for communication between the running incognito server and any other processes.
 func (s *Server) startRPCListener() error {
 	d := gorpc.NewDispatcher()
-	d.AddService("IncognitoRPCService", s)
+	d.AddService(rpcServiceName, &rpcService{server: s})
+
+	config := s.currentConfig()
+
+	listener, err := newRPCListenerFromConfig(config.RPC)
+	if err != nil {
+		return err
+	}
+
+	server := gorpc.NewUnixServer(config.General.UnixSockPath, d.NewHandlerFunc())
+	server.Listener = listener
 
-	server := gorpc.NewUnixServer(Config.General.UnixSockPath, d.NewHandlerFunc())
-	err := server.Start()
+	err = server.Start()
 	if err != nil {
 		return err
 	}
@@ -199,91 +293,228 @@ func (s *Server) startRPCListener() error {
 
 // Start begins listening for websocket connections (external requests) and RPC calls (internal requests).
 func (s *Server) Start() {
+	s.stopMu.Lock()
 	if s.started {
+		s.stopMu.Unlock()
 		return
 	}
 
 	s.started = true
+	s.stopMu.Unlock()
 
-	signal.Notify(s.signalCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(s.signalCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go handleSignals(s)
 
+	// Listening addresses and TLS settings are only read when starting, so they're all taken from the same configuration
+	config := s.currentConfig()
+
 	err := s.startRPCListener()
 	if err != nil {
-		log.Fatal(err)
+		logFatal(err)
 	}
 
-	go handleCommands(s)
-
 	mux := http.NewServeMux()
+	mux.Handle("/", s.Handler())
 
-	// We listen for websocket connection this way to avoid receiving an 403 when connecting from the localhost (or anything that passes a "null" Origin header)
-	mux.HandleFunc(Config.General.ListenPath, func(w http.ResponseWriter, req *http.Request) {
-		server := websocket.Server{Handler: websocket.Handler(func(ws *websocket.Conn) {
-			var args string
+	if config.Metrics.Enabled && config.Metrics.ListenAddress != "" {
+		s.startMetricsServer()
+	}
 
-			err := websocket.Message.Receive(ws, &args)
-			if err != nil {
-				log.Printf("[DEBUG] Error receiving command from websocket: %s\n", err)
-				websocket.Message.Send(ws, "error receiving command")
-				return
+	srv := &graceful.Server{
+		Timeout:          httpServerTimeout,
+		TCPKeepAlive:     httpServerTCPKeepAliveTimeout,
+		NoSignalHandling: true,
+		Server: &http.Server{
+			Addr:    config.General.ListenAddress,
+			Handler: mux,
+		},
+	}
+
+	s.stopMu.Lock()
+	s.httpServer = srv
+	s.stopMu.Unlock()
+
+	if config.ACME.Enabled {
+		var m *autocert.Manager
+		m, err = newACMEManagerFromConfig(config.ACME)
+		if err == nil {
+			if config.ACME.HTTPAddress != "" {
+				s.startACMEChallengeServer(m)
 			}
 
-			result, err := s.SendCommand("websocket", args)
-			if err != nil {
-				websocket.Message.Send(ws, "error "+err.Error())
-				return
+			tlsConfig := m.TLSConfig()
+			err = applyTLSPolicy(tlsConfig, config.General)
+			if err == nil {
+				err = srv.ListenAndServeTLSConfig(tlsConfig)
 			}
+		}
+	} else if config.tlsEnabled() {
+		// Serving the certificate through the provider, so it can be replaced when the files change or when reloading the configuration
+		tlsConfig := &tls.Config{GetCertificate: s.certificates.getCertificate}
 
-			websocket.Message.Send(ws, result)
-		})}
+		err = s.certificates.load(config.General.TLSCertFile, config.General.TLSKeyFile)
+		if err == nil {
+			err = applyTLSPolicy(tlsConfig, config.General)
+		}
+
+		if err == nil {
+			go s.watchCertificates(config.certificateCheckInterval())
+			err = srv.ListenAndServeTLSConfig(tlsConfig)
+		}
+	} else {
+		err = srv.ListenAndServe()
+	}
 
-		server.ServeHTTP(w, req)
-	})
+	if err != nil {
+		logFatal(err)
+	}
+}
+
+// startMetricsServer starts listening for metrics requests in their own address, so they can be kept away from the public websocket and REST API.
+func (s *Server) startMetricsServer() {
+	config := s.currentConfig()
+
+	mux := http.NewServeMux()
+	mux.Handle(config.Metrics.Path, newMetricsHandler(s.Service))
 
 	srv := &graceful.Server{
-		Timeout:      httpServerTimeout,
-		TCPKeepAlive: httpServerTCPKeepAliveTimeout,
+		Timeout:          httpServerTimeout,
+		TCPKeepAlive:     httpServerTCPKeepAliveTimeout,
+		NoSignalHandling: true,
 		Server: &http.Server{
-			Addr:    Config.General.ListenAddress,
+			Addr:    config.Metrics.ListenAddress,
 			Handler: mux,
 		},
 	}
 
-	s.httpServer = srv
+	s.stopMu.Lock()
+	s.metricsServer = srv
+	s.stopMu.Unlock()
 
-	if Config.General.TLSCertFile != "" && Config.General.TLSKeyFile != "" {
-		err = srv.ListenAndServeTLS(Config.General.TLSCertFile, Config.General.TLSKeyFile)
-	} else {
-		err = srv.ListenAndServe()
-	}
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil {
+			logFatal(err)
+		}
+	}()
+}
 
-	if err != nil {
-		log.Fatal(err)
+// startACMEChallengeServer starts answering the HTTP challenges sent by the ACME directory before issuing certificates. Any other request is redirected to HTTPS.
+func (s *Server) startACMEChallengeServer(m *autocert.Manager) {
+	srv := &graceful.Server{
+		Timeout:          httpServerTimeout,
+		TCPKeepAlive:     httpServerTCPKeepAliveTimeout,
+		NoSignalHandling: true,
+		Server: &http.Server{
+			Addr:    s.currentConfig().ACME.HTTPAddress,
+			Handler: m.HTTPHandler(nil),
+		},
 	}
+
+	s.stopMu.Lock()
+	s.acmeServer = srv
+	s.stopMu.Unlock()
+
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil {
+			logFatal(err)
+		}
+	}()
+}
+
+// Stop stops the server in order: new connections and commands are refused, running commands are given up to the drain timeout to finish, then the mail system, the database, the audit log and the lock file are closed. Calling Stop more than once has no effect, and every call returns only after the server stopped.
+func (s *Server) Stop() {
+	s.stopOnce.Do(s.shutdown)
+}
+
+// Close is the same as Stop, so the lock file and the listeners are released along with the Service.
+func (s *Server) Close() {
+	s.Stop()
 }
 
-// stopAllButHTTPServer is an utility for stopping everything else besides the http server (read the docs for handleSignals for an explanation).
-func (s *Server) stopAllButHTTPServer() {
-	s.rpcServer.Stop()
-	s.commandCh <- terminateCommand{}
-	s.persistence.Close()
+// shutdown does the work of Stop, and must only be called once.
+func (s *Server) shutdown() {
+	logEntry(logLevelInfo, "Stopping server", nil)
+
+	// Refusing any new command first, so nothing new starts while the listeners are closed
+	s.stopMu.Lock()
+	s.stopping = true
+	httpServer, metricsServer, acmeServer := s.httpServer, s.metricsServer, s.acmeServer
+	s.stopMu.Unlock()
+
+	if s.rpcServer != nil {
+		s.rpcServer.Stop()
+	}
+
+	if httpServer != nil {
+		httpServer.Stop(httpServerTimeout)
+	}
+
+	if metricsServer != nil {
+		metricsServer.Stop(httpServerTimeout)
+	}
+
+	if acmeServer != nil {
+		acmeServer.Stop(httpServerTimeout)
+	}
+
+	s.Service.Close()
+
+	logEntry(logLevelInfo, "Terminating server", nil)
+
 	s.removeLockFile()
+
+	// Waiting for the http servers to finish their connections
+	if httpServer != nil {
+		<-httpServer.StopChan()
+	}
+
+	if metricsServer != nil {
+		<-metricsServer.StopChan()
+	}
+
+	if acmeServer != nil {
+		<-acmeServer.StopChan()
+	}
+
+	close(s.finishCh)
 }
 
-// Stop will stop everything from a running server
-func (s *Server) Stop() {
-	s.stopAllButHTTPServer()
-	s.httpServer.Stop(httpServerTimeout)
+// drainCommands waits for all running commands to finish, or until ctx is done. Returns a channel closed once they finish, even if that happens after ctx is done.
+func (s *Service) drainCommands(ctx context.Context) <-chan struct{} {
+	done := make(chan struct{})
+
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logEntry(logLevelInfo, "Gave up waiting for running commands, the database will be closed once they finish", logFields{"timeout": s.currentConfig().drainTimeout().String()})
+	}
+
+	return done
+}
+
+// Config returns a copy of the configuration currently used by the server, which changes when reloading.
+func (s *Service) Config() Configuration {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
 
-	// Waiting for the http server to stop
-	<-s.httpServer.StopChan()
+	return *s.currentConfig().clone()
 }
 
-// Wait blocks until the server has finished executing. If the server wasn't started, it returns an error instead.
+// Wait blocks until the server has stopped. If the server wasn't started, it returns an error instead.
 func (s *Server) Wait() error {
-	if s.finishCh == nil {
+	s.stopMu.RLock()
+	started := s.started
+	s.stopMu.RUnlock()
+
+	if !started {
 		return ErrServerNotStarted
 	}
 
@@ -291,165 +522,665 @@ func (s *Server) Wait() error {
 	return nil
 }
 
-// SendCommand is executed for every message received either by the websocket or RPC interface. Builds a well-defined command to send to the goroutine listening for commands to execute.
-func (s *Server) SendCommand(source, args string) (string, error) {
+// SendCommand executes a command as if received by the RPC interface, with clientAddr being the address of the RPC client. It's the same as SendCommandContext with a background context, so only the command timeout applies.
+func (s *Service) SendCommand(clientAddr, args string) (string, error) {
+	return s.SendCommandContext(context.Background(), sourceRPC, clientAddr, args)
+}
+
+// SendCommandContext is executed for every message received by the websocket or RPC interface. Builds a well-defined command and executes it. The source ("websocket", "http" or "rpc") and remote address are used to check permissions, and ctx can cancel the command before it changes anything.
+// Never blocks longer than the command timeout. Returns ErrServerNotStarted if the server wasn't started yet, and ErrServerStopping once it started stopping.
+func (s *Service) SendCommandContext(ctx context.Context, source, remoteAddr, args string) (string, error) {
+	cmd, err := parseCommand(source, remoteAddr, args)
+	if err != nil {
+		// Commands that can't be parsed never reach runCommand, so they are only counted here
+		s.metrics.recordInvalidCommand(source, err)
+		return "", err
+	}
+
+	res, err := s.runCommand(ctx, source, remoteAddr, cmd)
+	if err != nil {
+		return "", err
+	}
+
+	return formatCommandResult(res)
+}
+
+// formatCommandResult turns the result of a command into the text sent back to the command line and the websocket: lists have one item per line, and audit log entries are sent as JSON since they have more structure than a line of text.
+func formatCommandResult(res interface{}) (string, error) {
+	switch t := res.(type) {
+	case string:
+		return t, nil
+	case []string:
+		return strings.Join(t, "\n"), nil
+	case []AuditEntry:
+		b, err := json.Marshal(t)
+		return string(b), err
+	}
+
+	return fmt.Sprintf("%v", res), nil
+}
+
+// parseCommand builds a well-defined command from the arguments typed in the command line, returning an error if they don't form a known command.
+func parseCommand(source, remoteAddr, args string) (interface{}, error) {
 	c := strings.Fields(args)
 	if len(c) == 0 {
-		return "", ErrEmptyCommand
+		return nil, ErrEmptyCommand
 	}
 
 	command := c[0]
 	// c[1:] works even if len(c) == 1, and in this case it's just an empty slice
 	extra := c[1:]
 
-	// It is important to make buffered channels, because we'll send values and close them afterwards
-	resultCh := make(chan string, 1)
-	errorCh := make(chan error, 1)
+	var cmd interface{}
 
 	switch command {
 	case "new":
-		if len(extra) != 2 {
-			return "", ErrWrongCommand
+		if len(extra) < 2 {
+			return nil, ErrWrongCommand
 		}
 
 		switch extra[0] {
 		case "handle":
-			s.commandCh <- newHandleCommand{
+			cmd = newHandleCommand{
 				source:        source,
+				remoteAddr:    remoteAddr,
 				accountSecret: extra[1],
-				resultCh:      resultCh,
-				errorCh:       errorCh,
+				targets:       extra[2:],
 			}
 		case "account":
-			s.commandCh <- newAccountCommand{
-				source:   source,
-				target:   extra[1],
-				resultCh: resultCh,
-				errorCh:  errorCh,
+			var inviteCode string
+			targets := extra[1:]
+
+			// Accounts created with an invite code use "new account invite <code> <address>..."
+			if targets[0] == "invite" {
+				if len(targets) < 3 {
+					return nil, ErrWrongCommand
+				}
+
+				inviteCode = targets[1]
+				targets = targets[2:]
+			}
+
+			cmd = newAccountCommand{
+				source:     source,
+				remoteAddr: remoteAddr,
+				targets:    targets,
+				inviteCode: inviteCode,
 			}
 		default:
-			log.Printf("[DEBUG] received unknown 'new' option: %s\n", args)
-			return "", ErrWrongCommand
+			logEntry(logLevelDebug, "Received unknown 'new' option", logFields{"args": args})
+			return nil, ErrWrongCommand
 		}
 	case "delete":
 		if len(extra) < 1 {
-			return "", ErrWrongCommand
+			return nil, ErrWrongCommand
 		}
 
 		switch extra[0] {
 		case "handle":
 			if len(extra) != 3 {
-				return "", ErrWrongCommand
+				return nil, ErrWrongCommand
 			}
 
-			s.commandCh <- deleteHandleCommand{
-				source:   source,
-				handle:   extra[1],
-				secret:   extra[2],
-				resultCh: resultCh,
-				errorCh:  errorCh,
+			cmd = deleteHandleCommand{
+				source:     source,
+				remoteAddr: remoteAddr,
+				handle:     extra[1],
+				secret:     extra[2],
 			}
 		case "account":
 			if len(extra) != 2 {
-				return "", ErrWrongCommand
+				return nil, ErrWrongCommand
+			}
+
+			cmd = deleteAccountCommand{
+				source:     source,
+				remoteAddr: remoteAddr,
+				secret:     extra[1],
+			}
+		default:
+			logEntry(logLevelDebug, "Received unknown 'delete' option", logFields{"args": args})
+			return nil, ErrWrongCommand
+		}
+	case "list":
+		if len(extra) != 1 {
+			return nil, ErrWrongCommand
+		}
+
+		cmd = listHandlesCommand{
+			source:     source,
+			remoteAddr: remoteAddr,
+			secret:     extra[0],
+		}
+	case "invite":
+		if len(extra) < 1 {
+			return nil, ErrWrongCommand
+		}
+
+		switch extra[0] {
+		case "new":
+			if len(extra) != 1 {
+				return nil, ErrWrongCommand
+			}
+
+			cmd = newInviteCommand{
+				source:     source,
+				remoteAddr: remoteAddr,
+			}
+		case "delete":
+			if len(extra) != 2 {
+				return nil, ErrWrongCommand
 			}
 
-			s.commandCh <- deleteAccountCommand{
-				source:   source,
-				secret:   extra[1],
-				resultCh: resultCh,
-				errorCh:  errorCh,
+			cmd = deleteInviteCommand{
+				source:     source,
+				remoteAddr: remoteAddr,
+				code:       extra[1],
 			}
+		default:
+			logEntry(logLevelDebug, "Received unknown 'invite' option", logFields{"args": args})
+			return nil, ErrWrongCommand
+		}
+	case "confirm":
+		if len(extra) != 2 {
+			return nil, ErrWrongCommand
+		}
+
+		cmd = confirmTargetCommand{
+			source:     source,
+			remoteAddr: remoteAddr,
+			secret:     extra[0],
+			token:      extra[1],
 		}
 	default:
-		log.Printf("[DEBUG] received unknown command %s\n", args)
-		return "", ErrUnknownCommand
+		logEntry(logLevelDebug, "Received unknown command", logFields{"args": args})
+		return nil, ErrUnknownCommand
 	}
 
-	return <-resultCh, <-errorCh
+	return cmd, nil
 }
 
-// Receives any command that needs to be executed, and executes them.
-func handleCommands(s *Server) {
-	for {
-		command := <-s.commandCh
-
-		var res string
-		var err error
-		var resCh chan string
-		var errCh chan error
-
-		switch t := command.(type) {
-		case terminateCommand:
-			log.Println("[INFO] Terminating server")
-			return
-		case newHandleCommand:
-			res, err = s.NewHandle(t.accountSecret)
-			resCh = t.resultCh
-			errCh = t.errorCh
-		case newAccountCommand:
-			// New accounts should be created locally only, at least at first
-			if t.source == "websocket" {
-				err = ErrInvalidPermission
-				res = ""
-			} else {
-				res, err = s.NewAccount(t.target)
-			}
+// runCommand executes an already built command in the calling goroutine, giving up if it takes longer than the configured timeout or if ctx is cancelled.
+// Commands from remote sources are refused if their remote address failed to authenticate too many times, and every failure is recorded.
+// Every command that changes accounts or handles is also written to the audit log, even if refused.
+// The result depends on the command: a string for the ones creating something or only reporting success, []string for lists and []AuditEntry for the audit log.
+func (s *Service) runCommand(ctx context.Context, source, remoteAddr string, command interface{}) (interface{}, error) {
+	var res interface{}
+	var err error
 
-			resCh = t.resultCh
-			errCh = t.errorCh
-		case deleteHandleCommand:
-			res = ""
-			if t.source == "websocket" {
-				err = ErrInvalidPermission
-			} else {
-				err = s.DeleteHandle(t.secret, t.handle)
-				if err == nil {
-					res = "success"
-				}
-			}
+	start := time.Now()
+
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+
+	config := s.currentConfig()
+	limited := s.authLimiter != nil && source != sourceRPC
+
+	ctx, cancel := context.WithTimeout(ctx, config.commandTimeout())
+	defer cancel()
 
-			resCh = t.resultCh
-			errCh = t.errorCh
-		case deleteAccountCommand:
-			res = ""
-			if t.source == "websocket" {
-				err = ErrInvalidPermission
-			} else {
-				err = s.DeleteAccount(t.secret)
-				if err == nil {
-					res = "success"
+	if limited {
+		err = s.authLimiter.check(remoteAddr)
+	}
+
+	if err == nil {
+		res, err = s.executeCommand(ctx, config, command)
+
+		if limited {
+			if isAuthFailure(err) {
+				if s.authLimiter.failure(remoteAddr, source) {
+					s.auditBan(source, remoteAddr)
 				}
+			} else if err == nil && commandSecret(command) != "" {
+				// Only commands that prove the knowledge of a secret forget previous failures, otherwise anyone could reset the count with commands that don't need one
+				s.authLimiter.success(remoteAddr)
 			}
+		}
+	}
 
-			resCh = t.resultCh
-			errCh = t.errorCh
-		default:
-			log.Printf("[DEBUG] unrecognized command %v\n", t)
-			continue
+	s.auditCommand(source, remoteAddr, command, res, err)
+
+	fields := logFields{
+		"command":    commandName(command),
+		"source":     source,
+		"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	if remoteAddr != "" {
+		fields["remote_addr"] = remoteAddr
+	}
+	if handle := commandHandle(command, res, err); handle != "" {
+		fields["handle"] = handle
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	logEntry(logLevelInfo, "Executed command", fields)
+	s.metrics.recordCommand(command, source, start, err)
+
+	return res, err
+}
+
+// commandSecret returns the account secret used by the command, or an empty string if the command doesn't act on an account.
+func commandSecret(command interface{}) string {
+	switch t := command.(type) {
+	case newHandleCommand:
+		return t.accountSecret
+	case deleteHandleCommand:
+		return t.secret
+	case listHandlesCommand:
+		return t.secret
+	case confirmTargetCommand:
+		return t.secret
+	case deleteAccountCommand:
+		return t.secret
+	case auditLogCommand:
+		return t.secret
+	}
+
+	return ""
+}
+
+// commandName returns the name of the command as typed in the command line, e.g. "new handle".
+func commandName(command interface{}) string {
+	switch command.(type) {
+	case newHandleCommand:
+		return "new handle"
+	case newAccountCommand:
+		return "new account"
+	case deleteHandleCommand:
+		return "delete handle"
+	case deleteAccountCommand:
+		return "delete account"
+	case listHandlesCommand:
+		return "list"
+	case confirmTargetCommand:
+		return "confirm"
+	case newInviteCommand:
+		return "invite new"
+	case deleteInviteCommand:
+		return "invite delete"
+	case listInvitesCommand:
+		return "invite list"
+	case auditLogCommand:
+		return "audit"
+	}
+
+	return ""
+}
+
+// commandHandle returns the handle the command acted on, if any, without the domain, so entries for the same handle always match. res and err are the results of the command.
+func commandHandle(command interface{}, res interface{}, err error) string {
+	switch t := command.(type) {
+	case newHandleCommand:
+		if handle, ok := res.(string); ok && err == nil {
+			return bareHandle(handle)
 		}
+	case deleteHandleCommand:
+		return bareHandle(t.handle)
+	}
 
-		errCh <- err
-		resCh <- res
-		close(errCh)
-		close(resCh)
+	return ""
+}
+
+// bareHandle returns the handle without the domain, if the domain was given.
+func bareHandle(handle string) string {
+	if i := strings.LastIndex(handle, "@"); i >= 0 {
+		return handle[:i]
 	}
+
+	return handle
+}
+
+// executeCommand executes the command if the permissions in config allow it. Commands that change the mail system wait for any other such command to finish first, and those that only read data are executed right away.
+// The command is refused if the server is stopping, and cancelled if ctx is done before it starts changing anything. Once a change starts, it's carried through so the database and the mail system don't disagree.
+func (s *Service) executeCommand(ctx context.Context, config *Configuration, command interface{}) (interface{}, error) {
+	err := s.beginCommand()
+	if err != nil {
+		return nil, err
+	}
+	defer s.running.Done()
+
+	var res interface{}
+
+	switch t := command.(type) {
+	case newHandleCommand:
+		if !config.allowed(t.source, t.remoteAddr, t.accountSecret, permissionNewHandle) {
+			return nil, ErrInvalidPermission
+		}
+
+		err = s.lockMailSystem(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer s.unlockMailSystem()
+
+		res, err = s.newHandle(t.accountSecret, t.targets...)
+	case newAccountCommand:
+		if !config.allowed(t.source, t.remoteAddr, "", permissionNewAccount) {
+			return nil, ErrInvalidPermission
+		}
+
+		if t.source != sourceRPC {
+			// New accounts from anywhere but the local RPC socket are only created if the signup policy allows it
+			err = s.checkSignupPolicy(config, t.targets, t.inviteCode)
+		}
+
+		if err == nil {
+			err = contextError(ctx)
+		}
+
+		// Claiming the invite code before creating the account, so two commands running at the same time can't both use it
+		claimed := false
+		if err == nil && t.source != sourceRPC && config.Signup.Policy == signupPolicyInvite {
+			err = s.persistence.DeleteInvite(t.inviteCode)
+			claimed = err == nil
+		}
+
+		if err == nil {
+			res, err = s.newAccount(t.targets...)
+		}
+
+		// Giving the invite code back if the account couldn't be created, so a failure doesn't waste it
+		if err != nil && claimed {
+			s.persistence.NewInvite(t.inviteCode)
+		}
+	case newInviteCommand:
+		if !config.allowed(t.source, t.remoteAddr, "", permissionNewInvite) {
+			return nil, ErrInvalidPermission
+		}
+
+		err = contextError(ctx)
+		if err == nil {
+			res, err = s.newInvite()
+		}
+	case deleteInviteCommand:
+		if !config.allowed(t.source, t.remoteAddr, "", permissionDeleteInvite) {
+			return nil, ErrInvalidPermission
+		}
+
+		err = contextError(ctx)
+		if err == nil {
+			err = s.deleteInvite(t.code)
+		}
+
+		if err == nil {
+			res = "success"
+		}
+	case deleteHandleCommand:
+		if !config.allowed(t.source, t.remoteAddr, t.secret, permissionDeleteHandle) {
+			return nil, ErrInvalidPermission
+		}
+
+		err = s.lockMailSystem(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer s.unlockMailSystem()
+
+		err = s.deleteHandle(t.secret, t.handle)
+		if err == nil {
+			res = "success"
+		}
+	case listHandlesCommand:
+		if !config.allowed(t.source, t.remoteAddr, t.secret, permissionListHandles) {
+			return nil, ErrInvalidPermission
+		}
+
+		res, err = s.listHandles(t.secret)
+	case confirmTargetCommand:
+		if !config.allowed(t.source, t.remoteAddr, t.secret, permissionConfirmTarget) {
+			return nil, ErrInvalidPermission
+		}
+
+		err = contextError(ctx)
+		if err == nil {
+			err = s.confirmTarget(t.secret, t.token)
+		}
+
+		if err == nil {
+			res = "success"
+		}
+	case deleteAccountCommand:
+		if !config.allowed(t.source, t.remoteAddr, t.secret, permissionDeleteAccount) {
+			return nil, ErrInvalidPermission
+		}
+
+		err = s.lockMailSystem(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer s.unlockMailSystem()
+
+		err = s.deleteAccount(t.secret)
+		if err == nil {
+			res = "success"
+		}
+	case listInvitesCommand:
+		if !config.allowed(t.source, t.remoteAddr, "", permissionListInvites) {
+			return nil, ErrInvalidPermission
+		}
+
+		res, err = s.listInvites()
+	case auditLogCommand:
+		if !config.allowed(t.source, t.remoteAddr, t.secret, permissionAuditLog) {
+			return nil, ErrInvalidPermission
+		}
+
+		res, err = s.auditEntries(t.secret)
+	default:
+		logEntry(logLevelDebug, "Unrecognized command", logFields{"command": fmt.Sprintf("%v", t)})
+		return nil, ErrUnknownCommand
+	}
+
+	return res, err
+}
+
+// beginCommand registers a new running command, returning an error if the server isn't running and no new commands should be executed.
+func (s *Service) beginCommand() error {
+	s.stopMu.RLock()
+	defer s.stopMu.RUnlock()
+
+	if !s.started {
+		return ErrServerNotStarted
+	}
+
+	if s.stopping {
+		return ErrServerStopping
+	}
+
+	s.running.Add(1)
+	return nil
+}
+
+// lockMailSystem waits until no other command is changing the mail system, or until ctx is done. A done ctx always returns an error, even if the mail system is free.
+func (s *Service) lockMailSystem(ctx context.Context) error {
+	// select picks at random when both cases are ready, so a cancelled command could otherwise still get the lock
+	err := contextError(ctx)
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&s.waitingCommands, 1)
+	defer atomic.AddInt64(&s.waitingCommands, -1)
+
+	select {
+	case s.mailSystemLock <- struct{}{}:
+		atomic.StoreInt64(&s.mailSystemLockedAt, time.Now().UnixNano())
+		return nil
+	case <-ctx.Done():
+		return contextError(ctx)
+	}
+}
+
+// unlockMailSystem lets the next command waiting in lockMailSystem change the mail system.
+func (s *Service) unlockMailSystem() {
+	atomic.StoreInt64(&s.mailSystemLockedAt, 0)
+	<-s.mailSystemLock
+}
+
+// contextError translates the error of a done context to one that can be shown to users, or returns nil if ctx is not done yet.
+func contextError(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return ErrCommandTimeout
+	default:
+		return ErrCommandCancelled
+	}
+}
+
+// drainTimeout returns the maximum time to wait for running commands when stopping, as configured.
+func (c *Configuration) drainTimeout() time.Duration {
+	// Already checked when validating the config
+	d, _ := time.ParseDuration(c.General.DrainTimeout)
+	return d
+}
+
+// commandTimeout returns the maximum time a command may take, as configured.
+func (c *Configuration) commandTimeout() time.Duration {
+	// Already checked when validating the config
+	d, _ := time.ParseDuration(c.General.CommandTimeout)
+	return d
 }
 
 func handleSignals(s *Server) {
-	<-s.signalCh
+	for sig := range s.signalCh {
+		logEntry(logLevelInfo, "Received signal", logFields{"signal": sig.String()})
+
+		if sig == syscall.SIGHUP {
+			// Errors are already logged by Reload
+			s.Reload()
+			continue
+		}
+
+		// The http servers don't handle signals themselves, so everything stops in the same order as with Stop
+		s.Stop()
+		return
+	}
+}
+
+// validateTargets returns an error if the list of targets is empty, too long, or contains any target that would break the map file. Duplicated targets are removed from the returned list.
+func validateTargets(targets []string) ([]string, error) {
+	if len(targets) == 0 {
+		return nil, ErrEmptyTarget
+	}
+
+	if len(targets) > maxTargets {
+		return nil, ErrTooManyTargets
+	}
+
+	seen := make(map[string]bool)
+	var result []string
+
+	for _, t := range targets {
+		if t == "" {
+			return nil, ErrEmptyTarget
+		}
+
+		// Commas and whitespace separate recipients and keys in the map file, so they can't be part of a single target
+		if strings.ContainsAny(t, ", \t\r\n") {
+			return nil, ErrInvalidTarget
+		}
+
+		// Only bare addresses are accepted, so anything like "Name <address>" is refused as well
+		addr, err := mail.ParseAddress(t)
+		if err != nil || addr.Address != t {
+			return nil, ErrInvalidTarget
+		}
+
+		if !seen[t] {
+			seen[t] = true
+			result = append(result, t)
+		}
+	}
+
+	return result, nil
+}
+
+// containsString returns true if s is one of the given values.
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runLocalCommand executes the command as if received by the RPC interface, from a client without an address. Used by the exported methods, so they can't skip anything done for commands from other sources.
+func (s *Service) runLocalCommand(command interface{}) (interface{}, error) {
+	return s.runCommand(context.Background(), sourceRPC, "", command)
+}
+
+// NewHandle creates a new handle for the account with the given secret, returning it with the domain attached. If any targets are given, the handle forwards to them instead of the account targets. Same as the "new handle" command.
+func (s *Service) NewHandle(accountSecret string, targets ...string) (string, error) {
+	res, err := s.runLocalCommand(newHandleCommand{source: sourceRPC, accountSecret: accountSecret, targets: targets})
+	handle, _ := res.(string)
+	return handle, err
+}
+
+// NewAccount creates a new account with the given target email addresses and returns the secret. The signup policy doesn't apply, the same as for the "new account" command from the RPC interface.
+func (s *Service) NewAccount(targets ...string) (string, error) {
+	res, err := s.runLocalCommand(newAccountCommand{source: sourceRPC, targets: targets})
+	secret, _ := res.(string)
+	return secret, err
+}
+
+// ConfirmTarget confirms the target of the account with the given secret that received the given token. Same as the "confirm" command.
+func (s *Service) ConfirmTarget(secret, token string) error {
+	_, err := s.runLocalCommand(confirmTargetCommand{source: sourceRPC, secret: secret, token: token})
+	return err
+}
+
+// DeleteHandle deletes the given handle from the account with the given secret. Same as the "delete handle" command.
+func (s *Service) DeleteHandle(secret, handle string) error {
+	_, err := s.runLocalCommand(deleteHandleCommand{source: sourceRPC, secret: secret, handle: handle})
+	return err
+}
+
+// DeleteAccount deletes all data from the account with the given secret. Same as the "delete account" command.
+func (s *Service) DeleteAccount(secret string) error {
+	_, err := s.runLocalCommand(deleteAccountCommand{source: sourceRPC, secret: secret})
+	return err
+}
 
-	// Upon receiving a signal, just stop. s.httpServer will also receive the signal, so stop everything but s.httpServer
-	s.stopAllButHTTPServer()
+// ListHandles returns all handles from the account with the given secret. Same as the "list" command.
+func (s *Service) ListHandles(secret string) ([]string, error) {
+	res, err := s.runLocalCommand(listHandlesCommand{source: sourceRPC, secret: secret})
+	handles, _ := res.([]string)
+	return handles, err
 }
 
-// NewHandle creates a new handle for the account with the given secret.
-func (s *Server) NewHandle(accountSecret string) (string, error) {
-	target, err := s.persistence.GetAccountTarget(accountSecret)
+// newHandle creates a new handle for the account with the given secret. If any targets are given, the handle forwards to them instead of the account targets. With target verification enabled, those targets must be confirmed targets of the account.
+// Changes the mail system, so it must only be called while holding the mail system lock.
+func (s *Service) newHandle(accountSecret string, targets ...string) (string, error) {
+	accountTargets, err := s.persistence.GetAccountTargets(accountSecret)
 	if err != nil {
 		return "", err
 	}
 
+	if s.persistence.HasPendingTargets(accountSecret) {
+		return "", ErrAccountPending
+	}
+
+	if len(targets) > 0 {
+		targets, err = validateTargets(targets)
+		if err != nil {
+			return "", err
+		}
+
+		// Without verification, handles could forward to addresses whose owners never agreed to receive anything
+		if s.verifier != nil {
+			for _, t := range targets {
+				if !containsString(accountTargets, t) {
+					return "", ErrTargetNotConfirmed
+				}
+			}
+		}
+	}
+
 	var newHandle string
 
 	// We'll keep looping until we find a handle that hasn't been used
@@ -464,24 +1195,33 @@ func (s *Server) NewHandle(accountSecret string) (string, error) {
 		}
 	}
 
-	err = s.persistence.NewAccountHandle(accountSecret, newHandle)
+	err = s.persistence.NewAccountHandle(accountSecret, newHandle, targets...)
 	if err != nil {
 		return "", err
 	}
 
+	if len(targets) == 0 {
+		targets = accountTargets
+	}
+
 	// fullHandle will have the domain attached, so it's the complete incognito email
-	fullHandle, err := s.mailSystemWriter.AddHandle(newHandle, target)
+	fullHandle, err := s.mailSystemWriter.AddHandle(newHandle, targets)
 	if err != nil {
+		s.metrics.mailSystemErrorsTotal.inc("add_handle")
 		return "", err
 	}
 
 	return fullHandle, nil
 }
 
-// NewAccount creates a new account with the given target email address and returns the secret.
-func (s *Server) NewAccount(target string) (string, error) {
+// newAccount creates a new account with the given target email addresses and returns the secret.
+func (s *Service) newAccount(targets ...string) (string, error) {
+	targets, err := validateTargets(targets)
+	if err != nil {
+		return "", err
+	}
+
 	var secret string
-	var err error
 
 	// We'll keep looping until we find an unused secret
 	for {
@@ -495,30 +1235,93 @@ func (s *Server) NewAccount(target string) (string, error) {
 		}
 	}
 
-	err = s.persistence.NewAccount(secret, target)
+	err = s.persistence.NewAccount(secret, targets...)
 	if err != nil {
 		return "", err
 	}
 
+	if s.verifier != nil {
+		err = s.requestConfirmation(secret, targets)
+		if err != nil {
+			// The account can't ever be confirmed, so it's better to not keep it around
+			s.persistence.DeleteAccount(secret)
+			return "", err
+		}
+	}
+
 	return secret, nil
 }
 
-// DeleteHandle deletes the given handle from the account with the given secret. If the account does not exist, it returns an error.
-func (s *Server) DeleteHandle(secret, handle string) error {
+// requestConfirmation marks all targets from the account with the given secret as pending, and sends each of them a different confirmation token.
+func (s *Service) requestConfirmation(secret string, targets []string) error {
+	tokens := make([]string, len(targets))
+
+	// All targets are marked as pending before sending anything, so the account can't be used while tokens are being sent
+	for i, target := range targets {
+		token, err := generateRandomString(confirmationTokenSize)
+		if err != nil {
+			return err
+		}
+
+		err = s.persistence.AddPendingTarget(secret, target, token)
+		if err != nil {
+			return err
+		}
+
+		tokens[i] = token
+	}
+
+	for i, target := range targets {
+		err := s.verifier.SendToken(target, tokens[i])
+		if err != nil {
+			logEntry(logLevelInfo, "Could not send confirmation token", logFields{"target": target, "error": err})
+			return err
+		}
+	}
+
+	return nil
+}
+
+// confirmTarget confirms the target of the account with the given secret that received the given token. Once all targets are confirmed, the account becomes active.
+func (s *Service) confirmTarget(secret, token string) error {
 	exists := s.persistence.HasAccount(secret)
 
 	if !exists {
 		return ErrAccountNotFound
 	}
 
+	return s.persistence.ConfirmPendingTarget(secret, token)
+}
+
+// deleteHandle deletes the given handle from the account with the given secret. If the account does not exist, or the handle doesn't belong to it, it returns an error.
+// Changes the mail system, so it must only be called while holding the mail system lock.
+func (s *Service) deleteHandle(secret, handle string) error {
+	exists := s.persistence.HasAccount(secret)
+
+	if !exists {
+		return ErrAccountNotFound
+	}
+
+	// Without this check, any account would be able to delete handles from other accounts
+	if !s.persistence.HasAccountHandle(secret, handle) {
+		return ErrHandleNotFound
+	}
+
+	// Same as DeleteAccount, only delete from the persistence system after removing from the mail system
+	err := s.mailSystemWriter.RemoveHandle(handle)
+	if err != nil {
+		s.metrics.mailSystemErrorsTotal.inc("remove_handle")
+		return err
+	}
+
 	s.persistence.DeleteAccountHandle(secret, handle)
-	s.mailSystemWriter.RemoveHandle(handle)
 
 	return nil
 }
 
-// DeleteAccount deletes all data from the account with the given secret. If the account does not exist, it returns an error.
-func (s *Server) DeleteAccount(secret string) error {
+// deleteAccount deletes all data from the account with the given secret. If the account does not exist, it returns an error.
+// Changes the mail system, so it must only be called while holding the mail system lock.
+func (s *Service) deleteAccount(secret string) error {
 	exists := s.persistence.HasAccount(secret)
 
 	if !exists {
@@ -534,6 +1337,7 @@ func (s *Server) DeleteAccount(secret string) error {
 	for _, handle := range handles {
 		err := s.mailSystemWriter.RemoveHandle(handle)
 		if err != nil {
+			s.metrics.mailSystemErrorsTotal.inc("remove_handle")
 			return err
 		}
 	}
@@ -544,8 +1348,8 @@ func (s *Server) DeleteAccount(secret string) error {
 	return nil
 }
 
-// ListHandles returns all handles from the account with the given secret.
-func (s *Server) ListHandles(secret string) ([]string, error) {
+// listHandles returns all handles from the account with the given secret.
+func (s *Service) listHandles(secret string) ([]string, error) {
 	exists := s.persistence.HasAccount(secret)
 
 	if !exists {
@@ -561,16 +1365,26 @@ func (s *Server) ListHandles(secret string) ([]string, error) {
 	return handles, nil
 }
 
-// CreateRPCServiceClient creates and returns a reasy to use RPC dispatcher client.
+// AccountID returns an identifier for the account with the given secret, which can be shown and stored anywhere without revealing the secret itself.
+func AccountID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:accountIDSize])
+}
+
+// CreateRPCServiceClient creates and returns a reasy to use RPC dispatcher client, connecting to the unix socket in the global Config.
 func CreateRPCServiceClient() *gorpc.DispatcherClient {
-	// Using an empty server struct is not a problem, we only want the methods
-	s := &Server{}
+	return NewRPCServiceClient(Config.General.UnixSockPath)
+}
+
+// NewRPCServiceClient creates and returns a ready to use RPC dispatcher client, connecting to the unix socket in the given path.
+func NewRPCServiceClient(sockPath string) *gorpc.DispatcherClient {
+	// Using an empty service struct is not a problem, we only want the methods
 	d := gorpc.NewDispatcher()
-	d.AddService("IncognitoRPCService", s)
+	d.AddService(rpcServiceName, &rpcService{})
 
-	c := gorpc.NewUnixClient(Config.General.UnixSockPath)
+	c := gorpc.NewUnixClient(sockPath)
 	c.Start()
 
-	dc := d.NewServiceClient("IncognitoRPCService", c)
+	dc := d.NewServiceClient(rpcServiceName, c)
 	return dc
 }
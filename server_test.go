@@ -0,0 +1,712 @@
+package incognitomail_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+// newTestServer returns a server created from newTestConfig, which is stopped once the test finishes. The server isn't started.
+func newTestServer(t *testing.T, configure func(*incognitomail.Configuration)) (*incognitomail.Server, string) {
+	config, dir := newTestConfig(t, configure)
+
+	server, err := incognitomail.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Stop)
+
+	return server, dir
+}
+
+// Ensure commands sent to a server that wasn't started fail right away instead of blocking.
+func TestServer_SendCommandContext_NotStarted(t *testing.T) {
+	t.Parallel()
+
+	server, _ := newTestServer(t, nil)
+
+	_, err := server.SendCommandContext(context.Background(), "rpc", "", "invite new")
+	if err != incognitomail.ErrServerNotStarted {
+		t.Errorf("expected ErrServerNotStarted, got %v", err)
+	}
+}
+
+// Ensure stopping releases the lock file, and that stopping again does nothing.
+func TestServer_Stop(t *testing.T) {
+	t.Parallel()
+
+	server, dir := newTestServer(t, nil)
+
+	server.Stop()
+	server.Stop()
+
+	_, err := os.Stat(filepath.Join(dir, "incognitomail.lock"))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected lock file to be removed, got %v", err)
+	}
+
+	err = server.Wait()
+	if err != incognitomail.ErrServerNotStarted {
+		t.Errorf("expected ErrServerNotStarted, got %v", err)
+	}
+}
+
+// writeConfigFile writes the given configuration to a file in dir and reads it.
+func writeConfigFile(t *testing.T, dir, contents string) string {
+	path := filepath.Join(dir, "incognitomail.conf")
+
+	err := ioutil.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// Ensure reloading applies new settings, including the mail system ones, keeps the ones that need a restart and refuses invalid configurations.
+func TestServer_Reload(t *testing.T) {
+	t.Parallel()
+
+	dir, postfix := postfixSetup(t, "")
+	defer postfixTeardown(t, dir)
+
+	base := "[General]\nSkipPreflightChecks = true\nLockFilePath = \"" + filepath.Join(dir, "incognitomail.lock") + "\"\n" +
+		"[Persistence]\nDatabasePath = \"" + filepath.Join(dir, "incognitomail.db") + "\"\n" +
+		"[PostfixConfig]\nPostmapPath = \"" + postfix.PostmapPath + "\"\nPostconfPath = \"" + postfix.PostconfPath + "\"\n"
+
+	config := incognitomail.DefaultConfiguration()
+	err := config.ReadFile(writeConfigFile(t, dir, base+"Domain = \"@sidhion.com\"\nMapFilePath = \""+postfix.MapFilePath+"\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := incognitomail.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	newMapFile := filepath.Join(dir, "virtual.new")
+	writeConfigFile(t, dir, base+"Domain = \"@example.com\"\nMapFilePath = \""+newMapFile+"\"\n[Signup]\nPolicy = \"open\"\n[General]\nListenAddress = \":9999\"\nMailSystem = \"postfix\"\n")
+
+	restart, err := server.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(restart) != 1 || restart[0] != "General.ListenAddress" {
+		t.Errorf("expected only General.ListenAddress to need a restart, got %v", restart)
+	}
+
+	if server.Config().Signup.Policy != "open" {
+		t.Errorf("expected signup policy to be reloaded, got %q", server.Config().Signup.Policy)
+	}
+
+	if server.Config().General.ListenAddress != ":8080" {
+		t.Errorf("expected listen address to be kept, got %q", server.Config().General.ListenAddress)
+	}
+
+	if config.Signup.Policy != "disabled" {
+		t.Errorf("expected the configuration given to the server to be left alone, got %q", config.Signup.Policy)
+	}
+
+	// New handles are written with the new domain, to the new map file
+	r := incognitomail.NewRPCService(server)
+
+	account, err := r.NewAccount("", incognitomail.NewAccountRequest{Targets: []string{accountTarget1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := r.NewHandle("", incognitomail.NewHandleRequest{Secret: account.Secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(handle.Handle, "@example.com") {
+		t.Errorf("expected the handle to use the new domain, got %q", handle.Handle)
+	}
+
+	newPostfix := postfix
+	newPostfix.MapFilePath = newMapFile
+	if !strings.Contains(readMap(t, newPostfix), handle.Handle) {
+		t.Errorf("expected the handle in the new map file, got %q", readMap(t, newPostfix))
+	}
+
+	_, err = os.Stat(postfix.MapFilePath)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the old map file to be left alone, got %v", err)
+	}
+
+	writeConfigFile(t, dir, base+"Domain = \"@example.com\"\nMapFilePath = \""+newMapFile+"\"\n[Signup]\nPolicy = \"everyone\"\n")
+
+	_, err = server.Reload()
+	if !errors.Is(err, incognitomail.ErrInvalidConfig) {
+		t.Errorf("expected ErrInvalidConfig, got %v", err)
+	}
+
+	if server.Config().Signup.Policy != "open" {
+		t.Errorf("expected signup policy to be kept after an invalid reload, got %q", server.Config().Signup.Policy)
+	}
+}
+
+// Ensure new mail system settings that fail the preflight checks are refused when reloading, leaving the current ones in place.
+func TestServer_Reload_Preflight(t *testing.T) {
+	t.Parallel()
+
+	dir, postfix := postfixSetup(t, "")
+	defer postfixTeardown(t, dir)
+
+	base := "[General]\nLockFilePath = \"" + filepath.Join(dir, "incognitomail.lock") + "\"\n" +
+		"[Persistence]\nDatabasePath = \"" + filepath.Join(dir, "incognitomail.db") + "\"\n" +
+		"[PostfixConfig]\nDomain = \"@sidhion.com\"\nPostmapPath = \"" + postfix.PostmapPath + "\"\nPostconfPath = \"" + postfix.PostconfPath + "\"\n"
+
+	config := incognitomail.DefaultConfiguration()
+	err := config.ReadFile(writeConfigFile(t, dir, base+"MapFilePath = \""+postfix.MapFilePath+"\"\n[General]\nSkipPreflightChecks = true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := incognitomail.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// The fake postconf doesn't list the domain anywhere, so the checks fail once they aren't skipped
+	writeConfigFile(t, dir, base+"MapFilePath = \""+filepath.Join(dir, "virtual.new")+"\"\n")
+
+	_, err = server.Reload()
+	if err == nil {
+		t.Fatal("expected the new mail system settings to fail the preflight checks")
+	}
+
+	if server.Config().PostfixConfig.MapFilePath != postfix.MapFilePath {
+		t.Errorf("expected the map file to be kept, got %q", server.Config().PostfixConfig.MapFilePath)
+	}
+}
+
+// Ensure requests keep being served while the configuration is reloaded, each one seeing either the old or the new configuration. Only meaningful with the race detector.
+func TestServer_Reload_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "incognitomail_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	base := "[General]\nSkipPreflightChecks = true\nAPIPath = \"/api/\"\nLockFilePath = \"" + filepath.Join(dir, "incognitomail.lock") + "\"\n" +
+		"[Persistence]\nDatabasePath = \"" + filepath.Join(dir, "incognitomail.db") + "\"\n" +
+		"[PostfixConfig]\nDomain = \"@sidhion.com\"\nMapFilePath = \"" + filepath.Join(dir, "canonical") + "\"\n"
+
+	path := writeConfigFile(t, dir, base)
+
+	config := incognitomail.DefaultConfiguration()
+	err = config.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := incognitomail.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	ts := httptest.NewServer(server.Handler())
+	defer ts.Close()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			contents := base + "[General]\nAllowedOrigin = \"https://sidhion.com\"\n"
+			if i%2 == 0 {
+				contents += "AllowedOrigin = \"https://example.com\"\n"
+			}
+
+			err := ioutil.WriteFile(path, []byte(contents), 0600)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			_, err = server.Reload()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	for i := 0; i < 100; i++ {
+		// Refused for not having a bearer token, after checking the origin
+		req, err := http.NewRequest(http.MethodGet, ts.URL+"/api/handles", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", "https://sidhion.com")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected status 401, got %d", resp.StatusCode)
+		}
+	}
+}
+
+// Ensure two servers with their own configuration can run in the same process.
+func TestServer_TwoServers(t *testing.T) {
+	t.Parallel()
+
+	first, _ := newTestServer(t, nil)
+	second, secondDir := newTestServer(t, nil)
+
+	if first.Config().Persistence.DatabasePath == second.Config().Persistence.DatabasePath {
+		t.Error("expected each server to keep its own configuration")
+	}
+
+	first.Stop()
+
+	_, err := os.Stat(filepath.Join(secondDir, "incognitomail.lock"))
+	if err != nil {
+		t.Errorf("expected the lock file of the second server to be kept, got %v", err)
+	}
+}
+
+// Ensure servers created without a configuration use the global Config.
+func TestServer_GlobalConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incognitomail_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	incognitomail.ResetConfig()
+	defer incognitomail.ResetConfig()
+
+	incognitomail.Config.General.SkipPreflightChecks = true
+	incognitomail.Config.General.LockFilePath = filepath.Join(dir, "incognitomail.lock")
+	incognitomail.Config.Persistence.DatabasePath = filepath.Join(dir, "incognitomail.db")
+	incognitomail.Config.PostfixConfig.Domain = "@sidhion.com"
+	incognitomail.Config.PostfixConfig.MapFilePath = filepath.Join(dir, "canonical")
+
+	server, err := incognitomail.NewServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	if server.Config().General.LockFilePath != incognitomail.Config.General.LockFilePath {
+		t.Errorf("expected the global lock file path, got %q", server.Config().General.LockFilePath)
+	}
+}
+
+// Ensure handles with their own targets can only forward to confirmed targets of the account when verification is enabled.
+func TestService_NewHandle_UnconfirmedTarget(t *testing.T) {
+	t.Parallel()
+
+	stub := newSMTPStub(t)
+	defer stub.listener.Close()
+
+	service, _ := newTestService(t, func(c *incognitomail.Configuration) {
+		c.Verification.Enabled = true
+		c.Verification.SMTPAddress = stub.listener.Addr().String()
+		c.Verification.From = "incognitomail@sidhion.com"
+	})
+
+	secret, err := service.NewAccount(accountTarget1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-stub.done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token is followed by an empty line and the closing sentence
+	lines := strings.Split(stub.data, "\n")
+	token := strings.TrimSpace(lines[len(lines)-3])
+
+	err = service.ConfirmTarget(secret, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = service.NewHandle(secret, accountTarget2)
+	if err != incognitomail.ErrTargetNotConfirmed {
+		t.Errorf("expected ErrTargetNotConfirmed, got %v", err)
+	}
+
+	_, err = service.NewHandle(secret, accountTarget1)
+	if err != nil {
+		t.Errorf("expected a handle forwarding to a confirmed target, got %v", err)
+	}
+}
+
+// Ensure an account can't delete handles from other accounts.
+func TestService_DeleteHandle_OtherAccount(t *testing.T) {
+	t.Parallel()
+
+	service, _ := newTestService(t, nil)
+	config := service.Config()
+
+	owner, err := service.NewAccount(accountTarget1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := service.NewAccount(accountTarget2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := service.NewHandle(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle = strings.TrimSuffix(handle, config.PostfixConfig.Domain)
+
+	err = service.DeleteHandle(other, handle)
+	if err != incognitomail.ErrHandleNotFound {
+		t.Errorf("expected ErrHandleNotFound, got %v", err)
+	}
+
+	if !strings.Contains(readMap(t, config.PostfixConfig), handle) {
+		t.Error("expected the handle to be kept in the map file")
+	}
+
+	err = service.DeleteHandle(owner, handle)
+	if err != nil {
+		t.Errorf("expected the owner to delete the handle, got %v", err)
+	}
+}
+
+// blockPostmap replaces the fake postmap in dir with one that waits until releasePostmap is called, and records in dir if two of them ever ran at the same time.
+func blockPostmap(t *testing.T, dir string) {
+	postmap := "#!/bin/sh\n" +
+		"dir=$(dirname \"$0\")\n" +
+		"[ -e \"$dir/running\" ] && touch \"$dir/overlap\"\n" +
+		"touch \"$dir/running\"\n" +
+		"while [ ! -e \"$dir/release\" ]; do sleep 0.01; done\n" +
+		"rm -f \"$dir/running\"\n"
+
+	err := ioutil.WriteFile(filepath.Join(dir, "postmap"), []byte(postmap), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// releasePostmap lets every postmap started by blockPostmap finish.
+func releasePostmap(t *testing.T, dir string) {
+	err := ioutil.WriteFile(filepath.Join(dir, "release"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor calls cond until it returns true, failing the test if it takes too long.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sendAsync sends the command in a new goroutine, returning a channel that receives its error.
+func sendAsync(service *incognitomail.Service, args string) <-chan error {
+	ch := make(chan error, 1)
+	go func() {
+		_, err := service.SendCommand("", args)
+		ch <- err
+	}()
+	return ch
+}
+
+// Ensure commands changing the mail system run one at a time, while reads and the readiness check don't wait for them.
+func TestService_MailSystemLock(t *testing.T) {
+	t.Parallel()
+
+	a := newAPITest(t, nil)
+
+	secret, err := a.service.SendCommand("", "new account "+accountTarget1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockPostmap(t, a.dir)
+
+	first := sendAsync(a.service, "new handle "+secret)
+	waitFor(t, "the first command to run postmap", func() bool {
+		_, err := os.Stat(filepath.Join(a.dir, "running"))
+		return err == nil
+	})
+
+	second := sendAsync(a.service, "new handle "+secret)
+	waitFor(t, "the second command to wait for the mail system", func() bool {
+		return a.service.WaitingCommands() == 1
+	})
+
+	read := sendAsync(a.service, "list "+secret)
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Errorf("expected handles to be listed, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected listing handles not to wait for the mail system")
+	}
+
+	resp, err := http.Get(a.server.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the service to be ready while a command changes the mail system, got status %d", resp.StatusCode)
+	}
+
+	releasePostmap(t, a.dir)
+
+	for _, ch := range []<-chan error{first, second} {
+		err := <-ch
+		if err != nil {
+			t.Errorf("expected handle to be created, got %v", err)
+		}
+	}
+
+	_, err = os.Stat(filepath.Join(a.dir, "overlap"))
+	if !os.IsNotExist(err) {
+		t.Error("expected postmap to never run twice at the same time")
+	}
+}
+
+// Ensure handles created by calling the service directly wait for each other the same as commands, and are written to the audit log.
+func TestService_NewHandle_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	a := newAPITest(t, withAuditLog(1024*1024, 1))
+
+	secret, err := a.service.NewAccount(accountTarget1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockPostmap(t, a.dir)
+
+	const calls = 3
+	results := make(chan error, calls)
+	for i := 0; i < calls; i++ {
+		go func() {
+			_, err := a.service.NewHandle(secret)
+			results <- err
+		}()
+	}
+
+	waitFor(t, "the other calls to wait for the mail system", func() bool {
+		return a.service.WaitingCommands() == calls-1
+	})
+
+	releasePostmap(t, a.dir)
+
+	for i := 0; i < calls; i++ {
+		err := <-results
+		if err != nil {
+			t.Errorf("expected handle to be created, got %v", err)
+		}
+	}
+
+	_, err = os.Stat(filepath.Join(a.dir, "overlap"))
+	if !os.IsNotExist(err) {
+		t.Error("expected postmap to never run twice at the same time")
+	}
+
+	handles, err := a.service.ListHandles(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(handles) != calls {
+		t.Fatalf("expected %d handles, got %v", calls, handles)
+	}
+
+	contents := readMap(t, a.service.Config().PostfixConfig)
+	for _, handle := range handles {
+		if !strings.Contains(contents, handle) {
+			t.Errorf("expected handle %s in the map file", handle)
+		}
+	}
+
+	entries, err := a.service.AuditLog(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != calls+1 {
+		t.Errorf("expected audit entries for the account and every handle, got %v", entries)
+	}
+}
+
+// Ensure a command waiting for the mail system longer than its deadline times out without changing anything.
+func TestService_MailSystemLock_Timeout(t *testing.T) {
+	t.Parallel()
+
+	a := newAPITest(t, nil)
+
+	secret, err := a.service.SendCommand("", "new account "+accountTarget1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockPostmap(t, a.dir)
+	defer releasePostmap(t, a.dir)
+
+	first := sendAsync(a.service, "new handle "+secret)
+
+	waitFor(t, "the first command to run postmap", func() bool {
+		_, err := os.Stat(filepath.Join(a.dir, "running"))
+		return err == nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = a.service.SendCommandContext(ctx, "rpc", "", "new handle "+secret)
+	if err != incognitomail.ErrCommandTimeout {
+		t.Errorf("expected ErrCommandTimeout, got %v", err)
+	}
+
+	releasePostmap(t, a.dir)
+	<-first
+
+	handles, err := a.service.SendCommand("", "list "+secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(strings.Fields(handles)); n != 1 {
+		t.Errorf("expected only the first handle to be created, got %d handles", n)
+	}
+}
+
+// Ensure a command with a cancelled context never changes anything, even if the mail system is free.
+func TestService_MailSystemLock_Cancelled(t *testing.T) {
+	t.Parallel()
+
+	a := newAPITest(t, nil)
+
+	secret, err := a.service.SendCommand("", "new account "+accountTarget1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The mail system is free, so this fails every now and then if a cancelled command can still take the lock
+	for i := 0; i < 20; i++ {
+		_, err = a.service.SendCommandContext(ctx, "rpc", "", "new handle "+secret)
+		if err != incognitomail.ErrCommandCancelled {
+			t.Fatalf("expected ErrCommandCancelled, got %v", err)
+		}
+	}
+
+	handles, err := a.service.SendCommand("", "list "+secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if handles != "" {
+		t.Errorf("expected no handles to be created, got %q", handles)
+	}
+
+	_, err = os.Stat(a.service.Config().PostfixConfig.MapFilePath)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected no map file to be written, got %v", err)
+	}
+}
+
+// Ensure a command still running after the drain timeout can finish its changes, instead of finding the database closed.
+func TestService_Close_DrainTimeout(t *testing.T) {
+	t.Parallel()
+
+	a := newAPITest(t, func(c *incognitomail.Configuration) {
+		c.General.DrainTimeout = "10ms"
+	})
+
+	secret, err := a.service.SendCommand("", "new account "+accountTarget1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := a.service.SendCommand("", "new handle "+secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handle = strings.TrimSuffix(handle, "@sidhion.com")
+
+	blockPostmap(t, a.dir)
+	defer releasePostmap(t, a.dir)
+
+	running := sendAsync(a.service, "delete handle "+handle+" "+secret)
+	waitFor(t, "the command to run postmap", func() bool {
+		_, err := os.Stat(filepath.Join(a.dir, "running"))
+		return err == nil
+	})
+
+	a.service.Close()
+
+	_, err = a.service.SendCommand("", "list "+secret)
+	if err != incognitomail.ErrServerStopping {
+		t.Errorf("expected ErrServerStopping, got %v", err)
+	}
+
+	releasePostmap(t, a.dir)
+
+	err = <-running
+	if err != nil {
+		t.Errorf("expected the running command to finish, got %v", err)
+	}
+
+	// Opening the database waits until the service closes it
+	data, err := incognitomail.OpenIncognitoData(filepath.Join(a.dir, "incognitomail.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	if data.HasAccountHandle(secret, handle) {
+		t.Error("expected the handle to be deleted from the database")
+	}
+}
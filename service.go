@@ -0,0 +1,200 @@
+package incognitomail
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/websocket"
+)
+
+// Service executes commands against the database and the mail system. It has no side effects besides the files in its configuration: it doesn't take a lock file, listen on any address or handle signals, so it can be used inside other programs, with Handler mounted on their own mux. Its methods for accounts, handles and invites run the same commands as the RPC interface, with the same permissions, locking, audit log and metrics. Server adds all of that on top of a Service to run it as a daemon.
+type Service struct {
+	// Replaced as a whole when reloading, while holding configMu. Always read through currentConfig, once per command or request, so a single one never sees two different configurations
+	config atomic.Pointer[Configuration]
+
+	persistence *IncognitoData
+
+	// Replaced when reloading, while holding configMu and the mail system lock
+	mailSystemWriter MailSystemHandleWriter
+
+	verifier        TargetVerifier
+	authLimiter     *authLimiter
+	auditLog        *auditLog
+	mailSystemLock  chan struct{}
+	waitingCommands int64
+	metrics         *serviceMetrics
+
+	// Time the mail system was locked, in nanoseconds since the Unix epoch, or zero if it's unlocked
+	mailSystemLockedAt int64
+
+	// Held by every running command and health check, and exclusively while reloading the configuration, so they never see a partially applied configuration
+	configMu sync.RWMutex
+
+	// Protects started and stopping, so no command starts running before the service started or after it started stopping
+	stopMu   sync.RWMutex
+	started  bool
+	stopping bool
+	running  sync.WaitGroup
+
+	// Extra checks done by the readiness endpoint, by name
+	readyChecks map[string]func() error
+
+	closeOnce sync.Once
+}
+
+// NewService returns a Service ready to execute commands, with a copy of the given configuration. Opens the database and the audit log, which are only released by Close.
+// If the configuration is invalid, a *ConfigError listing every invalid value is returned instead.
+func NewService(c *Configuration) (*Service, error) {
+	s, err := newService(c)
+	if err != nil {
+		return nil, err
+	}
+
+	s.started = true
+	return s, nil
+}
+
+// newService does the work of NewService, but leaves the service refusing commands until it's marked as started.
+func newService(c *Configuration) (*Service, error) {
+	err := c.Check()
+	if err != nil {
+		return nil, err
+	}
+
+	config := c.clone()
+	metrics := newServiceMetrics()
+
+	s := &Service{
+		mailSystemWriter: mailSystemWriterFromConfig(config, metrics),
+		mailSystemLock:   make(chan struct{}, 1),
+		authLimiter:      newAuthLimiterFromConfig(config.BruteForce),
+		metrics:          metrics,
+	}
+	s.config.Store(config)
+
+	if config.Verification.Enabled {
+		s.verifier = NewSMTPVerifierFromConfig(config.Verification)
+	}
+
+	// Checking permissions before anything else, so we don't even open the database if we can't change the mail system
+	if !config.General.SkipPreflightChecks {
+		err = s.mailSystemWriter.Preflight()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := OpenIncognitoData(config.Persistence.DatabasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	s.auditLog, err = openAuditLogFromConfig(config.Audit)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+
+	s.persistence = data
+	return s, nil
+}
+
+// Handler returns an http.Handler serving the websocket, the REST API, the health and readiness endpoints and, if they don't have their own listen address, the metrics, all in the paths given by the configuration.
+func (s *Service) Handler() http.Handler {
+	mux := http.NewServeMux()
+	config := s.currentConfig()
+
+	if len(config.General.AllowedOrigin) == 0 {
+		logEntry(logLevelInfo, "No allowed origins configured, web pages won't be able to send commands to the server", nil)
+	}
+
+	mux.HandleFunc(config.General.ListenPath, s.serveWebsocket)
+
+	if config.General.APIPath != "" {
+		mux.Handle(strings.TrimSuffix(config.General.APIPath, "/")+"/", newAPIHandler(s, config.General.APIPath))
+	}
+
+	if config.General.HealthPath != "" {
+		mux.HandleFunc(config.General.HealthPath, s.serveHealth)
+	}
+
+	if config.General.ReadyPath != "" {
+		mux.HandleFunc(config.General.ReadyPath, s.serveReady)
+	}
+
+	if config.Metrics.Enabled && config.Metrics.ListenAddress == "" {
+		mux.Handle(config.Metrics.Path, newMetricsHandler(s))
+	}
+
+	return mux
+}
+
+// serveWebsocket receives a single command from a websocket connection and sends back its result.
+// We listen for websocket connection this way to check the Origin header against our own list, instead of websocket.Server's default check which refuses the "null" Origin header sent by some pages and add-ons.
+func (s *Service) serveWebsocket(w http.ResponseWriter, req *http.Request) {
+	server := websocket.Server{Handshake: s.checkWebsocketOrigin, Handler: websocket.Handler(func(ws *websocket.Conn) {
+		atomic.AddInt64(&s.metrics.websocketConnections, 1)
+		defer atomic.AddInt64(&s.metrics.websocketConnections, -1)
+
+		var args string
+
+		err := websocket.Message.Receive(ws, &args)
+		if err != nil {
+			logEntry(logLevelDebug, "Error receiving command from websocket", logFields{"remote_addr": req.RemoteAddr, "error": err})
+			websocket.Message.Send(ws, "error receiving command")
+			return
+		}
+
+		result, err := s.SendCommandContext(req.Context(), sourceWebsocket, req.RemoteAddr, args)
+		if err != nil {
+			websocket.Message.Send(ws, "error "+err.Error())
+			return
+		}
+
+		websocket.Message.Send(ws, result)
+	})}
+
+	server.ServeHTTP(w, req)
+}
+
+// Close refuses new commands, gives running commands up to the drain timeout to finish, then closes the database and the audit log. Calling Close more than once has no effect, and every call returns only after the service was closed.
+// If commands are still running after the drain timeout, Close returns without waiting for them, and the database and the audit log are only closed once they finish.
+func (s *Service) Close() {
+	s.closeOnce.Do(func() {
+		s.stopMu.Lock()
+		s.stopping = true
+		s.stopMu.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.currentConfig().drainTimeout())
+		defer cancel()
+
+		// New commands are refused from now on, so nothing changes the mail system or the database once the running ones finish
+		done := s.drainCommands(ctx)
+
+		select {
+		case <-done:
+			s.closeStorage()
+		default:
+			go func() {
+				<-done
+				s.closeStorage()
+			}()
+		}
+	})
+}
+
+// currentConfig returns the configuration currently used by the service. The returned configuration is never changed, reloading replaces it with a new one instead.
+func (s *Service) currentConfig() *Configuration {
+	return s.config.Load()
+}
+
+// closeStorage closes the database and the audit log, and must only be called once no command is running.
+func (s *Service) closeStorage() {
+	s.persistence.Close()
+	if s.auditLog != nil {
+		s.auditLog.close()
+	}
+}
@@ -0,0 +1,158 @@
+package incognitomail_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+// newTestConfig returns a configuration keeping every file in a new temporary directory, with the fake postfix from postfixSetup and the preflight checks skipped, changed by configure if not nil. Also returns the directory, which is removed once the test finishes.
+func newTestConfig(t *testing.T, configure func(*incognitomail.Configuration)) (*incognitomail.Configuration, string) {
+	dir, postfix := postfixSetup(t, "")
+	t.Cleanup(func() { postfixTeardown(t, dir) })
+
+	config := incognitomail.DefaultConfiguration()
+	config.General.SkipPreflightChecks = true
+	config.General.UnixSockPath = filepath.Join(dir, "incognitomail.sock")
+	config.General.LockFilePath = filepath.Join(dir, "incognitomail.lock")
+	config.Persistence.DatabasePath = filepath.Join(dir, "incognitomail.db")
+	config.PostfixConfig = postfix
+
+	if configure != nil {
+		configure(config)
+	}
+
+	return config, dir
+}
+
+// newTestService returns a service created from newTestConfig, which is closed once the test finishes.
+func newTestService(t *testing.T, configure func(*incognitomail.Configuration)) (*incognitomail.Service, string) {
+	config, dir := newTestConfig(t, configure)
+
+	service, err := incognitomail.NewService(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(service.Close)
+
+	return service, dir
+}
+
+// Ensure a service runs without a lock file, serves its endpoints from its handler and refuses commands once closed.
+func TestService_Handler(t *testing.T) {
+	t.Parallel()
+
+	service, _ := newTestService(t, nil)
+	config := service.Config()
+
+	_, err := os.Stat(config.General.LockFilePath)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected no lock file, got %v", err)
+	}
+
+	ts := httptest.NewServer(service.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + config.General.ReadyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	var ready struct {
+		Checks map[string]interface{} `json:"checks"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&ready)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := ready.Checks["lock"]; ok {
+		t.Error("expected no lock file check in the readiness response")
+	}
+
+	_, err = service.SendCommand("", "invite new")
+	if err != nil {
+		t.Errorf("expected the service to execute commands, got %v", err)
+	}
+
+	service.Close()
+
+	_, err = service.SendCommand("", "invite new")
+	if err != incognitomail.ErrServerStopping {
+		t.Errorf("expected ErrServerStopping, got %v", err)
+	}
+}
+
+// Ensure an invalid configuration is refused with every invalid value listed, instead of creating a service that can't work.
+func TestService_InvalidConfig(t *testing.T) {
+	t.Parallel()
+
+	config, _ := newTestConfig(t, func(c *incognitomail.Configuration) {
+		c.General.MailSystem = "exim"
+		c.General.CommandTimeout = "soon"
+	})
+
+	_, err := incognitomail.NewService(config)
+
+	var configErr *incognitomail.ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected a ConfigError, got %v", err)
+	}
+
+	for _, key := range []string{"General.MailSystem", "General.CommandTimeout"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("expected %s to be listed, got %v", key, err)
+		}
+	}
+
+	_, err = os.Stat(config.Persistence.DatabasePath)
+	if !os.IsNotExist(err) {
+		t.Errorf("expected the database not to be created, got %v", err)
+	}
+}
+
+// Ensure the permissions of a service can't be changed through the configuration it was created with, or through the copy returned by Config.
+func TestService_ConfigCopy(t *testing.T) {
+	t.Parallel()
+
+	config, _ := newTestConfig(t, func(c *incognitomail.Configuration) {
+		c.Permissions = map[string]*incognitomail.PermissionConfig{"rpc": {NewAccount: "deny"}}
+		c.AccountPermissions = map[string]*incognitomail.PermissionConfig{"3f2a9c1d0e8b7a65:rpc": {NewHandle: "deny"}}
+	})
+
+	service, err := incognitomail.NewService(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	config.Permissions["rpc"].NewAccount = "allow"
+	config.AccountPermissions["3f2a9c1d0e8b7a65:rpc"] = &incognitomail.PermissionConfig{NewHandle: "allow"}
+
+	copied := service.Config()
+	copied.Permissions["rpc"].NewAccount = "allow"
+	delete(copied.AccountPermissions, "3f2a9c1d0e8b7a65:rpc")
+
+	current := service.Config()
+
+	if current.Permissions["rpc"].NewAccount != "deny" {
+		t.Errorf("expected NewAccount to stay denied, got %q", current.Permissions["rpc"].NewAccount)
+	}
+
+	if p := current.AccountPermissions["3f2a9c1d0e8b7a65:rpc"]; p == nil || p.NewHandle != "deny" {
+		t.Errorf("expected NewHandle to stay denied for the account, got %v", p)
+	}
+}
@@ -0,0 +1,125 @@
+package incognitomail
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// Accounts can't be created from the websocket at all.
+	signupPolicyDisabled = "disabled"
+
+	// Anyone can create accounts from the websocket.
+	signupPolicyOpen = "open"
+
+	// Accounts can be created from the websocket with an invite code, which is consumed on success.
+	signupPolicyInvite = "invite"
+
+	// Accounts can be created from the websocket if every target belongs to one of the allowed domains.
+	signupPolicyAllowList = "allowlist"
+
+	inviteCodeSize = 16
+)
+
+var (
+	// ErrInviteRequired is used when the signup policy requires an invite code, but none was given.
+	ErrInviteRequired = errors.New("invite code required")
+
+	// ErrTargetNotAllowed is used when the signup policy only allows some domains, and a target doesn't belong to any of them.
+	ErrTargetNotAllowed = errors.New("target domain not allowed")
+)
+
+// checkSignupPolicy returns nil if an account with the given targets can be created from the websocket according to the policy in config. The invite code is only checked, and must be consumed by the caller once the account is created.
+func (s *Service) checkSignupPolicy(config *Configuration, targets []string, inviteCode string) error {
+	switch config.Signup.Policy {
+	case signupPolicyOpen:
+		return nil
+	case signupPolicyInvite:
+		if inviteCode == "" {
+			return ErrInviteRequired
+		}
+
+		if !s.persistence.HasInvite(inviteCode) {
+			return ErrInviteNotFound
+		}
+
+		return nil
+	case signupPolicyAllowList:
+		targets, err := validateTargets(targets)
+		if err != nil {
+			return err
+		}
+
+		for _, t := range targets {
+			if !domainAllowed(config.Signup.AllowedDomain, t[strings.LastIndex(t, "@")+1:]) {
+				return ErrTargetNotAllowed
+			}
+		}
+
+		return nil
+	}
+
+	return ErrInvalidPermission
+}
+
+// domainAllowed returns true if the given domain is in the list of allowed domains for signup.
+func domainAllowed(allowedDomains []string, domain string) bool {
+	for _, d := range allowedDomains {
+		if strings.EqualFold(strings.TrimPrefix(d, "@"), domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewInvite creates a new invite code that can be used once to create an account from the websocket or the API. Same as the "invite new" command.
+func (s *Service) NewInvite() (string, error) {
+	res, err := s.runLocalCommand(newInviteCommand{source: sourceRPC})
+	code, _ := res.(string)
+	return code, err
+}
+
+// ListInvites returns all invite codes that haven't been used yet. Same as the "invite list" command.
+func (s *Service) ListInvites() ([]string, error) {
+	res, err := s.runLocalCommand(listInvitesCommand{source: sourceRPC})
+	codes, _ := res.([]string)
+	return codes, err
+}
+
+// DeleteInvite deletes the given invite code, so it can't be used anymore. Same as the "invite delete" command.
+func (s *Service) DeleteInvite(code string) error {
+	_, err := s.runLocalCommand(deleteInviteCommand{source: sourceRPC, code: code})
+	return err
+}
+
+// newInvite creates a new invite code that can be used once to create an account from the websocket.
+func (s *Service) newInvite() (string, error) {
+	for {
+		code, err := generateRandomString(inviteCodeSize)
+		if err != nil {
+			return "", err
+		}
+
+		err = s.persistence.NewInvite(code)
+		if err == ErrInviteExists {
+			continue
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		return code, nil
+	}
+}
+
+// listInvites returns all invite codes that haven't been used yet.
+func (s *Service) listInvites() ([]string, error) {
+	return s.persistence.ListInvites()
+}
+
+// deleteInvite deletes the given invite code, so it can't be used anymore.
+func (s *Service) deleteInvite(code string) error {
+	return s.persistence.DeleteInvite(code)
+}
@@ -0,0 +1,248 @@
+package incognitomail_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+// signupOrigin is the origin sent by the websocket client, allowed by newSignupTest.
+const signupOrigin = "http://localhost"
+
+// signupTest holds a started server with the given signup policy, serving the websocket and the REST API from a test HTTP server.
+type signupTest struct {
+	t      *testing.T
+	server *incognitomail.Server
+	rpc    *incognitomail.RPCService
+	http   *httptest.Server
+}
+
+// newSignupTest creates a server with the given signup policy, only allowing targets from example.com with the allowlist policy. Everything is stopped once the test finishes.
+func newSignupTest(t *testing.T, policy string) *signupTest {
+	server, _ := newTestServer(t, func(c *incognitomail.Configuration) {
+		c.General.APIPath = "/api/"
+		c.General.AllowedOrigin = []string{signupOrigin}
+		c.Signup.Policy = policy
+		c.Signup.AllowedDomain = []string{"example.com"}
+		c.BruteForce.Enabled = false
+	})
+
+	s := &signupTest{
+		t:      t,
+		server: server,
+		rpc:    incognitomail.NewRPCService(server),
+		http:   httptest.NewServer(server.Handler()),
+	}
+	t.Cleanup(s.http.Close)
+
+	return s
+}
+
+// newAccount creates an account through the given source, with the invite code if not empty, and returns the error reported by that source.
+// Errors from the websocket and the API only arrive as text, so they are returned as new errors with the same message.
+func (s *signupTest) newAccount(source string, targets []string, invite string) error {
+	switch source {
+	case "websocket":
+		args := "new account "
+		if invite != "" {
+			args += "invite " + invite + " "
+		}
+		args += strings.Join(targets, " ")
+
+		ws, err := websocket.Dial("ws"+strings.TrimPrefix(s.http.URL, "http")+s.server.Config().General.ListenPath, "", signupOrigin)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		defer ws.Close()
+
+		err = websocket.Message.Send(ws, args)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+
+		var res string
+		err = websocket.Message.Receive(ws, &res)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+
+		if strings.HasPrefix(res, "error ") {
+			return errors.New(strings.TrimPrefix(res, "error "))
+		}
+
+		return nil
+	case "http":
+		body, err := json.Marshal(map[string]interface{}{"targets": targets, "invite": invite})
+		if err != nil {
+			s.t.Fatal(err)
+		}
+
+		resp, err := http.Post(s.http.URL+"/api/accounts", "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			s.t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == http.StatusCreated {
+			return nil
+		}
+
+		var res struct {
+			Error string `json:"error"`
+		}
+
+		err = json.NewDecoder(resp.Body).Decode(&res)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+
+		return errors.New(res.Error)
+	case "rpc":
+		// The RPC interface has no way to send an invite code, since the policy never applies to it
+		_, err := s.rpc.NewAccount("", incognitomail.NewAccountRequest{Targets: targets})
+		return err
+	}
+
+	s.t.Fatalf("unknown source %q", source)
+	return nil
+}
+
+// hasInvite returns true if the invite code wasn't used yet.
+func (s *signupTest) hasInvite(code string) bool {
+	codes, err := s.server.ListInvites()
+	if err != nil {
+		s.t.Fatal(err)
+	}
+
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+// errorMessage returns the message of err, or an empty string if it's nil, so errors that only arrived as text can be compared.
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return err.Error()
+}
+
+// Ensure the signup policy decides which accounts can be created from the websocket and the API, that invite codes are only consumed by accounts that were created, and that the RPC interface isn't subject to the policy.
+func TestSignup_Policies(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		policy  string
+		targets []string
+		// "new" stands for an invite code created right before the account
+		invite string
+		err    error
+	}{
+		{"disabled", []string{accountTarget1}, "", incognitomail.ErrInvalidPermission},
+		{"open", []string{accountTarget1}, "", nil},
+		{"invite", []string{accountTarget1}, "", incognitomail.ErrInviteRequired},
+		{"invite", []string{accountTarget1}, "unknown", incognitomail.ErrInviteNotFound},
+		{"invite", []string{accountTarget1}, "new", nil},
+		{"invite", []string{"not an address"}, "new", incognitomail.ErrInvalidTarget},
+		{"allowlist", []string{accountTarget1, accountTarget2}, "", nil},
+		{"allowlist", []string{accountTarget1, "someone@sidhion.com"}, "", incognitomail.ErrTargetNotAllowed},
+	}
+
+	for _, test := range tests {
+		s := newSignupTest(t, test.policy)
+
+		for _, source := range []string{"websocket", "http", "rpc"} {
+			invite := test.invite
+			if invite == "new" {
+				var err error
+				invite, err = s.server.NewInvite()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected := test.err
+			if source == "rpc" && expected != incognitomail.ErrInvalidTarget {
+				expected = nil
+			}
+
+			err := s.newAccount(source, test.targets, invite)
+			if errorMessage(err) != errorMessage(expected) {
+				t.Errorf("expected %v creating an account with %v and invite %q from %s with the %s policy, got %v", expected, test.targets, test.invite, source, test.policy, err)
+			}
+
+			if test.invite == "new" {
+				consumed := err == nil && source != "rpc"
+				if s.hasInvite(invite) == consumed {
+					t.Errorf("expected the invite code to be consumed only if the account was created from %s with the %s policy, got consumed=%v for %v", source, test.policy, !consumed, err)
+				}
+			}
+		}
+	}
+}
+
+// Ensure a single invite code can't be used by two accounts created at the same time.
+func TestSignup_Invite_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	s := newSignupTest(t, "invite")
+
+	invite, err := s.server.NewInvite()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const attempts = 32
+	errs := make(chan error, attempts)
+
+	// Every attempt waits for the others to be ready, so they check the invite code as close together as possible
+	start := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			<-start
+			_, err := s.server.SendCommandContext(context.Background(), "websocket", "127.0.0.1:1234", "new account invite "+invite+" "+accountTarget1)
+			errs <- err
+		}()
+	}
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	created := 0
+	for err := range errs {
+		switch err {
+		case nil:
+			created++
+		case incognitomail.ErrInviteNotFound:
+		default:
+			t.Errorf("expected ErrInviteNotFound for every other account, got %v", err)
+		}
+	}
+
+	if created != 1 {
+		t.Errorf("expected a single account to be created with the invite code, got %d", created)
+	}
+
+	if s.hasInvite(invite) {
+		t.Error("expected the invite code to be consumed")
+	}
+}
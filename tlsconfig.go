@@ -0,0 +1,88 @@
+package incognitomail
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+)
+
+var (
+	// tlsVersions maps the versions accepted in TLSMinVersion to their values in crypto/tls.
+	tlsVersions = map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	// ErrInvalidClientCA is used when the client CA file has no certificates.
+	ErrInvalidClientCA = errors.New("no certificates found in the client CA file")
+)
+
+// applyTLSPolicy sets the minimum version, cipher suites and client certificate verification from the [General] section in c.
+// Client certificates are required for every connection to c, so they cover every path served with it, including the health, readiness and metrics paths. Only the metrics served in their own address are left out.
+func applyTLSPolicy(c *tls.Config, g GeneralConfig) error {
+	// Already checked when validating the config
+	c.MinVersion = tlsVersions[g.TLSMinVersion]
+
+	for _, name := range g.TLSCipherSuite {
+		c.CipherSuites = append(c.CipherSuites, tlsCipherSuiteID(name))
+	}
+
+	if g.TLSClientCAFile != "" {
+		pem, err := ioutil.ReadFile(g.TLSClientCAFile)
+		if err != nil {
+			return err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return ErrInvalidClientCA
+		}
+
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return nil
+}
+
+// tlsCipherSuiteID returns the ID of the cipher suite with the given name, or 0 if it's unknown or insecure.
+func tlsCipherSuiteID(name string) uint16 {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID
+		}
+	}
+
+	return 0
+}
+
+// tls13CipherSuite returns true if the cipher suite with the given name is only used by TLS 1.3.
+func tls13CipherSuite(name string) bool {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13
+		}
+	}
+
+	return false
+}
+
+// checkTLSPolicyConfig records a TLS version or cipher suites in the configuration that aren't known.
+func checkTLSPolicyConfig(c *Configuration, p *configProblems) {
+	if _, ok := tlsVersions[c.General.TLSMinVersion]; !ok {
+		p.add("General.TLSMinVersion", "%q must be one of \"1.0\", \"1.1\", \"1.2\" or \"1.3\"", c.General.TLSMinVersion)
+	}
+
+	for _, name := range c.General.TLSCipherSuite {
+		switch {
+		case tlsCipherSuiteID(name) == 0:
+			p.add("General.TLSCipherSuite", "%q is not a known secure cipher suite", name)
+		case tls13CipherSuite(name):
+			// crypto/tls ignores the configured suites for TLS 1.3, so listing one would suggest a choice that has no effect
+			p.add("General.TLSCipherSuite", "%q is a TLS 1.3 cipher suite, which can't be configured", name)
+		}
+	}
+}
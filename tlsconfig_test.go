@@ -0,0 +1,79 @@
+package incognitomail_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+// Ensure connections with an older TLS version than the minimum, or without a client certificate from the client CA, are refused during the handshake.
+func TestApplyTLSPolicy_Handshake(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "incognitomail_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	serverCertFile, serverKeyFile := writeKeyPair(t, dir, "server")
+	clientCertFile, clientKeyFile := writeKeyPair(t, dir, "client")
+
+	general := incognitomail.DefaultConfiguration().General
+	general.TLSMinVersion = "1.2"
+	general.TLSClientCAFile = clientCertFile
+
+	serverCert, err := tls.LoadX509KeyPair(serverCertFile, serverKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	ts.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+
+	err = incognitomail.ApplyTLSPolicy(ts.TLS, general)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	tests := []struct {
+		name     string
+		config   *tls.Config
+		accepted bool
+	}{
+		{"client certificate", &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}, true},
+		{"no client certificate", &tls.Config{RootCAs: roots}, false},
+		{"TLS 1.1", &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}, MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}, false},
+	}
+
+	for _, test := range tests {
+		test.config.ServerName = "localhost"
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: test.config}}
+
+		resp, err := client.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+
+		if (err == nil) != test.accepted {
+			t.Errorf("%s: expected the connection to be accepted: %v, got %v", test.name, test.accepted, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package incognitomail
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FieldError describes why a single config key is invalid.
+type FieldError struct {
+	// Field is the key with its section, e.g. "General.ListenAddress" or `Permissions "websocket".NewHandle`.
+	Field  string
+	Reason string
+}
+
+// ConfigError is returned when the configuration has invalid values, and lists every invalid key. It matches ErrInvalidConfig with errors.Is.
+type ConfigError struct {
+	Fields []FieldError
+}
+
+// configProblems collects the invalid keys found while checking the configuration.
+type configProblems struct {
+	fields []FieldError
+}
+
+// Error returns the field and the reason in a single line.
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Reason
+}
+
+// Error lists every invalid key in a single line.
+func (e *ConfigError) Error() string {
+	reasons := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		reasons[i] = f.Error()
+	}
+
+	return ErrInvalidConfig.Error() + ": " + strings.Join(reasons, "; ")
+}
+
+// Unwrap returns ErrInvalidConfig, so callers that only care whether the configuration is valid can keep checking for it.
+func (e *ConfigError) Unwrap() error {
+	return ErrInvalidConfig
+}
+
+// add records that field is invalid, with the reason formatted as in fmt.Sprintf.
+func (p *configProblems) add(field, format string, args ...interface{}) {
+	p.fields = append(p.fields, FieldError{Field: field, Reason: fmt.Sprintf(format, args...)})
+}
+
+// err returns a ConfigError with all problems found, or nil if there are none.
+func (p *configProblems) err() error {
+	if len(p.fields) == 0 {
+		return nil
+	}
+
+	return &ConfigError{Fields: p.fields}
+}
+
+// required records field as invalid if value is empty.
+func (p *configProblems) required(field, value string) {
+	if value == "" {
+		p.add(field, "must be set")
+	}
+}
+
+// absolutePath records field as invalid if path is set, but isn't absolute.
+func (p *configProblems) absolutePath(field, path string) {
+	if path != "" && !filepath.IsAbs(path) {
+		p.add(field, "%q must be an absolute path", path)
+	}
+}
+
+// duration records field as invalid if value isn't a duration, or isn't bigger than zero when positive is true.
+func (p *configProblems) duration(field, value string, positive bool) {
+	d, err := time.ParseDuration(value)
+	switch {
+	case err != nil:
+		p.add(field, "%q is not a duration, e.g. \"30s\"", value)
+	case positive && d <= 0:
+		p.add(field, "must be bigger than zero")
+	case d < 0:
+		p.add(field, "must not be negative")
+	}
+}
+
+// address records field as invalid if value isn't in the host:port form used to listen or connect, with a port number or service name.
+func (p *configProblems) address(field, value string) {
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		p.add(field, "%q is not a valid address: %s", value, err)
+		return
+	}
+
+	_, err = net.LookupPort("tcp", port)
+	if err != nil {
+		p.add(field, "%q does not have a valid port", value)
+	}
+}
+
+// keyPair records the certificate and key fields as invalid if they aren't both set, or if they can't be loaded as a matching pair.
+func (p *configProblems) keyPair(certField, certFile, keyField, keyFile string) {
+	if certFile == "" && keyFile == "" {
+		return
+	}
+
+	if certFile == "" {
+		p.add(certField, "must be set when %s is set", keyField)
+		return
+	}
+
+	if keyFile == "" {
+		p.add(keyField, "must be set when %s is set", certField)
+		return
+	}
+
+	_, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		p.add(certField, "could not be loaded with %s: %s", keyField, err)
+	}
+}
+
+// validDomainName returns true if name is a fully qualified domain name, such as "sidhion.com". A trailing dot isn't allowed.
+func validDomainName(name string) bool {
+	if len(name) == 0 || len(name) > 253 {
+		return false
+	}
+
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return false
+	}
+
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,55 @@
+package incognitomail
+
+import (
+	"bytes"
+	"fmt"
+	"net/smtp"
+	"time"
+)
+
+// TargetVerifier sends confirmation tokens to targets, so accounts are only activated once their owners prove they receive mail in every target.
+type TargetVerifier interface {
+	SendToken(target, token string) error
+}
+
+// SMTPVerifier sends confirmation tokens through an SMTP server, usually the local MTA.
+type SMTPVerifier struct {
+	address string
+	from    string
+}
+
+const (
+	confirmationTokenSize = 32
+)
+
+// NewSMTPVerifier returns a SMTPVerifier that sends messages through the SMTP server listening in address, using from as the sender.
+func NewSMTPVerifier(address, from string) *SMTPVerifier {
+	return &SMTPVerifier{
+		address: address,
+		from:    from,
+	}
+}
+
+// NewSMTPVerifierFromConfig returns a SMTPVerifier initialized with values from the [Verification] section.
+func NewSMTPVerifierFromConfig(c VerificationConfig) *SMTPVerifier {
+	return NewSMTPVerifier(c.SMTPAddress, c.From)
+}
+
+// SendToken sends a message with the token to the target.
+func (v *SMTPVerifier) SendToken(target, token string) error {
+	var msg bytes.Buffer
+
+	fmt.Fprintf(&msg, "From: %s\r\n", v.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", target)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Subject: Confirm your IncognitoMail address\r\n")
+	fmt.Fprintf(&msg, "\r\n")
+	fmt.Fprintf(&msg, "This address was registered as a target of an IncognitoMail account.\r\n")
+	fmt.Fprintf(&msg, "No messages will be forwarded until the account is confirmed with the following token:\r\n")
+	fmt.Fprintf(&msg, "\r\n")
+	fmt.Fprintf(&msg, "%s\r\n", token)
+	fmt.Fprintf(&msg, "\r\n")
+	fmt.Fprintf(&msg, "If you didn't expect this message, you can safely ignore it.\r\n")
+
+	return smtp.SendMail(v.address, nil, v.from, []string{target}, msg.Bytes())
+}
@@ -0,0 +1,119 @@
+package incognitomail_test
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/danielsidhion/incognitomail"
+)
+
+// smtpStub is a minimal SMTP server that accepts a single message and records it.
+type smtpStub struct {
+	listener net.Listener
+	rcpt     []string
+	data     string
+	done     chan error
+}
+
+// newSMTPStub starts listening in a random local port.
+func newSMTPStub(t *testing.T) *smtpStub {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := &smtpStub{
+		listener: l,
+		done:     make(chan error, 1),
+	}
+
+	go func() {
+		stub.done <- stub.serve()
+	}()
+
+	return stub
+}
+
+// serve handles a single connection, answering every command with success.
+func (s *smtpStub) serve() error {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost stub")
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return err
+		}
+
+		verb := strings.ToUpper(strings.Fields(line)[0])
+
+		switch verb {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "RCPT":
+			s.rcpt = append(s.rcpt, line)
+			tp.PrintfLine("250 ok")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+
+			lines, err := tp.ReadDotLines()
+			if err != nil {
+				return err
+			}
+
+			s.data = strings.Join(lines, "\n")
+			tp.PrintfLine("250 ok")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return nil
+		default:
+			tp.PrintfLine("250 ok")
+		}
+	}
+}
+
+// Ensure the SMTP verifier delivers the token to the target.
+func TestSMTPVerifier_SendToken(t *testing.T) {
+	t.Parallel()
+
+	stub := newSMTPStub(t)
+	defer stub.listener.Close()
+
+	v := incognitomail.NewSMTPVerifier(stub.listener.Addr().String(), "incognitomail@sidhion.com")
+
+	err := v.SendToken(accountTarget1, "t0k3n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-stub.done
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stub.rcpt) != 1 || !strings.Contains(stub.rcpt[0], accountTarget1) {
+		t.Fatal("message not sent to target, recipients: ", stub.rcpt)
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(stub.data))
+	found := false
+
+	for scanner.Scan() {
+		if scanner.Text() == "t0k3n" {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Fatalf("token not found in message:\n%s", stub.data)
+	}
+}